@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// addChirpsBatchHandler creates several chirps for the authenticated user
+// in one transaction; either every chirp is stored or none is.
+func (cfg *apiConfig) addChirpsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	var params []parameters
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
+
+	userID := requestUserID(r)
+
+	if len(params) == 0 {
+		returnError(w, http.StatusBadRequest, fmt.Errorf("batch is empty"))
+		return
+	}
+	if len(params) > cfg.maxChirpBatch {
+		returnError(w, http.StatusBadRequest, fmt.Errorf("batch may contain at most %d chirps", cfg.maxChirpBatch))
+		return
+	}
+
+	bodies := make([]string, len(params))
+	for i, p := range params {
+		body, err := cfg.prepareChirpBody(r, p.Body)
+		if err != nil {
+			// error.index points at the chirp that failed validation
+			writeErrorBody(w, http.StatusBadRequest, errorBody{
+				Code:    chirpErrorCode(err),
+				Message: err.Error(),
+				Index:   &i,
+			})
+			return
+		}
+		bodies[i] = body
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	// the per-user quota applies to every chirp in the batch
+	if !cfg.allowChirps(w, ctx, userID, len(bodies)) {
+		return
+	}
+
+	chirps := make([]Chirp, 0, len(bodies))
+	err := cfg.withTx(ctx, func(q *database.Queries) error {
+		for _, body := range bodies {
+			dbChirp, err := q.CreateChirp(ctx, database.CreateChirpParams{Body: body, UserID: userID})
+			if err != nil {
+				return err
+			}
+			chirps = append(chirps, chirpFromDB(dbChirp))
+		}
+		return nil
+	})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	for _, chirp := range chirps {
+		cfg.chirpHub.publish(chirp)
+	}
+
+	respondJSON(w, http.StatusCreated, chirps)
+}
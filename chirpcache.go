@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// defaultChirpCacheSize is how many chirps getChirpHandler keeps in memory
+// unless CHIRP_CACHE_SIZE says otherwise; 0 turns the cache off.
+const defaultChirpCacheSize = 1000
+
+// defaultChirpCacheTTL bounds how long a cached chirp is served unless
+// CHIRP_CACHE_TTL says otherwise.
+const defaultChirpCacheTTL = 30 * time.Second
+
+// chirpCache is an LRU of chirps by ID in front of GetChirp. It only ever
+// holds chirps that aren't deleted, so a hit is right for every viewer.
+// Handlers that change a chirp must forget it, and callers fill it from the
+// primary so a lagging replica can't put an old version back. It is safe
+// for concurrent use, and a nil cache is disabled: it never hits and
+// ignores writes.
+//
+// Entries expire after ttl. That bounds how long an edit made through
+// another instance, or a read that raced the edit, can be served stale.
+type chirpCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // front is most recently used
+	entries map[uuid.UUID]*list.Element
+}
+
+type chirpCacheEntry struct {
+	chirp   database.Chirp
+	expires time.Time
+}
+
+func newChirpCache(size int, ttl time.Duration) *chirpCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &chirpCache{size: size, ttl: ttl, order: list.New(), entries: map[uuid.UUID]*list.Element{}}
+}
+
+func (c *chirpCache) get(id uuid.UUID) (database.Chirp, bool) {
+	if c == nil {
+		return database.Chirp{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		return database.Chirp{}, false
+	}
+	entry := e.Value.(chirpCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, id)
+		return database.Chirp{}, false
+	}
+	c.order.MoveToFront(e)
+	return entry.chirp, true
+}
+
+// add stores chirp, evicting the least recently used one when full.
+// Deleted chirps are left out.
+func (c *chirpCache) add(chirp database.Chirp) {
+	if c == nil || chirp.DeletedAt.Valid {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := chirpCacheEntry{chirp: chirp, expires: time.Now().Add(c.ttl)}
+	if e, ok := c.entries[chirp.ID]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[chirp.ID] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(chirpCacheEntry).chirp.ID)
+	}
+}
+
+// forget drops one chirp after it was edited or deleted.
+func (c *chirpCache) forget(id uuid.UUID) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok {
+		c.order.Remove(e)
+		delete(c.entries, id)
+	}
+}
+
+// forgetAuthor drops every chirp by userID, for changes made to all of them
+// at once.
+func (c *chirpCache) forgetAuthor(userID uuid.UUID) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, e := range c.entries {
+		if e.Value.(chirpCacheEntry).chirp.UserID == userID {
+			c.order.Remove(e)
+			delete(c.entries, id)
+		}
+	}
+}
+
+// purge empties the cache.
+func (c *chirpCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	clear(c.entries)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// chirpQuota caps how many chirps one user may post within a sliding
+// window. A zero limit or window disables it.
+type chirpQuota struct {
+	limit  int
+	window time.Duration
+}
+
+// allowChirps reports whether userID may post n more chirps. When the quota
+// would be exceeded it answers 429 with a Retry-After telling the client when
+// the oldest chirp in the window ages out.
+func (cfg *apiConfig) allowChirps(w http.ResponseWriter, ctx context.Context, userID uuid.UUID, n int) bool {
+	quota := cfg.chirpQuota
+	if quota.limit <= 0 || quota.window <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	// deleted chirps still count, so deleting doesn't refund the quota
+	recent, err := cfg.db.CountRecentChirps(ctx, database.CountRecentChirpsParams{UserID: userID, Since: now.Add(-quota.window)})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return false
+	}
+	if int(recent.Recent)+n <= quota.limit {
+		return true
+	}
+
+	wait := quota.window
+	if recent.Oldest.Valid {
+		wait = recent.Oldest.Time.Add(quota.window).Sub(now)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	returnError(w, http.StatusTooManyRequests, fmt.Errorf("at most %d chirps may be posted per %s", quota.limit, quota.window))
+	return false
+}
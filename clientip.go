@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// defaultTrustedProxies are the networks a reverse proxy normally sits on,
+// used when TRUST_PROXY is on but TRUSTED_PROXIES isn't set.
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"::1/128",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+}
+
+// proxyTrust says whether X-Forwarded-For and X-Real-IP may be believed,
+// and from which peers. Headers from anyone else are ignored, since any
+// client can send them.
+type proxyTrust struct {
+	enabled bool
+	trusted []netip.Prefix
+}
+
+// newProxyTrust parses a comma-separated CIDR list; an empty one means the
+// private and loopback ranges.
+func newProxyTrust(enabled bool, cidrs string) (proxyTrust, error) {
+	p := proxyTrust{enabled: enabled}
+	list := defaultTrustedProxies
+	if strings.TrimSpace(cidrs) != "" {
+		list = strings.Split(cidrs, ",")
+	}
+	for _, cidr := range list {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return proxyTrust{}, err
+		}
+		p.trusted = append(p.trusted, prefix.Masked())
+	}
+	return p, nil
+}
+
+func (p proxyTrust) trusts(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client behind r. Without TRUST_PROXY,
+// or when the direct peer isn't a trusted proxy, that is RemoteAddr.
+// Otherwise X-Forwarded-For is walked from the right, past our own proxies,
+// to the first hop we don't trust; entries left of it were written by the
+// client and can't be relied on. X-Real-IP is used when there is no
+// X-Forwarded-For.
+func (cfg *apiConfig) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !cfg.proxies.enabled || !cfg.proxies.trusts(peer) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := peer.Unmap()
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// garbage from the client; the hop we have is the best we know
+			break
+		}
+		client = hop.Unmap()
+		if !cfg.proxies.trusts(hop) {
+			break
+		}
+	}
+	if len(hops) == 0 {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			client = realIP.Unmap()
+		}
+	}
+	return client.String()
+}
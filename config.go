@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// minSecretLength keeps the JWT signing secret long enough that it can't be
+// brute-forced; 32 bytes matches the HS256 key size.
+const minSecretLength = 32
+
+// TOKEN_TYPE values: the access token formats the server can issue.
+const (
+	tokenTypeJWT    = "jwt"
+	tokenTypePASETO = "paseto"
+)
+
+// envConfig holds the settings the server can't start without, plus the
+// optional TLS certificate pair, read replica, retired JWT secrets, access
+// token format and two-factor key. totpKey encrypts two-factor secrets at
+// rest; without it two-factor authentication is unavailable. Unlike SECRET
+// it can't be rotated, since that would lose every enrolled secret.
+type envConfig struct {
+	dbURL            string
+	replicaURL       string
+	platform         string
+	secret           string
+	secondarySecrets []string
+	tokenType        string
+	totpKey          string
+	polkaKey         string
+	tlsCertFile      string
+	tlsKeyFile       string
+}
+
+// loadConfig reads the required settings through getenv (os.Getenv in
+// production) and reports every missing or invalid one at once.
+func loadConfig(getenv func(string) string) (envConfig, error) {
+	cfg := envConfig{
+		dbURL:      getenv("DB_URL"),
+		replicaURL: getenv("DB_REPLICA_URL"),
+		platform:   getenv("PLATFORM"),
+		secret:     getenv("SECRET"),
+		polkaKey:   getenv("POLKA_KEY"),
+		tokenType:  getenv("TOKEN_TYPE"),
+		totpKey:    getenv("TOTP_ENCRYPTION_KEY"),
+
+		tlsCertFile: getenv("TLS_CERT_FILE"),
+		tlsKeyFile:  getenv("TLS_KEY_FILE"),
+	}
+
+	var errs []error
+	for _, v := range []struct{ key, value string }{
+		{"DB_URL", cfg.dbURL},
+		{"PLATFORM", cfg.platform},
+		{"SECRET", cfg.secret},
+		{"POLKA_KEY", cfg.polkaKey},
+	} {
+		if v.value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", v.key))
+		}
+	}
+	if cfg.secret != "" && len(cfg.secret) < minSecretLength {
+		errs = append(errs, fmt.Errorf("SECRET must be at least %d characters", minSecretLength))
+	}
+	if cfg.totpKey != "" && len(cfg.totpKey) < minSecretLength {
+		errs = append(errs, fmt.Errorf("TOTP_ENCRYPTION_KEY must be at least %d characters", minSecretLength))
+	}
+
+	// SECONDARY_SECRETS lists retired secrets, comma-separated, whose
+	// tokens are still accepted while they run out
+	for _, secret := range strings.Split(getenv("SECONDARY_SECRETS"), ",") {
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			continue
+		}
+		if len(secret) < minSecretLength {
+			errs = append(errs, fmt.Errorf("each SECONDARY_SECRETS entry must be at least %d characters", minSecretLength))
+			continue
+		}
+		cfg.secondarySecrets = append(cfg.secondarySecrets, secret)
+	}
+
+	switch cfg.tokenType {
+	case "":
+		cfg.tokenType = tokenTypeJWT
+	case tokenTypeJWT, tokenTypePASETO:
+	default:
+		errs = append(errs, fmt.Errorf("TOKEN_TYPE must be %s or %s", tokenTypeJWT, tokenTypePASETO))
+	}
+
+	switch {
+	case (cfg.tlsCertFile == "") != (cfg.tlsKeyFile == ""):
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	case cfg.tlsCertFile != "":
+		for _, v := range []struct{ key, path string }{
+			{"TLS_CERT_FILE", cfg.tlsCertFile},
+			{"TLS_KEY_FILE", cfg.tlsKeyFile},
+		} {
+			if _, err := os.Stat(v.path); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", v.key, err))
+			}
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return envConfig{}, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// useTLS reports whether the server should serve HTTPS.
+func (c envConfig) useTLS() bool {
+	return c.tlsCertFile != ""
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+)
+
+// requireJSON answers 415 when a request doesn't declare a JSON body.
+// Parameters such as charset are ignored.
+func requireJSON(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			returnError(w, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json"))
+			return
+		}
+		next(w, r)
+	}
+}
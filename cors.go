@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsPolicy describes which cross-origin browser clients may call the API.
+// The zero value allows no origins.
+type corsPolicy struct {
+	allowedOrigins map[string]bool
+	allowedMethods string
+	allowedHeaders string
+}
+
+func newCORSPolicy(origins, methods, headers string) corsPolicy {
+	p := corsPolicy{
+		allowedOrigins: map[string]bool{},
+		allowedMethods: "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+		allowedHeaders: "Authorization, Content-Type, Idempotency-Key",
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			p.allowedOrigins[origin] = true
+		}
+	}
+	if methods != "" {
+		p.allowedMethods = methods
+	}
+	if headers != "" {
+		p.allowedHeaders = headers
+	}
+	return p
+}
+
+// exposedHeaders lists the response headers the API sets that browser
+// clients need to read.
+var exposedHeaders = strings.Join([]string{
+	newAccessTokenHeader,
+	idempotentReplayedHeader,
+	nextCursorHeader,
+	requestIDHeader,
+	"X-Total-Count",
+	"X-Deleted-Count",
+	"Location",
+	"ETag",
+	"Retry-After",
+}, ", ")
+
+func (cfg *apiConfig) middlewareCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := cfg.cors.allowedOrigins[origin]
+		if allowed {
+			// echo the origin back rather than "*" so only listed sites get access
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			// browsers hide every response header outside the safelist
+			// unless it's named here
+			w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", cfg.cors.allowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", cfg.cors.allowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
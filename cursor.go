@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+const nextCursorHeader = "X-Next-Cursor"
+
+// chirpCursor marks a position in the (created_at, id) keyset. Unlike an
+// offset it stays put when chirps are added while a client is paging.
+type chirpCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// encode returns the cursor in the opaque form handed to clients.
+func (c chirpCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.UTC().Format(time.RFC3339Nano) + "," + c.ID.String()))
+}
+
+func decodeChirpCursor(s string) (chirpCursor, error) {
+	errInvalid := errors.New("invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return chirpCursor{}, errInvalid
+	}
+	at, id, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return chirpCursor{}, errInvalid
+	}
+	c := chirpCursor{}
+	if c.CreatedAt, err = time.Parse(time.RFC3339Nano, at); err != nil {
+		return chirpCursor{}, errInvalid
+	}
+	if c.ID, err = uuid.Parse(id); err != nil {
+		return chirpCursor{}, errInvalid
+	}
+	return c, nil
+}
+
+// usesCursor reports whether the request asked for keyset pagination via
+// ?after or ?before. Either may be empty to fetch the first page.
+func usesCursor(r *http.Request) bool {
+	return r.URL.Query().Has("after") || r.URL.Query().Has("before")
+}
+
+// getChirpsPage serves GET /api/chirps?after=... (oldest first) or
+// ?before=... (newest first). When the page is full, X-Next-Cursor holds
+// the value to pass back in the same parameter for the following page; with
+// envelope=true it is in the body's pagination.next_cursor too.
+func (cfg *apiConfig) getChirpsPage(w http.ResponseWriter, r *http.Request, ctx context.Context, authorIDs []uuid.UUID, withDeleted bool, viewer uuid.NullUUID, limit int32, fields []string) {
+	query := r.URL.Query()
+	if query.Has("after") && query.Has("before") {
+		returnError(w, http.StatusBadRequest, errors.New("after and before can't be combined"))
+		return
+	}
+	for _, param := range []string{"offset", "sort", "q", "created_after", "include"} {
+		if query.Has(param) {
+			returnError(w, http.StatusBadRequest, errors.New(param+" can't be combined with a cursor"))
+			return
+		}
+	}
+	if sortBy := query.Get("sort_by"); sortBy != "" && sortBy != "created_at" {
+		returnError(w, http.StatusBadRequest, errors.New("cursor pages are ordered by created_at"))
+		return
+	}
+
+	before := query.Has("before")
+	raw := query.Get("after")
+	if before {
+		raw = query.Get("before")
+	}
+
+	cursorAt, cursorID := sql.NullTime{}, uuid.NullUUID{}
+	if raw != "" {
+		cursor, err := decodeChirpCursor(raw)
+		if err != nil {
+			returnError(w, http.StatusBadRequest, err)
+			return
+		}
+		cursorAt = sql.NullTime{Time: cursor.CreatedAt, Valid: true}
+		cursorID = uuid.NullUUID{UUID: cursor.ID, Valid: true}
+	}
+
+	var dbChirps []database.Chirp
+	var err error
+	if before {
+		dbChirps, err = cfg.readDB.GetChirpsPageBefore(ctx, database.GetChirpsPageBeforeParams{
+			CursorCreatedAt: cursorAt,
+			CursorID:        cursorID,
+			AuthorIds:       authorIDs,
+			IncludeDeleted:  withDeleted,
+			PageLimit:       limit,
+		})
+	} else {
+		dbChirps, err = cfg.readDB.GetChirpsPageAfter(ctx, database.GetChirpsPageAfterParams{
+			CursorCreatedAt: cursorAt,
+			CursorID:        cursorID,
+			AuthorIds:       authorIDs,
+			IncludeDeleted:  withDeleted,
+			PageLimit:       limit,
+		})
+	}
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	chirps := make([]Chirp, len(dbChirps))
+	for i, dbChirp := range dbChirps {
+		chirps[i] = chirpFromDB(dbChirp)
+	}
+	if err := cfg.attachCounts(ctx, chirps, viewer); err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	// a short page means there is nothing further yet
+	next := ""
+	if len(dbChirps) == int(limit) {
+		last := dbChirps[len(dbChirps)-1]
+		next = chirpCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+		w.Header().Set(nextCursorHeader, next)
+	}
+
+	if wantsEnvelope(r) {
+		respondChirpsEnvelope(w, http.StatusOK, chirps, fields, cursorPagination{Limit: limit, NextCursor: next})
+		return
+	}
+	respondChirps(w, http.StatusOK, chirps, fields)
+}
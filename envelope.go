@@ -0,0 +1,45 @@
+package main
+
+import "net/http"
+
+// pagination describes the page an enveloped listing holds. Total counts
+// every chirp matching the filters, not just this page.
+type pagination struct {
+	Limit  int32 `json:"limit"`
+	Offset int32 `json:"offset"`
+	Total  int64 `json:"total"`
+}
+
+// cursorPagination describes an enveloped cursor page. NextCursor is left
+// out once a page comes back short, like the X-Next-Cursor header.
+type cursorPagination struct {
+	Limit      int32  `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// chirpsEnvelope is the ?envelope=true shape of a chirp listing, with a
+// pagination or, for cursor pages, a cursorPagination:
+//
+//	{"data": [...], "pagination": {"limit": 100, "offset": 0, "total": 3}}
+//	{"data": [...], "pagination": {"limit": 100, "next_cursor": "..."}}
+type chirpsEnvelope struct {
+	Data       any `json:"data"`
+	Pagination any `json:"pagination"`
+}
+
+// wantsEnvelope reports whether ?envelope=true asked for a listing wrapped
+// with its pagination rather than the bare array older clients expect.
+func wantsEnvelope(r *http.Request) bool {
+	return r.URL.Query().Get("envelope") == "true"
+}
+
+// respondChirpsEnvelope writes chirps, limited to fields when set, inside a
+// chirpsEnvelope.
+func respondChirpsEnvelope(w http.ResponseWriter, statusCode int, chirps []Chirp, fields []string, page any) {
+	data, err := chirpsBody(chirps, fields)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, statusCode, chirpsEnvelope{Data: data, Pagination: page})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// errorCode is a stable, machine-readable identifier for an error response.
+// Clients should branch on the code; the message is for humans and may change.
+type errorCode string
+
+const (
+	codeBadRequest           errorCode = "bad_request"
+	codeUnauthorized         errorCode = "unauthorized"
+	codeForbidden            errorCode = "forbidden"
+	codeNotFound             errorCode = "not_found"
+	codeMethodNotAllowed     errorCode = "method_not_allowed"
+	codeConflict             errorCode = "conflict"
+	codeBodyTooLarge         errorCode = "body_too_large"
+	codeUnsupportedMediaType errorCode = "unsupported_media_type"
+	codeUpgradeRequired      errorCode = "upgrade_required"
+	codeValidationFailed     errorCode = "validation_failed"
+	codeRateLimited          errorCode = "rate_limited"
+	codeAccountLocked        errorCode = "account_locked"
+	codeInternal             errorCode = "internal_error"
+	codeUnavailable          errorCode = "unavailable"
+	codeTimeout              errorCode = "timeout"
+
+	codeChirpEmpty   errorCode = "chirp_empty"
+	codeChirpTooLong errorCode = "chirp_too_long"
+
+	codeRefreshTokenNotFound errorCode = "refresh_token_not_found"
+	codeRefreshTokenRevoked  errorCode = "refresh_token_revoked"
+	codeRefreshTokenExpired  errorCode = "refresh_token_expired"
+
+	codeTOTPRequired errorCode = "totp_required"
+	codeTOTPInvalid  errorCode = "totp_invalid"
+)
+
+// statusCodes is the code used when a handler reports only an HTTP status.
+var statusCodes = map[int]errorCode{
+	http.StatusBadRequest:            codeBadRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	http.StatusConflict:              codeConflict,
+	http.StatusRequestEntityTooLarge: codeBodyTooLarge,
+	http.StatusUnsupportedMediaType:  codeUnsupportedMediaType,
+	http.StatusUpgradeRequired:       codeUpgradeRequired,
+	http.StatusUnprocessableEntity:   codeValidationFailed,
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusLocked:                codeAccountLocked,
+	http.StatusServiceUnavailable:    codeUnavailable,
+	http.StatusGatewayTimeout:        codeTimeout,
+}
+
+func codeForStatus(statusCode int) errorCode {
+	if code, ok := statusCodes[statusCode]; ok {
+		return code
+	}
+	return codeInternal
+}
+
+// errorResponse is the body of every error the API returns:
+//
+//	{"error": {"code": "chirp_too_long", "message": "Chirp is too long"}}
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      errorCode   `json:"code"`
+	Message   string      `json:"message"`
+	RequestID string      `json:"request_id,omitempty"`
+	Fields    fieldErrors `json:"fields,omitempty"`
+	Index     *int        `json:"index,omitempty"`
+}
+
+func returnError(w http.ResponseWriter, statusCode int, err error) {
+	returnErrorCode(w, statusCode, codeForStatus(statusCode), err)
+}
+
+// internalErrorMessage is all a client is told about an internal error.
+const internalErrorMessage = "Something went wrong"
+
+// returnErrorCode writes an error response carrying a machine-readable code
+// alongside the human-readable message. Internal errors can carry driver or
+// system details, so those are logged with the request ID and the client
+// gets internalErrorMessage instead.
+func returnErrorCode(w http.ResponseWriter, statusCode int, code errorCode, err error) {
+	msg := err.Error()
+	if code == codeInternal {
+		log.Printf("internal error request_id=%s: %v", w.Header().Get(requestIDHeader), err)
+		msg = internalErrorMessage
+	}
+	writeErrorBody(w, statusCode, errorBody{Code: code, Message: msg})
+}
+
+// writeErrorBody is the single place error responses are written. The
+// request ID set by middlewareRequestID is copied into the body so users can
+// quote it.
+func writeErrorBody(w http.ResponseWriter, statusCode int, body errorBody) {
+	body.RequestID = w.Header().Get(requestIDHeader)
+	dat, _ := json.Marshal(errorResponse{Error: body})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(dat)
+}
+
+// returnDBError reports a failed query, answering 504 when the query was cut
+// off by the DB timeout and statusCode otherwise.
+func returnDBError(w http.ResponseWriter, ctx context.Context, statusCode int, err error) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		returnError(w, http.StatusGatewayTimeout, errors.New("database query timed out"))
+		return
+	}
+	returnError(w, statusCode, err)
+}
+
+// middlewareMethodNotAllowed rewrites the plain-text 405 that mux answers
+// with when a path exists but not for the request's method, so it follows
+// the JSON error schema too. The Allow header mux sets is kept.
+func middlewareMethodNotAllowed(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only mux's own responses come back without a pattern
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(&methodNotAllowedWriter{ResponseWriter: w, method: r.Method}, r)
+	})
+}
+
+// methodNotAllowedWriter swaps a 405 for a JSON error and drops the text
+// body that follows it. Anything else passes straight through.
+type methodNotAllowedWriter struct {
+	http.ResponseWriter
+	method  string
+	replace bool
+}
+
+func (w *methodNotAllowedWriter) WriteHeader(code int) {
+	if code != http.StatusMethodNotAllowed {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.replace = true
+	allowed := w.Header().Get("Allow")
+	w.Header().Del("X-Content-Type-Options")
+	returnError(w.ResponseWriter, code, fmt.Errorf("%s is not allowed here; use %s", w.method, allowed))
+}
+
+func (w *methodNotAllowedWriter) Write(b []byte) (int, error) {
+	if w.replace {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
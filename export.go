@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// exportBatchSize is how many chirps an export reads per query, so a
+// prolific user's export never sits in memory all at once.
+const exportBatchSize = 500
+
+// exportedChirp is one chirp in an export, CSV or JSON.
+type exportedChirp struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Body      string    `json:"body"`
+}
+
+// chirpExporter writes an export in one format: begin once, write for each
+// chirp, then end. flush pushes out anything it has buffered.
+type chirpExporter interface {
+	begin() error
+	write(c exportedChirp) error
+	flush() error
+	end() error
+}
+
+// exportChirpsHandler serves GET /api/chirps/export?format=csv|json: every
+// chirp the caller hasn't deleted, oldest first, as a download. Rows are
+// written as they are read and flushed after each batch.
+func (cfg *apiConfig) exportChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	var exporter chirpExporter
+	var contentType, filename string
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "csv":
+		exporter = &csvExporter{w: csv.NewWriter(w)}
+		contentType, filename = "text/csv; charset=utf-8", "chirps.csv"
+	case "json":
+		exporter = &jsonExporter{w: w}
+		contentType, filename = "application/json", "chirps.json"
+	default:
+		returnError(w, http.StatusBadRequest, errors.New("format must be csv or json"))
+		return
+	}
+
+	userID := requestUserID(r)
+
+	// the first batch is read before any headers go out, so a failure can
+	// still be answered with an error
+	ctx, cancel := cfg.dbContext(r)
+	batch, err := cfg.readChirpsAfter(ctx, userID, nil)
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		cancel()
+		return
+	}
+	cancel()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	// once the body has started all that's left on failure is to stop
+	if err := cfg.writeExport(w, r, exporter, userID, batch); err != nil {
+		log.Printf("exporting chirps for %s: %v", userID, err)
+	}
+}
+
+func (cfg *apiConfig) writeExport(w http.ResponseWriter, r *http.Request, exporter chirpExporter, userID uuid.UUID, batch []database.Chirp) error {
+	if err := exporter.begin(); err != nil {
+		return err
+	}
+	for {
+		for _, c := range batch {
+			if err := exporter.write(exportedChirp{ID: c.ID, CreatedAt: c.CreatedAt, Body: c.Body}); err != nil {
+				return err
+			}
+		}
+		if len(batch) < exportBatchSize {
+			return exporter.end()
+		}
+		if err := exporter.flush(); err != nil {
+			return err
+		}
+		http.NewResponseController(w).Flush()
+
+		// each batch gets its own DB timeout
+		last := batch[len(batch)-1]
+		ctx, cancel := cfg.dbContext(r)
+		var err error
+		batch, err = cfg.readChirpsAfter(ctx, userID, &chirpCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readChirpsAfter reads a batch of the user's chirps following after, or
+// the first ones when after is nil.
+func (cfg *apiConfig) readChirpsAfter(ctx context.Context, userID uuid.UUID, after *chirpCursor) ([]database.Chirp, error) {
+	params := database.GetChirpsPageAfterParams{
+		AuthorIds: []uuid.UUID{userID},
+		PageLimit: exportBatchSize,
+	}
+	if after != nil {
+		params.CursorCreatedAt = sql.NullTime{Time: after.CreatedAt, Valid: true}
+		params.CursorID = uuid.NullUUID{UUID: after.ID, Valid: true}
+	}
+	return cfg.readDB.GetChirpsPageAfter(ctx, params)
+}
+
+// csvExporter writes a header row and then one row per chirp.
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) begin() error {
+	return e.w.Write([]string{"id", "created_at", "body"})
+}
+
+func (e *csvExporter) write(c exportedChirp) error {
+	return e.w.Write([]string{c.ID.String(), c.CreatedAt.Format(time.RFC3339Nano), c.Body})
+}
+
+func (e *csvExporter) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExporter) end() error {
+	return e.flush()
+}
+
+// jsonExporter writes a JSON array, one element at a time.
+type jsonExporter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (e *jsonExporter) begin() error {
+	_, err := e.w.Write([]byte("["))
+	return err
+}
+
+func (e *jsonExporter) write(c exportedChirp) error {
+	dat, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if e.written {
+		dat = append([]byte(","), dat...)
+	}
+	e.written = true
+	_, err = e.w.Write(dat)
+	return err
+}
+
+func (e *jsonExporter) flush() error {
+	return nil
+}
+
+func (e *jsonExporter) end() error {
+	_, err := e.w.Write([]byte("]"))
+	return err
+}
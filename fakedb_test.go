@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeResult is what a scripted query returns: rows for :one/:many queries,
+// rowsAffected for :execresult ones.
+type fakeResult struct {
+	rows         [][]driver.Value
+	rowsAffected int64
+	err          error
+}
+
+type fakeHandler func(args []driver.Value) fakeResult
+
+// fakeDB is an in-memory database/sql driver that answers sqlc queries by
+// name ("-- name: GetChirp :one" -> "GetChirp") so handlers can be tested
+// without postgres.
+type fakeDB struct {
+	mu       sync.Mutex
+	handlers map[string]fakeHandler
+	calls    []string
+}
+
+func newFakeDB(t *testing.T) (*fakeDB, *sql.DB) {
+	t.Helper()
+	f := &fakeDB{handlers: map[string]fakeHandler{}}
+	db := sql.OpenDB(fakeConnector{f})
+	t.Cleanup(func() { db.Close() })
+	return f, db
+}
+
+func (f *fakeDB) on(name string, h fakeHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[name] = h
+}
+
+func (f *fakeDB) called(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeDB) run(query string, named []driver.NamedValue) fakeResult {
+	name := queryName(query)
+	f.mu.Lock()
+	f.calls = append(f.calls, name)
+	h, ok := f.handlers[name]
+	f.mu.Unlock()
+	if !ok {
+		return fakeResult{err: fmt.Errorf("fakedb: unexpected query %q", name)}
+	}
+	args := make([]driver.Value, len(named))
+	for i, nv := range named {
+		args[i] = nv.Value
+	}
+	return h(args)
+}
+
+func queryName(query string) string {
+	const prefix = "-- name: "
+	if !strings.HasPrefix(query, prefix) {
+		return query
+	}
+	name, _, _ := strings.Cut(query[len(prefix):], " ")
+	return name
+}
+
+// row converts values to what a real driver would hand back, so that
+// types such as uuid.UUID scan the same way they do against postgres.
+func row(values ...any) []driver.Value {
+	out := make([]driver.Value, len(values))
+	for i, v := range values {
+		if valuer, ok := v.(driver.Valuer); ok {
+			dv, err := valuer.Value()
+			if err != nil {
+				panic(err)
+			}
+			out[i] = dv
+			continue
+		}
+		out[i] = v
+	}
+	return out
+}
+
+type fakeConnector struct{ f *fakeDB }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return &fakeConn{c.f}, nil }
+func (c fakeConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fakedb: use the connector")
+}
+
+type fakeConn struct{ f *fakeDB }
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakedb: prepared statements are not supported")
+}
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.f.mu.Lock()
+	c.f.calls = append(c.f.calls, "BEGIN")
+	c.f.mu.Unlock()
+	return fakeTx{c.f}, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res := c.f.run(query, args)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return &fakeRows{rows: res.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res := c.f.run(query, args)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return driver.RowsAffected(res.rowsAffected), nil
+}
+
+// CheckNamedValue accepts every argument as-is after driver.Valuer conversion.
+func (c *fakeConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if valuer, ok := nv.Value.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return err
+		}
+		nv.Value = v
+	}
+	return nil
+}
+
+type fakeTx struct{ f *fakeDB }
+
+func (tx fakeTx) Commit() error   { return tx.record("COMMIT") }
+func (tx fakeTx) Rollback() error { return tx.record("ROLLBACK") }
+
+func (tx fakeTx) record(name string) error {
+	tx.f.mu.Lock()
+	defer tx.f.mu.Unlock()
+	tx.f.calls = append(tx.f.calls, name)
+	return nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	pos  int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	cols := make([]string, len(r.rows[0]))
+	for i := range cols {
+		cols[i] = fmt.Sprintf("col%d", i)
+	}
+	return cols
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
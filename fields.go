@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// chirpFields are the names ?fields may pick from, matching Chirp's JSON
+// keys.
+var chirpFields = map[string]bool{
+	"id":          true,
+	"created_at":  true,
+	"updated_at":  true,
+	"body":        true,
+	"user_id":     true,
+	"parent_id":   true,
+	"image_url":   true,
+	"like_count":  true,
+	"liked_by_me": true,
+	"reply_count": true,
+	"author":      true,
+	"deleted_at":  true,
+}
+
+// parseChirpFields reads ?fields=id,body. A nil result means the param was
+// absent and chirps go out whole.
+func parseChirpFields(r *http.Request) ([]string, error) {
+	if !r.URL.Query().Has("fields") {
+		return nil, nil
+	}
+	var fields []string
+	for _, field := range strings.Split(r.URL.Query().Get("fields"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !chirpFields[field] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("fields must name at least one field")
+	}
+	return fields, nil
+}
+
+// selectChirpFields trims a chirp down to the requested keys. Fields the
+// chirp leaves out anyway, like author without include=author, stay out.
+func selectChirpFields(c Chirp, fields []string) (map[string]json.RawMessage, error) {
+	dat, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(dat, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if v, ok := all[field]; ok {
+			selected[field] = v
+		}
+	}
+	return selected, nil
+}
+
+// respondChirp writes a single chirp, limited to fields when set.
+func respondChirp(w http.ResponseWriter, statusCode int, c Chirp, fields []string) {
+	if fields == nil {
+		respondJSON(w, statusCode, c)
+		return
+	}
+	selected, err := selectChirpFields(c, fields)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, statusCode, selected)
+}
+
+// respondChirps writes a chirp list, limited to fields when set.
+func respondChirps(w http.ResponseWriter, statusCode int, chirps []Chirp, fields []string) {
+	out, err := chirpsBody(chirps, fields)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, statusCode, out)
+}
+
+// chirpsBody is the JSON value for a chirp list: the chirps themselves, or
+// maps of just the requested fields.
+func chirpsBody(chirps []Chirp, fields []string) (any, error) {
+	if fields == nil {
+		return chirps, nil
+	}
+	out := make([]map[string]json.RawMessage, len(chirps))
+	for i, c := range chirps {
+		selected, err := selectChirpFields(c, fields)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = selected
+	}
+	return out, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultGzipMinSize is the smallest response, in bytes, worth compressing
+// when GZIP_MIN_SIZE is unset; below roughly one packet gzip only adds
+// overhead.
+const defaultGzipMinSize = 1024
+
+// precompressedTypes are content types gzip can't shrink any further.
+var precompressedTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp",
+	"video/", "audio/",
+	"application/zip", "application/gzip", "application/x-gzip",
+}
+
+// middlewareGzip compresses responses of at least cfg.gzipMinSize bytes for
+// clients that accept gzip. Smaller bodies, bodies that already carry a
+// Content-Encoding or a compressed type, and websocket upgrades pass
+// through untouched. A negative cfg.gzipMinSize turns it off.
+func (cfg *apiConfig) middlewareGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.gzipMinSize < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: cfg.gzipMinSize}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding = strings.TrimSpace(coding); coding != "gzip" && coding != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the status and the first minSize bytes of
+// the body so it can tell whether the response is worth compressing before
+// any headers go out. Statuses reach the wrapped writer unchanged, so
+// status-recording middleware outside it sees what the handler wrote.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	started bool
+	gz      *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.started || g.status != 0 {
+		return
+	}
+	if code < http.StatusOK {
+		// informational responses go straight out
+		g.ResponseWriter.WriteHeader(code)
+		return
+	}
+	g.status = code
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if !g.started {
+		if !g.compressible() {
+			if err := g.start(false); err != nil {
+				return 0, err
+			}
+		} else {
+			g.buf = append(g.buf, b...)
+			if len(g.buf) < g.minSize {
+				return len(b), nil
+			}
+			return len(b), g.start(true)
+		}
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Flush sends whatever is buffered, compressing from here on if the
+// response qualifies, since a streaming handler can't wait for minSize.
+func (g *gzipResponseWriter) Flush() {
+	if !g.started {
+		if g.status == 0 {
+			g.status = http.StatusOK
+		}
+		if err := g.start(g.compressible()); err != nil {
+			return
+		}
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) compressible() bool {
+	h := g.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if g.status == http.StatusNoContent || g.status == http.StatusNotModified {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	for _, t := range precompressedTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// start sends the headers and the buffered bytes, through gzip when
+// compress is set.
+func (g *gzipResponseWriter) start(compress bool) error {
+	g.started = true
+	if compress {
+		h := g.Header()
+		h.Set("Content-Encoding", "gzip")
+		// the length the handler set was for the uncompressed body
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	buf := g.buf
+	g.buf = nil
+	if g.gz != nil {
+		_, err := g.gz.Write(buf)
+		return err
+	}
+	_, err := g.ResponseWriter.Write(buf)
+	return err
+}
+
+// close flushes a response that never reached minSize uncompressed and
+// finishes the gzip stream of one that did.
+func (g *gzipResponseWriter) close() {
+	if !g.started {
+		if g.status == 0 {
+			g.status = http.StatusOK
+		}
+		g.start(false)
+	}
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// ChirpRevision is an earlier body of an edited chirp: what it said from
+// CreatedAt until an edit replaced it at ReplacedAt.
+type ChirpRevision struct {
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// ownChirp loads a chirp for its author. It answers 404 when the chirp
+// doesn't exist or was deleted, and 403 when it belongs to someone else.
+func (cfg *apiConfig) ownChirp(w http.ResponseWriter, ctx context.Context, chirpID, userID uuid.UUID) (database.Chirp, bool) {
+	dbChirp, err := cfg.db.GetChirp(ctx, database.GetChirpParams{ID: chirpID})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusNotFound, err)
+		return database.Chirp{}, false
+	}
+	if dbChirp.UserID != userID {
+		returnError(w, http.StatusForbidden, errors.New("You can only access your own chirps"))
+		return database.Chirp{}, false
+	}
+	return dbChirp, true
+}
+
+// editChirpHandler replaces the body of one of the caller's chirps. The
+// body it had is kept in chirp_revisions, written in the same transaction.
+func (cfg *apiConfig) editChirpHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	params := parameters{}
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
+	body, err := cfg.prepareChirpBody(r, params.Body)
+	if err != nil {
+		returnErrorCode(w, http.StatusBadRequest, chirpErrorCode(err), err)
+		return
+	}
+
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	dbChirp, ok := cfg.ownChirp(w, ctx, chirpID, userID)
+	if !ok {
+		return
+	}
+
+	// an edit that changes nothing leaves no revision behind
+	if dbChirp.Body != body {
+		err = cfg.withTx(ctx, func(q *database.Queries) error {
+			saved, err := q.CreateChirpRevision(ctx, chirpID)
+			if err != nil {
+				return err
+			}
+			if saved == 0 {
+				// deleted since ownChirp looked
+				return sql.ErrNoRows
+			}
+			dbChirp, err = q.UpdateChirpBody(ctx, database.UpdateChirpBodyParams{ID: chirpID, Body: body})
+			return err
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			returnError(w, http.StatusNotFound, errors.New("chirp not found"))
+			return
+		}
+		if err != nil {
+			returnDBError(w, ctx, http.StatusInternalServerError, err)
+			return
+		}
+		cfg.chirpCache.forget(chirpID)
+	}
+
+	chirps := []Chirp{chirpFromDB(dbChirp)}
+	if err := cfg.attachCounts(ctx, chirps, uuid.NullUUID{UUID: userID, Valid: true}); err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, chirps[0])
+}
+
+// getChirpHistoryHandler lists the earlier bodies of one of the caller's
+// chirps, oldest first. A chirp that was never edited has an empty history.
+func (cfg *apiConfig) getChirpHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	if _, ok := cfg.ownChirp(w, ctx, chirpID, userID); !ok {
+		return
+	}
+
+	dbRevisions, err := cfg.db.GetChirpRevisions(ctx, chirpID)
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	revisions := make([]ChirpRevision, len(dbRevisions))
+	for i, rev := range dbRevisions {
+		revisions[i] = ChirpRevision{Body: rev.Body, CreatedAt: rev.CreatedAt, ReplacedAt: rev.ReplacedAt}
+	}
+	respondJSON(w, http.StatusOK, revisions)
+}
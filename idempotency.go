@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	defaultIdempotencyKeyTTL = 24 * time.Hour
+)
+
+// errIdempotencyKeyTaken means another request stored the same key while
+// ours was in flight; its chirp is the one to answer with.
+var errIdempotencyKeyTaken = errors.New("idempotency key already used")
+
+// idempotencyKey returns the request's Idempotency-Key, or "" when the
+// header is absent or keys are disabled by a zero TTL.
+func (cfg *apiConfig) idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" || cfg.idempotencyKeyTTL <= 0 {
+		return "", nil
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return "", fmt.Errorf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+	return key, nil
+}
+
+// idempotentChirp looks up the chirp userID created with key within the
+// TTL. found is false when there is none.
+func (cfg *apiConfig) idempotentChirp(ctx context.Context, userID uuid.UUID, key string) (chirp database.Chirp, found bool, err error) {
+	chirp, err = cfg.db.GetIdempotentChirp(ctx, database.GetIdempotentChirpParams{
+		UserID:       userID,
+		Key:          key,
+		CreatedAfter: time.Now().Add(-cfg.idempotencyKeyTTL),
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.Chirp{}, false, nil
+	}
+	return chirp, err == nil, err
+}
+
+// createChirpOnce inserts the chirp and records key against it in one
+// transaction. An expired entry for the same key is taken over; a live one
+// rolls the insert back with errIdempotencyKeyTaken.
+func (cfg *apiConfig) createChirpOnce(ctx context.Context, params database.CreateChirpParams, key string) (database.Chirp, error) {
+	var dbChirp database.Chirp
+	err := cfg.withTx(ctx, func(q *database.Queries) error {
+		var err error
+		dbChirp, err = q.CreateChirp(ctx, params)
+		if err != nil {
+			return err
+		}
+		saved, err := q.SaveIdempotencyKey(ctx, database.SaveIdempotencyKeyParams{
+			UserID:        params.UserID,
+			Key:           key,
+			ChirpID:       dbChirp.ID,
+			ExpiredBefore: time.Now().Add(-cfg.idempotencyKeyTTL),
+		})
+		if err != nil {
+			return err
+		}
+		if saved == 0 {
+			return errIdempotencyKeyTaken
+		}
+		return nil
+	})
+	return dbChirp, err
+}
+
+// replayChirp answers a repeated request with the chirp the original one
+// created. It is a 200 rather than a 201 since nothing new was made.
+func replayChirp(w http.ResponseWriter, dbChirp database.Chirp) {
+	chirp := chirpFromDB(dbChirp)
+	w.Header().Set("Location", "/api/chirps/"+chirp.ID.String())
+	w.Header().Set(idempotentReplayedHeader, "true")
+	respondJSON(w, http.StatusOK, chirp)
+}
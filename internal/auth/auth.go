@@ -2,10 +2,11 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -22,36 +23,143 @@ func CheckPasswordHash(password, hash string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
-func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
-	claims := jwt.RegisteredClaims{
-		Subject:   userID.String(),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		Issuer:    "chirpy",
+// TokenBackend mints and checks access tokens. JWTConfig and PASETOConfig
+// implement it, so callers needn't care which format a deployment uses.
+type TokenBackend interface {
+	// Make issues a token for userID that expires after expiresIn.
+	Make(userID uuid.UUID, expiresIn time.Duration) (string, error)
+	// Renew issues a token continuing s's session for expiresIn, keeping
+	// its AuthTime.
+	Renew(s Session, expiresIn time.Duration) (string, error)
+	// ParseSession validates a token, returning all it says about the
+	// session.
+	ParseSession(token string) (Session, error)
+}
+
+// Session is what a valid access token says about its holder.
+type Session struct {
+	UserID    uuid.UUID
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	// AuthTime is when the user logged in. Renewed tokens carry it over
+	// unchanged so a session can't be stretched forever. Tokens minted
+	// before it was recorded report their IssuedAt.
+	AuthTime time.Time
+}
+
+// DefaultIssuer is the iss claim used when a JWTConfig doesn't name one, so
+// tokens minted before the issuer was configurable stay valid.
+const DefaultIssuer = "chirpy"
+
+// JWTConfig describes the access tokens one deployment mints and accepts.
+// Tokens must carry Issuer to validate, and Audience too when it is set, so
+// a token minted by another service sharing the secret is rejected.
+//
+// New tokens are always signed with Secret. SecondarySecrets are retired
+// secrets that are still accepted, so rotating Secret doesn't log everyone
+// out; drop them once the tokens they signed have expired.
+//
+// Leeway is how far exp and iat may be off to allow for clock skew between
+// servers; a token is still accepted that long after it expires.
+type JWTConfig struct {
+	Secret           string
+	SecondarySecrets []string
+	Issuer           string
+	Audience         string
+	Leeway           time.Duration
+}
+
+func (c JWTConfig) issuer() string {
+	if c.Issuer == "" {
+		return DefaultIssuer
+	}
+	return c.Issuer
+}
+
+// jwtClaims are the registered claims plus auth_time, when the session the
+// token belongs to began.
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+}
+
+// Make signs an access token for userID that expires after expiresIn.
+func (c JWTConfig) Make(userID uuid.UUID, expiresIn time.Duration) (string, error) {
+	return c.sign(userID, time.Now(), expiresIn)
+}
+
+// Renew signs an access token continuing s's session.
+func (c JWTConfig) Renew(s Session, expiresIn time.Duration) (string, error) {
+	return c.sign(s.UserID, s.AuthTime, expiresIn)
+}
+
+func (c JWTConfig) sign(userID uuid.UUID, authTime time.Time, expiresIn time.Duration) (string, error) {
+	claims := jwtClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID.String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    c.issuer(),
+		},
+		AuthTime: jwt.NewNumericDate(authTime),
+	}
+	if c.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{c.Audience}
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(tokenSecret))
+	return token.SignedString([]byte(c.Secret))
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claims := &jwt.RegisteredClaims{}
+// ParseSession validates an access token, returning its user, when it was
+// issued and expires, and when its session began.
+func (c JWTConfig) ParseSession(tokenString string) (Session, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(c.issuer()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(c.Leeway),
+	}
+	if c.Audience != "" {
+		opts = append(opts, jwt.WithAudience(c.Audience))
+	}
+
+	keys := jwt.VerificationKeySet{Keys: []jwt.VerificationKey{[]byte(c.Secret)}}
+	for _, secret := range c.SecondarySecrets {
+		keys.Keys = append(keys.Keys, []byte(secret))
+	}
+
+	claims := &jwtClaims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
-		return []byte(tokenSecret), nil
-	})
+		return keys, nil
+	}, opts...)
 	if err != nil {
-		return uuid.Nil, err
+		return Session{}, err
 	}
 	if !token.Valid {
-		return uuid.Nil, fmt.Errorf("invalid token")
-	} else if claims.ExpiresAt.Time.Before(time.Now()) {
-		return uuid.Nil, fmt.Errorf("token expired")
+		return Session{}, fmt.Errorf("invalid token")
+	} else if claims.ExpiresAt.Time.Add(c.Leeway).Before(time.Now()) {
+		return Session{}, fmt.Errorf("token expired")
 	}
 	userID, err := uuid.Parse(claims.Subject)
 	if err != nil {
-		return uuid.Nil, err
+		return Session{}, err
+	}
+	s := Session{UserID: userID, ExpiresAt: claims.ExpiresAt.Time}
+	if claims.IssuedAt != nil {
+		s.IssuedAt = claims.IssuedAt.Time
 	}
-	return userID, nil
+	s.AuthTime = s.IssuedAt
+	if claims.AuthTime != nil {
+		s.AuthTime = claims.AuthTime.Time
+	}
+	return s, nil
+}
+
+// MakeJWT signs an access token with the default issuer and no audience.
+func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return JWTConfig{Secret: tokenSecret}.Make(userID, expiresIn)
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -65,22 +173,54 @@ func GetBearerToken(headers http.Header) (string, error) {
 	return authHeader[7:], nil
 }
 
+// MinRefreshTokenBytes is the least randomness a refresh token may carry;
+// 16 bytes gives 128 bits of entropy, beyond practical guessing.
+const MinRefreshTokenBytes = 16
+
+// MakeRefreshToken returns a hex-encoded refresh token built from 32 random
+// bytes (256 bits of entropy).
 func MakeRefreshToken() (string, error) {
-	b := make([]byte, 32)
-	n, err := rand.Read(b)
+	return MakeRefreshTokenN(32)
+}
+
+// MakeRefreshTokenN returns a hex-encoded refresh token built from n random
+// bytes read from crypto/rand, so the result is 2*n characters long.
+func MakeRefreshTokenN(n int) (string, error) {
+	if n < MinRefreshTokenBytes {
+		return "", fmt.Errorf("refresh tokens need at least %d bytes, got %d", MinRefreshTokenBytes, n)
+	}
+	b := make([]byte, n)
+	read, err := rand.Read(b)
 	if err != nil {
 		return "", err
 	}
-	if n != len(b) {
-		return "", fmt.Errorf("expected to read %d bytes, got %d", len(b), n)
+	if read != len(b) {
+		return "", fmt.Errorf("expected to read %d bytes, got %d", len(b), read)
 	}
 	return hex.EncodeToString(b), nil
 }
 
+// GetAPIKey extracts the key from an "Authorization: ApiKey <key>" header,
+// the format Polka uses when calling our webhooks.
 func GetAPIKey(headers http.Header) (string, error) {
 	if len(headers["Authorization"]) == 0 {
 		return "", fmt.Errorf("missing api key header")
 	}
-	tokens := strings.Split(headers["Authorization"][0], " ")
-	return tokens[1], nil
+	authHeader := headers["Authorization"][0]
+	if len(authHeader) < 7 || authHeader[:7] != "ApiKey " {
+		return "", fmt.Errorf("invalid api key header")
+	}
+	if authHeader[7:] == "" {
+		return "", fmt.Errorf("empty api key")
+	}
+	return authHeader[7:], nil
+}
+
+// CompareAPIKey reports whether got matches want in constant time. Both
+// keys are hashed first so that neither their contents nor their lengths
+// can be learned from response timing.
+func CompareAPIKey(got, want string) bool {
+	gotSum := sha256.Sum256([]byte(got))
+	wantSum := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(gotSum[:], wantSum[:]) == 1
 }
@@ -1,10 +1,18 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"aidanwoods.dev/go-paseto"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/pquerna/otp/totp"
 )
 
 func TestCreateValidateJWT(t *testing.T) {
@@ -15,12 +23,68 @@ func TestCreateValidateJWT(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	parsedUUID, err := ValidateJWT(tokenString, tokenSecret)
+	session, err := JWTConfig{Secret: tokenSecret}.ParseSession(tokenString)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if parsedUUID != uuid {
-		t.Fatalf("expected %s, got %s", uuid, parsedUUID)
+	if session.UserID != uuid {
+		t.Fatalf("expected %s, got %s", uuid, session.UserID)
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	userID := uuid.New()
+	before := time.Now().Add(time.Hour).Truncate(time.Second)
+	tokenString, err := MakeJWT(userID, "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := JWTConfig{Secret: "secret"}.ParseSession(tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.UserID != userID {
+		t.Fatalf("expected %s, got %s", userID, session.UserID)
+	}
+	if session.ExpiresAt.Before(before) || session.ExpiresAt.After(before.Add(2*time.Second)) {
+		t.Fatalf("expected expiry about an hour from now, got %s", session.ExpiresAt)
+	}
+}
+
+func TestJWTIssuerAndAudience(t *testing.T) {
+	userID := uuid.New()
+	chirpy := JWTConfig{Secret: "secret", Issuer: "chirpy-api"}
+	token, err := chirpy.Make(userID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := chirpy.ParseSession(token); err != nil || got.UserID != userID {
+		t.Fatalf("matching issuer: got %s, %v", got.UserID, err)
+	}
+	other := JWTConfig{Secret: "secret", Issuer: "billing"}
+	if _, err := other.ParseSession(token); err == nil {
+		t.Fatal("expected a token from another issuer to be rejected")
+	}
+	// without an Issuer the default is expected
+	if _, err := (JWTConfig{Secret: "secret"}).ParseSession(token); err == nil {
+		t.Fatal("expected the default issuer to reject a non-default one")
+	}
+
+	withAudience := JWTConfig{Secret: "secret", Issuer: "chirpy-api", Audience: "web"}
+	if _, err := withAudience.ParseSession(token); err == nil {
+		t.Fatal("expected a token without the audience to be rejected")
+	}
+	token, err = withAudience.Make(userID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withAudience.ParseSession(token); err != nil {
+		t.Fatalf("matching audience: %v", err)
+	}
+	if _, err := (JWTConfig{Secret: "secret", Issuer: "chirpy-api", Audience: "mobile"}).ParseSession(token); err == nil {
+		t.Fatal("expected a token for another audience to be rejected")
 	}
 }
 
@@ -34,7 +98,7 @@ func TestExpiredJWT(t *testing.T) {
 	// Sleep for 2 seconds to ensure the token is expired
 	time.Sleep(2 * time.Second)
 
-	_, err = ValidateJWT(tokenString, tokenSecret)
+	_, err = JWTConfig{Secret: tokenSecret}.ParseSession(tokenString)
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
@@ -48,8 +112,378 @@ func TestBadSecret(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = ValidateJWT(tokenString, "badsecret")
+	_, err = JWTConfig{Secret: "badsecret"}.ParseSession(tokenString)
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
 }
+
+func TestSecondarySecrets(t *testing.T) {
+	userID := uuid.New()
+	retired, err := MakeJWT(userID, "old-secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := JWTConfig{Secret: "new-secret", SecondarySecrets: []string{"older-secret", "old-secret"}}.ParseSession(retired)
+	if err != nil {
+		t.Fatalf("token signed with a secondary secret should validate: %v", err)
+	}
+	if got.UserID != userID {
+		t.Fatalf("expected %s, got %s", userID, got.UserID)
+	}
+
+	if _, err := (JWTConfig{Secret: "new-secret", SecondarySecrets: []string{"older-secret"}}).ParseSession(retired); err == nil {
+		t.Fatal("token signed with an unknown secret should fail")
+	}
+
+	// new tokens are signed with the primary only
+	cfg := JWTConfig{Secret: "new-secret", SecondarySecrets: []string{"old-secret"}}
+	fresh, err := cfg.Make(userID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (JWTConfig{Secret: "new-secret"}).ParseSession(fresh); err != nil {
+		t.Fatalf("expected token signed with the primary secret: %v", err)
+	}
+	if _, err := (JWTConfig{Secret: "old-secret"}).ParseSession(fresh); err == nil {
+		t.Fatal("new tokens shouldn't be signed with a secondary secret")
+	}
+}
+
+func TestTokenBackends(t *testing.T) {
+	backends := map[string]func(JWTConfig) TokenBackend{
+		"jwt":    func(c JWTConfig) TokenBackend { return c },
+		"paseto": func(c JWTConfig) TokenBackend { return PASETOConfig(c) },
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			userID := uuid.New()
+			tokens := backend(JWTConfig{Secret: "new-secret", SecondarySecrets: []string{"old-secret"}, Issuer: "chirpy-test", Audience: "web"})
+
+			token, err := tokens.Make(userID, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tokens.ParseSession(token)
+			if err != nil {
+				t.Fatalf("expected a valid token: %v", err)
+			}
+			if got.UserID != userID {
+				t.Fatalf("expected %s, got %s", userID, got.UserID)
+			}
+			if d := time.Until(got.ExpiresAt); d < 59*time.Minute || d > time.Hour {
+				t.Fatalf("expected expiry in about an hour, got %v", d)
+			}
+
+			// a renewed token keeps the session's auth_time
+			authTime := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+			renewed, err := tokens.Renew(Session{UserID: userID, AuthTime: authTime}, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session, err := tokens.ParseSession(renewed)
+			if err != nil {
+				t.Fatalf("expected a valid renewed token: %v", err)
+			}
+			if session.UserID != userID || !session.AuthTime.Equal(authTime) || session.ExpiresAt.Sub(session.IssuedAt) != time.Minute {
+				t.Fatalf("unexpected renewed session %+v", session)
+			}
+
+			retired, err := backend(JWTConfig{Secret: "old-secret", Issuer: "chirpy-test", Audience: "web"}).Make(userID, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tokens.ParseSession(retired); err != nil {
+				t.Fatalf("token from a secondary secret should validate: %v", err)
+			}
+
+			rejected := map[string]TokenBackend{
+				"other secret":   backend(JWTConfig{Secret: "other-secret", Issuer: "chirpy-test", Audience: "web"}),
+				"other issuer":   backend(JWTConfig{Secret: "new-secret", Issuer: "someone-else", Audience: "web"}),
+				"other audience": backend(JWTConfig{Secret: "new-secret", Issuer: "chirpy-test", Audience: "mobile"}),
+			}
+			for why, other := range rejected {
+				if _, err := other.ParseSession(token); err == nil {
+					t.Errorf("%s: expected the token to be rejected", why)
+				}
+			}
+
+			expired, err := tokens.Make(userID, -time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tokens.ParseSession(expired); err == nil {
+				t.Fatal("expected an expired token to be rejected")
+			}
+
+			tampered := []byte(token)
+			tampered[len(tampered)-10] ^= 1
+			if _, err := tokens.ParseSession(string(tampered)); err == nil {
+				t.Fatal("expected a tampered token to be rejected")
+			}
+		})
+	}
+
+	// neither backend accepts the other's tokens
+	cfg := JWTConfig{Secret: "secret"}
+	jwtToken, _ := cfg.Make(uuid.New(), time.Hour)
+	pasetoToken, _ := PASETOConfig(cfg).Make(uuid.New(), time.Hour)
+	if _, err := PASETOConfig(cfg).ParseSession(jwtToken); err == nil {
+		t.Error("PASETO backend accepted a JWT")
+	}
+	if _, err := cfg.ParseSession(pasetoToken); err == nil {
+		t.Error("JWT backend accepted a PASETO token")
+	}
+
+	// the PASETO key is derived for PASETO alone, not a bare hash of the
+	// secret
+	sum := sha256.Sum256([]byte(cfg.Secret))
+	bare, _ := paseto.V4SymmetricKeyFromBytes(sum[:])
+	now := time.Now()
+	payload, _ := json.Marshal(pasetoClaims{Issuer: DefaultIssuer, Subject: uuid.NewString(), IssuedAt: now, ExpiresAt: now.Add(time.Hour)})
+	token, err := paseto.NewTokenFromClaimsJSON(payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PASETOConfig(cfg).ParseSession(token.V4Encrypt(bare, nil)); err == nil {
+		t.Error("PASETO backend accepted a token under the bare SHA-256 of the secret")
+	}
+}
+
+func TestTokenLeeway(t *testing.T) {
+	cfg := JWTConfig{Secret: "secret", Leeway: 30 * time.Second}
+	userID := uuid.New()
+
+	// mint signs a token issued at iat that expires at exp
+	mints := map[string]func(iat, exp time.Time) string{
+		"jwt": func(iat, exp time.Time) string {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+				Subject:   userID.String(),
+				Issuer:    DefaultIssuer,
+				IssuedAt:  jwt.NewNumericDate(iat),
+				ExpiresAt: jwt.NewNumericDate(exp),
+			}).SignedString([]byte(cfg.Secret))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token
+		},
+		"paseto": func(iat, exp time.Time) string {
+			payload, _ := json.Marshal(pasetoClaims{Issuer: DefaultIssuer, Subject: userID.String(), IssuedAt: iat, ExpiresAt: exp})
+			token, err := paseto.NewTokenFromClaimsJSON(payload, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token.V4Encrypt(pasetoKey(cfg.Secret), nil)
+		},
+	}
+	backends := map[string]TokenBackend{"jwt": cfg, "paseto": PASETOConfig(cfg)}
+
+	now := time.Now()
+	cases := []struct {
+		name     string
+		iat, exp time.Time
+		valid    bool
+	}{
+		{"expired within the leeway", now.Add(-time.Hour), now.Add(-10 * time.Second), true},
+		{"expired beyond the leeway", now.Add(-time.Hour), now.Add(-time.Minute), false},
+		{"issued just ahead of our clock", now.Add(10 * time.Second), now.Add(time.Hour), true},
+		{"issued too far ahead", now.Add(time.Minute), now.Add(time.Hour), false},
+	}
+	for name, mint := range mints {
+		for _, c := range cases {
+			_, err := backends[name].ParseSession(mint(c.iat, c.exp))
+			if c.valid && err != nil {
+				t.Errorf("%s, %s: expected the token to validate: %v", name, c.name, err)
+			} else if !c.valid && err == nil {
+				t.Errorf("%s, %s: expected the token to be rejected", name, c.name)
+			}
+		}
+	}
+}
+
+// Tokens from the published v4.local test vectors decrypt with the library
+// the backend uses, so its tokens interoperate with other implementations.
+func TestPASETOVectors(t *testing.T) {
+	key, err := paseto.V4SymmetricKeyFromHex("707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors := map[string]string{
+		"4-E-1": "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvSwscFlAl1pk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XJ5hOb_4v9RmDkneN0S92dx0OW4pgy7omxgf3S8c3LlQg",
+		"4-E-3": "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WkwMsYXw6FSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t6-tyebyWG6Ov7kKvBdkrrAJ837lKP3iDag2hzUPHuMKA",
+	}
+	for name, token := range vectors {
+		parsed, err := paseto.NewParserWithoutExpiryCheck().ParseV4Local(key, token, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if data, _ := parsed.GetString("data"); data != "this is a secret message" {
+			t.Fatalf("%s: unexpected payload %s", name, parsed.ClaimsJSON())
+		}
+	}
+}
+
+func TestMakeRefreshTokenN(t *testing.T) {
+	for _, n := range []int{16, 32, 64} {
+		token, err := MakeRefreshTokenN(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) != 2*n {
+			t.Fatalf("expected %d hex characters, got %d", 2*n, len(token))
+		}
+	}
+
+	token, err := MakeRefreshToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 {
+		t.Fatalf("expected 64 hex characters, got %d", len(token))
+	}
+}
+
+func TestMakeRefreshTokenNTooShort(t *testing.T) {
+	_, err := MakeRefreshTokenN(MinRefreshTokenBytes - 1)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestMakeRefreshTokenNoCollisions(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 10000; i++ {
+		token, err := MakeRefreshTokenN(MinRefreshTokenBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[token] {
+			t.Fatalf("token %s generated twice", token)
+		}
+		seen[token] = true
+	}
+}
+
+func TestGetAPIKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"present", "ApiKey f271c81ff7084ee5b99a5091b42d486e", "f271c81ff7084ee5b99a5091b42d486e", false},
+		{"missing", "", "", true},
+		{"wrong scheme", "Bearer f271c81ff7084ee5b99a5091b42d486e", "", true},
+		{"scheme only", "ApiKey", "", true},
+		{"empty key", "ApiKey ", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.header != "" {
+				headers.Set("Authorization", tt.header)
+			}
+			got, err := GetAPIKey(headers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetAPIKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("GetAPIKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareAPIKey(t *testing.T) {
+	if !CompareAPIKey("secret-key", "secret-key") {
+		t.Fatal("expected equal keys to match")
+	}
+	for _, got := range []string{"secret-kez", "secret", "secret-key-longer", ""} {
+		if CompareAPIKey(got, "secret-key") {
+			t.Fatalf("expected %q not to match", got)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, _, err := NewTOTPKey("Chirpy", "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	code := func(step int64) string {
+		c, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totpOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	for _, offset := range []int64{-1, 0, 1} {
+		step, err := ValidateTOTP(code(TOTPStep(now)+offset), secret, now)
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		if step != TOTPStep(now)+offset {
+			t.Fatalf("offset %d: expected step %d, got %d", offset, TOTPStep(now)+offset, step)
+		}
+	}
+	if _, err := ValidateTOTP(code(TOTPStep(now)+2), secret, now); err == nil {
+		t.Fatal("expected a code two steps out to be rejected")
+	}
+	if _, err := ValidateTOTP("000000x", secret, now); err == nil {
+		t.Fatal("expected garbage to be rejected")
+	}
+}
+
+func TestNewTOTPKey(t *testing.T) {
+	secret, uri, err := NewTOTPKey("Chirpy", "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Fatalf("expected a 160-bit base32 secret, got %q", secret)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Chirpy:a@example.com" {
+		t.Fatalf("unexpected URI %s", uri)
+	}
+	q := u.Query()
+	if q.Get("secret") != secret || q.Get("issuer") != "Chirpy" || q.Get("digits") != "6" || q.Get("period") != "30" || q.Get("algorithm") != "SHA1" {
+		t.Fatalf("unexpected query in %s", uri)
+	}
+}
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox(strings.Repeat("k", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := box.Seal("JBSWY3DPEHPK3PXP", "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("secret stored in the clear: %s", sealed)
+	}
+	if got, err := box.Open(sealed, "user-1"); err != nil || got != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("expected the secret back, got %q, %v", got, err)
+	}
+
+	other, _ := NewSecretBox(strings.Repeat("o", 32))
+	for why, open := range map[string]func() (string, error){
+		"other row": func() (string, error) { return box.Open(sealed, "user-2") },
+		"other key": func() (string, error) { return other.Open(sealed, "user-1") },
+		"tampered":  func() (string, error) { return box.Open(sealed[:len(sealed)-2]+"AA", "user-1") },
+		"plaintext": func() (string, error) { return box.Open("JBSWY3DPEHPK3PXP", "user-1") },
+	} {
+		if _, err := open(); err == nil {
+			t.Errorf("%s: expected the sealed secret not to open", why)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sealedPrefix marks a value sealed by a SecretBox and versions its format.
+const sealedPrefix = "v1:"
+
+var errInvalidSealed = errors.New("invalid sealed secret")
+
+// DeriveKey stretches secret into a 32-byte key for one purpose with HKDF,
+// so keys for different uses never coincide even when drawn from the same
+// secret.
+func DeriveKey(secret, purpose string) []byte {
+	key := make([]byte, 32)
+	// HKDF-SHA256 can produce far more than 32 bytes, so this can't fail
+	io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(purpose)), key)
+	return key
+}
+
+// SecretBox encrypts small secrets, such as TOTP keys, for storage with
+// AES-256-GCM.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox returns a SecretBox keyed by secret.
+func NewSecretBox(secret string) (*SecretBox, error) {
+	block, err := aes.NewCipher(DeriveKey(secret, "chirpy secret box"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal encrypts plaintext bound to context, typically the ID of the row it
+// is stored in, so a sealed value copied to another row won't open.
+func (b *SecretBox) Seal(plaintext, context string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), []byte(context))
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed with the same context. Anything else,
+// including a plaintext value, is an error.
+func (b *SecretBox) Open(value, context string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return "", errInvalidSealed
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < b.aead.NonceSize() {
+		return "", errInvalidSealed
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, []byte(context))
+	if err != nil {
+		return "", errInvalidSealed
+	}
+	return string(plaintext), nil
+}
@@ -7,25 +7,144 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
+const clearChirps = `-- name: ClearChirps :exec
+DELETE FROM chirps
+`
+
+func (q *Queries) ClearChirps(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, clearChirps)
+	return err
+}
+
+const countChirps = `-- name: CountChirps :one
+SELECT COUNT(*) FROM chirps
+WHERE $1::boolean OR deleted_at IS NULL
+`
+
+func (q *Queries) CountChirps(ctx context.Context, includeDeleted bool) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countChirps, includeDeleted)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countChirpsCreatedAfter = `-- name: CountChirpsCreatedAfter :one
+SELECT COUNT(*) FROM chirps
+WHERE created_at > $1
+AND ($2::uuid IS NULL OR user_id = $2)
+AND ($3::boolean OR deleted_at IS NULL)
+`
+
+type CountChirpsCreatedAfterParams struct {
+	CreatedAfter   time.Time
+	AuthorID       uuid.NullUUID
+	IncludeDeleted bool
+}
+
+func (q *Queries) CountChirpsCreatedAfter(ctx context.Context, arg CountChirpsCreatedAfterParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countChirpsCreatedAfter, arg.CreatedAfter, arg.AuthorID, arg.IncludeDeleted)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countChirpsFromAuthors = `-- name: CountChirpsFromAuthors :one
+SELECT COUNT(*) FROM chirps
+WHERE user_id = ANY($1::uuid[])
+AND ($2::boolean OR deleted_at IS NULL)
+`
+
+type CountChirpsFromAuthorsParams struct {
+	AuthorIds      []uuid.UUID
+	IncludeDeleted bool
+}
+
+func (q *Queries) CountChirpsFromAuthors(ctx context.Context, arg CountChirpsFromAuthorsParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countChirpsFromAuthors, pq.Array(arg.AuthorIds), arg.IncludeDeleted)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countRecentChirps = `-- name: CountRecentChirps :one
+SELECT COUNT(*) AS recent, MIN(created_at)::timestamp AS oldest
+FROM chirps
+WHERE user_id = $1 AND created_at > $2
+`
+
+type CountRecentChirpsParams struct {
+	UserID uuid.UUID
+	Since  time.Time
+}
+
+type CountRecentChirpsRow struct {
+	Recent int64
+	Oldest sql.NullTime
+}
+
+func (q *Queries) CountRecentChirps(ctx context.Context, arg CountRecentChirpsParams) (CountRecentChirpsRow, error) {
+	row := q.db.QueryRowContext(ctx, countRecentChirps, arg.UserID, arg.Since)
+	var i CountRecentChirpsRow
+	err := row.Scan(&i.Recent, &i.Oldest)
+	return i, err
+}
+
+const countSearchChirps = `-- name: CountSearchChirps :one
+SELECT COUNT(*) FROM chirps
+WHERE body ILIKE $1
+AND ($2::uuid IS NULL OR user_id = $2)
+AND ($3::boolean OR deleted_at IS NULL)
+AND ($4::timestamp IS NULL OR created_at > $4)
+`
+
+type CountSearchChirpsParams struct {
+	Pattern        string
+	AuthorID       uuid.NullUUID
+	IncludeDeleted bool
+	CreatedAfter   sql.NullTime
+}
+
+func (q *Queries) CountSearchChirps(ctx context.Context, arg CountSearchChirpsParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countSearchChirps,
+		arg.Pattern,
+		arg.AuthorID,
+		arg.IncludeDeleted,
+		arg.CreatedAfter,
+	)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const createChirp = `-- name: CreateChirp :one
-INSERT INTO chirps (id, created_at, updated_at, body, user_id)
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, parent_id, image_url)
 VALUES (
-    gen_random_uuid(), now(), now(), $1, $2
+    gen_random_uuid(), now(), now(), $1, $2, $3, $4
 )
-RETURNING id, created_at, updated_at, user_id, body
+RETURNING id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url
 `
 
 type CreateChirpParams struct {
-	Body   string
-	UserID uuid.UUID
+	Body     string
+	UserID   uuid.UUID
+	ParentID uuid.NullUUID
+	ImageUrl sql.NullString
 }
 
 func (q *Queries) CreateChirp(ctx context.Context, arg CreateChirpParams) (Chirp, error) {
-	row := q.db.QueryRowContext(ctx, createChirp, arg.Body, arg.UserID)
+	row := q.db.QueryRowContext(ctx, createChirp,
+		arg.Body,
+		arg.UserID,
+		arg.ParentID,
+		arg.ImageUrl,
+	)
 	var i Chirp
 	err := row.Scan(
 		&i.ID,
@@ -33,25 +152,63 @@ func (q *Queries) CreateChirp(ctx context.Context, arg CreateChirpParams) (Chirp
 		&i.UpdatedAt,
 		&i.UserID,
 		&i.Body,
+		&i.DeletedAt,
+		&i.ParentID,
+		&i.ImageUrl,
 	)
 	return i, err
 }
 
-const deleteChirp = `-- name: DeleteChirp :exec
-DELETE FROM chirps where id= $1
+const deleteChirp = `-- name: DeleteChirp :execrows
+UPDATE chirps SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL
 `
 
-func (q *Queries) DeleteChirp(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, deleteChirp, id)
-	return err
+func (q *Queries) DeleteChirp(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteChirp, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteChirpForUser = `-- name: DeleteChirpForUser :execrows
+UPDATE chirps SET deleted_at = now() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
+`
+
+type DeleteChirpForUserParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+func (q *Queries) DeleteChirpForUser(ctx context.Context, arg DeleteChirpForUserParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteChirpForUser, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteChirpsByAuthor = `-- name: DeleteChirpsByAuthor :execresult
+UPDATE chirps SET deleted_at = now() WHERE user_id = $1 AND deleted_at IS NULL
+`
+
+func (q *Queries) DeleteChirpsByAuthor(ctx context.Context, userID uuid.UUID) (sql.Result, error) {
+	return q.db.ExecContext(ctx, deleteChirpsByAuthor, userID)
 }
 
 const getChirp = `-- name: GetChirp :one
-SELECT id, created_at, updated_at, user_id, body FROM chirps WHERE id = $1
+SELECT id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url FROM chirps WHERE id = $1
+AND ($2::boolean OR deleted_at IS NULL OR user_id = $3)
 `
 
-func (q *Queries) GetChirp(ctx context.Context, id uuid.UUID) (Chirp, error) {
-	row := q.db.QueryRowContext(ctx, getChirp, id)
+type GetChirpParams struct {
+	ID             uuid.UUID
+	IncludeDeleted bool
+	ViewerID       uuid.NullUUID
+}
+
+func (q *Queries) GetChirp(ctx context.Context, arg GetChirpParams) (Chirp, error) {
+	row := q.db.QueryRowContext(ctx, getChirp, arg.ID, arg.IncludeDeleted, arg.ViewerID)
 	var i Chirp
 	err := row.Scan(
 		&i.ID,
@@ -59,17 +216,143 @@ func (q *Queries) GetChirp(ctx context.Context, id uuid.UUID) (Chirp, error) {
 		&i.UpdatedAt,
 		&i.UserID,
 		&i.Body,
+		&i.DeletedAt,
+		&i.ParentID,
+		&i.ImageUrl,
+	)
+	return i, err
+}
+
+const getChirpReplies = `-- name: GetChirpReplies :many
+SELECT id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url FROM chirps
+WHERE parent_id = $1
+AND ($2::boolean OR deleted_at IS NULL)
+ORDER BY created_at ASC, id ASC
+`
+
+type GetChirpRepliesParams struct {
+	ParentID       uuid.NullUUID
+	IncludeDeleted bool
+}
+
+func (q *Queries) GetChirpReplies(ctx context.Context, arg GetChirpRepliesParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpReplies, arg.ParentID, arg.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.UserID,
+			&i.Body,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ImageUrl,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getChirpStats = `-- name: GetChirpStats :one
+SELECT COUNT(*) AS total, MIN(created_at)::timestamp AS earliest, MAX(created_at)::timestamp AS latest
+FROM chirps
+WHERE ($1::uuid IS NULL OR user_id = $1)
+AND deleted_at IS NULL
+`
+
+type GetChirpStatsRow struct {
+	Total    int64
+	Earliest sql.NullTime
+	Latest   sql.NullTime
+}
+
+func (q *Queries) GetChirpStats(ctx context.Context, authorID uuid.NullUUID) (GetChirpStatsRow, error) {
+	row := q.db.QueryRowContext(ctx, getChirpStats, authorID)
+	var i GetChirpStatsRow
+	err := row.Scan(
+		&i.Total,
+		&i.Earliest,
+		&i.Latest,
+	)
+	return i, err
+}
+
+const getChirpWithAuthor = `-- name: GetChirpWithAuthor :one
+SELECT chirps.id, chirps.created_at, chirps.updated_at, chirps.user_id, chirps.body, chirps.deleted_at, chirps.parent_id, chirps.image_url, users.email AS author_email
+FROM chirps JOIN users ON users.id = chirps.user_id
+WHERE chirps.id = $1
+AND ($2::boolean OR chirps.deleted_at IS NULL OR chirps.user_id = $3)
+`
+
+type GetChirpWithAuthorParams struct {
+	ID             uuid.UUID
+	IncludeDeleted bool
+	ViewerID       uuid.NullUUID
+}
+
+type GetChirpWithAuthorRow struct {
+	Chirp       Chirp
+	AuthorEmail string
+}
+
+func (q *Queries) GetChirpWithAuthor(ctx context.Context, arg GetChirpWithAuthorParams) (GetChirpWithAuthorRow, error) {
+	row := q.db.QueryRowContext(ctx, getChirpWithAuthor, arg.ID, arg.IncludeDeleted, arg.ViewerID)
+	var i GetChirpWithAuthorRow
+	err := row.Scan(
+		&i.Chirp.ID,
+		&i.Chirp.CreatedAt,
+		&i.Chirp.UpdatedAt,
+		&i.Chirp.UserID,
+		&i.Chirp.Body,
+		&i.Chirp.DeletedAt,
+		&i.Chirp.ParentID,
+		&i.Chirp.ImageUrl,
+		&i.AuthorEmail,
 	)
 	return i, err
 }
 
 const getChirps = `-- name: GetChirps :many
-SELECT id, created_at, updated_at, user_id, body FROM chirps 
-ORDER BY created_at ASC
+SELECT id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url FROM chirps 
+WHERE $1::boolean OR deleted_at IS NULL
+ORDER BY
+    CASE WHEN $2::boolean THEN CASE WHEN $3::text = 'updated_at' THEN updated_at ELSE created_at END END DESC,
+    CASE WHEN $3::text = 'updated_at' THEN updated_at ELSE created_at END ASC,
+    CASE WHEN $2::boolean THEN id END DESC,
+    id ASC
+LIMIT $4 OFFSET $5
 `
 
-func (q *Queries) GetChirps(ctx context.Context) ([]Chirp, error) {
-	rows, err := q.db.QueryContext(ctx, getChirps)
+type GetChirpsParams struct {
+	IncludeDeleted bool
+	SortDesc       bool
+	SortBy         string
+	PageLimit      int32
+	PageOffset     int32
+}
+
+func (q *Queries) GetChirps(ctx context.Context, arg GetChirpsParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, getChirps,
+		arg.IncludeDeleted,
+		arg.SortDesc,
+		arg.SortBy,
+		arg.PageLimit,
+		arg.PageOffset,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -83,6 +366,9 @@ func (q *Queries) GetChirps(ctx context.Context) ([]Chirp, error) {
 			&i.UpdatedAt,
 			&i.UserID,
 			&i.Body,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ImageUrl,
 		); err != nil {
 			return nil, err
 		}
@@ -97,14 +383,39 @@ func (q *Queries) GetChirps(ctx context.Context) ([]Chirp, error) {
 	return items, nil
 }
 
-const getChirpsFromAuthor = `-- name: GetChirpsFromAuthor :many
-SELECT id, created_at, updated_at, user_id, body FROM chirps 
-WHERE user_id = $1
-ORDER BY created_at ASC
+const getChirpsCreatedAfter = `-- name: GetChirpsCreatedAfter :many
+SELECT id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url FROM chirps
+WHERE created_at > $1
+AND ($2::uuid IS NULL OR user_id = $2)
+AND ($3::boolean OR deleted_at IS NULL)
+ORDER BY
+    CASE WHEN $4::boolean THEN CASE WHEN $5::text = 'updated_at' THEN updated_at ELSE created_at END END DESC,
+    CASE WHEN $5::text = 'updated_at' THEN updated_at ELSE created_at END ASC,
+    CASE WHEN $4::boolean THEN id END DESC,
+    id ASC
+LIMIT $6 OFFSET $7
 `
 
-func (q *Queries) GetChirpsFromAuthor(ctx context.Context, userID uuid.UUID) ([]Chirp, error) {
-	rows, err := q.db.QueryContext(ctx, getChirpsFromAuthor, userID)
+type GetChirpsCreatedAfterParams struct {
+	CreatedAfter   time.Time
+	AuthorID       uuid.NullUUID
+	IncludeDeleted bool
+	SortDesc       bool
+	SortBy         string
+	PageLimit      int32
+	PageOffset     int32
+}
+
+func (q *Queries) GetChirpsCreatedAfter(ctx context.Context, arg GetChirpsCreatedAfterParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpsCreatedAfter,
+		arg.CreatedAfter,
+		arg.AuthorID,
+		arg.IncludeDeleted,
+		arg.SortDesc,
+		arg.SortBy,
+		arg.PageLimit,
+		arg.PageOffset,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +429,9 @@ func (q *Queries) GetChirpsFromAuthor(ctx context.Context, userID uuid.UUID) ([]
 			&i.UpdatedAt,
 			&i.UserID,
 			&i.Body,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ImageUrl,
 		); err != nil {
 			return nil, err
 		}
@@ -131,3 +445,346 @@ func (q *Queries) GetChirpsFromAuthor(ctx context.Context, userID uuid.UUID) ([]
 	}
 	return items, nil
 }
+
+const getChirpsFromAuthors = `-- name: GetChirpsFromAuthors :many
+SELECT id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url FROM chirps 
+WHERE user_id = ANY($1::uuid[])
+AND ($2::boolean OR deleted_at IS NULL)
+ORDER BY
+    CASE WHEN $3::boolean THEN CASE WHEN $4::text = 'updated_at' THEN updated_at ELSE created_at END END DESC,
+    CASE WHEN $4::text = 'updated_at' THEN updated_at ELSE created_at END ASC,
+    CASE WHEN $3::boolean THEN id END DESC,
+    id ASC
+LIMIT $5 OFFSET $6
+`
+
+type GetChirpsFromAuthorsParams struct {
+	AuthorIds      []uuid.UUID
+	IncludeDeleted bool
+	SortDesc       bool
+	SortBy         string
+	PageLimit      int32
+	PageOffset     int32
+}
+
+func (q *Queries) GetChirpsFromAuthors(ctx context.Context, arg GetChirpsFromAuthorsParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpsFromAuthors,
+		pq.Array(arg.AuthorIds),
+		arg.IncludeDeleted,
+		arg.SortDesc,
+		arg.SortBy,
+		arg.PageLimit,
+		arg.PageOffset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.UserID,
+			&i.Body,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ImageUrl,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getChirpsPageAfter = `-- name: GetChirpsPageAfter :many
+SELECT id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url FROM chirps
+WHERE ($1::timestamp IS NULL OR (created_at, id) > ($1, $2::uuid))
+AND (COALESCE(cardinality($3::uuid[]), 0) = 0 OR user_id = ANY($3::uuid[]))
+AND ($4::boolean OR deleted_at IS NULL)
+ORDER BY created_at ASC, id ASC
+LIMIT $5
+`
+
+type GetChirpsPageAfterParams struct {
+	CursorCreatedAt sql.NullTime
+	CursorID        uuid.NullUUID
+	AuthorIds       []uuid.UUID
+	IncludeDeleted  bool
+	PageLimit       int32
+}
+
+func (q *Queries) GetChirpsPageAfter(ctx context.Context, arg GetChirpsPageAfterParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpsPageAfter,
+		arg.CursorCreatedAt,
+		arg.CursorID,
+		pq.Array(arg.AuthorIds),
+		arg.IncludeDeleted,
+		arg.PageLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.UserID,
+			&i.Body,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ImageUrl,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getChirpsPageBefore = `-- name: GetChirpsPageBefore :many
+SELECT id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url FROM chirps
+WHERE ($1::timestamp IS NULL OR (created_at, id) < ($1, $2::uuid))
+AND (COALESCE(cardinality($3::uuid[]), 0) = 0 OR user_id = ANY($3::uuid[]))
+AND ($4::boolean OR deleted_at IS NULL)
+ORDER BY created_at DESC, id DESC
+LIMIT $5
+`
+
+type GetChirpsPageBeforeParams struct {
+	CursorCreatedAt sql.NullTime
+	CursorID        uuid.NullUUID
+	AuthorIds       []uuid.UUID
+	IncludeDeleted  bool
+	PageLimit       int32
+}
+
+func (q *Queries) GetChirpsPageBefore(ctx context.Context, arg GetChirpsPageBeforeParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpsPageBefore,
+		arg.CursorCreatedAt,
+		arg.CursorID,
+		pq.Array(arg.AuthorIds),
+		arg.IncludeDeleted,
+		arg.PageLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.UserID,
+			&i.Body,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ImageUrl,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getReplyCounts = `-- name: GetReplyCounts :many
+SELECT parent_id::uuid AS chirp_id, COUNT(*) AS reply_count FROM chirps
+WHERE parent_id = ANY($1::uuid[])
+AND deleted_at IS NULL
+GROUP BY parent_id
+`
+
+type GetReplyCountsRow struct {
+	ChirpID    uuid.UUID
+	ReplyCount int64
+}
+
+func (q *Queries) GetReplyCounts(ctx context.Context, chirpIds []uuid.UUID) ([]GetReplyCountsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getReplyCounts, pq.Array(chirpIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetReplyCountsRow
+	for rows.Next() {
+		var i GetReplyCountsRow
+		if err := rows.Scan(&i.ChirpID, &i.ReplyCount); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getTopChirpAuthors = `-- name: GetTopChirpAuthors :many
+SELECT user_id, COUNT(*) AS chirp_count FROM chirps
+WHERE ($1::uuid IS NULL OR user_id = $1)
+AND deleted_at IS NULL
+GROUP BY user_id
+ORDER BY chirp_count DESC, user_id
+LIMIT $2
+`
+
+type GetTopChirpAuthorsParams struct {
+	AuthorID   uuid.NullUUID
+	MaxAuthors int32
+}
+
+type GetTopChirpAuthorsRow struct {
+	UserID     uuid.UUID
+	ChirpCount int64
+}
+
+func (q *Queries) GetTopChirpAuthors(ctx context.Context, arg GetTopChirpAuthorsParams) ([]GetTopChirpAuthorsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getTopChirpAuthors, arg.AuthorID, arg.MaxAuthors)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetTopChirpAuthorsRow
+	for rows.Next() {
+		var i GetTopChirpAuthorsRow
+		if err := rows.Scan(
+			&i.UserID,
+			&i.ChirpCount,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const searchChirps = `-- name: SearchChirps :many
+SELECT id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url FROM chirps
+WHERE body ILIKE $1
+AND ($2::uuid IS NULL OR user_id = $2)
+AND ($3::boolean OR deleted_at IS NULL)
+AND ($4::timestamp IS NULL OR created_at > $4)
+ORDER BY
+    CASE WHEN $5::boolean THEN CASE WHEN $6::text = 'updated_at' THEN updated_at ELSE created_at END END DESC,
+    CASE WHEN $6::text = 'updated_at' THEN updated_at ELSE created_at END ASC,
+    CASE WHEN $5::boolean THEN id END DESC,
+    id ASC
+LIMIT $7 OFFSET $8
+`
+
+type SearchChirpsParams struct {
+	Pattern        string
+	AuthorID       uuid.NullUUID
+	IncludeDeleted bool
+	CreatedAfter   sql.NullTime
+	SortDesc       bool
+	SortBy         string
+	PageLimit      int32
+	PageOffset     int32
+}
+
+func (q *Queries) SearchChirps(ctx context.Context, arg SearchChirpsParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, searchChirps,
+		arg.Pattern,
+		arg.AuthorID,
+		arg.IncludeDeleted,
+		arg.CreatedAfter,
+		arg.SortDesc,
+		arg.SortBy,
+		arg.PageLimit,
+		arg.PageOffset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.UserID,
+			&i.Body,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ImageUrl,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const updateChirpBody = `-- name: UpdateChirpBody :one
+UPDATE chirps SET body = $2, updated_at = now()
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING id, created_at, updated_at, user_id, body, deleted_at, parent_id, image_url
+`
+
+type UpdateChirpBodyParams struct {
+	ID   uuid.UUID
+	Body string
+}
+
+func (q *Queries) UpdateChirpBody(ctx context.Context, arg UpdateChirpBodyParams) (Chirp, error) {
+	row := q.db.QueryRowContext(ctx, updateChirpBody, arg.ID, arg.Body)
+	var i Chirp
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.UserID,
+		&i.Body,
+		&i.DeletedAt,
+		&i.ParentID,
+		&i.ImageUrl,
+	)
+	return i, err
+}
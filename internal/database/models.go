@@ -6,6 +6,7 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,6 +18,44 @@ type Chirp struct {
 	UpdatedAt time.Time
 	UserID    uuid.UUID
 	Body      string
+	DeletedAt sql.NullTime
+	ParentID  uuid.NullUUID
+	ImageUrl  sql.NullString
+}
+
+type ChirpLike struct {
+	ChirpID   uuid.UUID
+	UserID    uuid.UUID
+	CreatedAt time.Time
+}
+
+type ChirpReport struct {
+	ID         uuid.UUID
+	CreatedAt  time.Time
+	ChirpID    uuid.UUID
+	ReporterID uuid.UUID
+	Reason     sql.NullString
+}
+
+type ChirpRevision struct {
+	ID         uuid.UUID
+	ChirpID    uuid.UUID
+	Body       string
+	CreatedAt  time.Time
+	ReplacedAt time.Time
+}
+
+type IdempotencyKey struct {
+	UserID    uuid.UUID
+	Key       string
+	ChirpID   uuid.UUID
+	CreatedAt time.Time
+}
+
+type LoginFailure struct {
+	UserID      uuid.UUID
+	FailedCount int32
+	LockedUntil sql.NullTime
 }
 
 type RefreshToken struct {
@@ -35,4 +74,14 @@ type User struct {
 	Email          string
 	HashedPassword string
 	IsChirpyRed    bool
+	LastLoginAt    sql.NullTime
+	Settings       json.RawMessage
+}
+
+type UserTotp struct {
+	UserID       uuid.UUID
+	Secret       string
+	CreatedAt    time.Time
+	EnabledAt    sql.NullTime
+	LastUsedStep int64
 }
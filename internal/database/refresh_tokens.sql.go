@@ -12,6 +12,15 @@ import (
 	"github.com/google/uuid"
 )
 
+const clearRefreshTokens = `-- name: ClearRefreshTokens :exec
+DELETE FROM refresh_tokens
+`
+
+func (q *Queries) ClearRefreshTokens(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, clearRefreshTokens)
+	return err
+}
+
 const createRefreshToken = `-- name: CreateRefreshToken :one
 INSERT INTO refresh_tokens (token, created_at, updated_at, user_id, expires_at)
 VALUES (
@@ -40,6 +49,19 @@ func (q *Queries) CreateRefreshToken(ctx context.Context, arg CreateRefreshToken
 	return i, err
 }
 
+const deleteExpiredRefreshTokens = `-- name: DeleteExpiredRefreshTokens :execrows
+DELETE FROM refresh_tokens
+WHERE expires_at < now() OR revoked_at < $1::timestamp
+`
+
+func (q *Queries) DeleteExpiredRefreshTokens(ctx context.Context, revokedBefore time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteExpiredRefreshTokens, revokedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const getRefreshToken = `-- name: GetRefreshToken :one
 SELECT token, created_at, updated_at, user_id, expires_at, revoked_at FROM refresh_tokens WHERE token = $1
 `
@@ -58,6 +80,35 @@ func (q *Queries) GetRefreshToken(ctx context.Context, token string) (RefreshTok
 	return i, err
 }
 
+const getValidRefreshToken = `-- name: GetValidRefreshToken :one
+SELECT token, created_at, updated_at, user_id, expires_at, revoked_at FROM refresh_tokens
+WHERE token = $1 AND expires_at > now() AND revoked_at IS NULL
+`
+
+func (q *Queries) GetValidRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	row := q.db.QueryRowContext(ctx, getValidRefreshToken, token)
+	var i RefreshToken
+	err := row.Scan(
+		&i.Token,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.UserID,
+		&i.ExpiresAt,
+		&i.RevokedAt,
+	)
+	return i, err
+}
+
+const revokeAllUserRefreshTokens = `-- name: RevokeAllUserRefreshTokens :exec
+UPDATE refresh_tokens SET revoked_at = now(), updated_at = now()
+WHERE user_id = $1 AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeAllUserRefreshTokens(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, revokeAllUserRefreshTokens, userID)
+	return err
+}
+
 const revokeRefreshToken = `-- name: RevokeRefreshToken :exec
 UPDATE refresh_tokens SET revoked_at = now() WHERE token = $1
 `
@@ -66,3 +117,17 @@ func (q *Queries) RevokeRefreshToken(ctx context.Context, token string) error {
 	_, err := q.db.ExecContext(ctx, revokeRefreshToken, token)
 	return err
 }
+
+const userHasValidRefreshToken = `-- name: UserHasValidRefreshToken :one
+SELECT EXISTS (
+    SELECT 1 FROM refresh_tokens
+    WHERE user_id = $1 AND expires_at > now() AND revoked_at IS NULL
+)
+`
+
+func (q *Queries) UserHasValidRefreshToken(ctx context.Context, userID uuid.UUID) (bool, error) {
+	row := q.db.QueryRowContext(ctx, userHasValidRefreshToken, userID)
+	var exists bool
+	err := row.Scan(&exists)
+	return exists, err
+}
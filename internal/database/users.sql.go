@@ -8,8 +8,10 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 const clearUsers = `-- name: ClearUsers :exec
@@ -26,7 +28,7 @@ INSERT INTO users (id, created_at, updated_at, email, hashed_password)
 VALUES (
     gen_random_uuid(), now(), now(), $1, $2
 )
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, last_login_at, settings
 `
 
 type CreateUserParams struct {
@@ -44,12 +46,22 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.LastLoginAt,
+		&i.Settings,
 	)
 	return i, err
 }
 
+const deleteUser = `-- name: DeleteUser :execresult
+DELETE FROM users WHERE id = $1
+`
+
+func (q *Queries) DeleteUser(ctx context.Context, id uuid.UUID) (sql.Result, error) {
+	return q.db.ExecContext(ctx, deleteUser, id)
+}
+
 const getUser = `-- name: GetUser :one
-SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red FROM users WHERE email = $1
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, last_login_at, settings FROM users WHERE lower(email) = lower($1)
 `
 
 func (q *Queries) GetUser(ctx context.Context, email string) (User, error) {
@@ -62,22 +74,129 @@ func (q *Queries) GetUser(ctx context.Context, email string) (User, error) {
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.LastLoginAt,
+		&i.Settings,
 	)
 	return i, err
 }
 
-const setUserEmailPassword = `-- name: SetUserEmailPassword :exec
-UPDATE users SET email = $2, hashed_password = $3, updated_at=now() WHERE id = $1
+const getUserByID = `-- name: GetUserByID :one
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, last_login_at, settings FROM users WHERE id = $1
 `
 
-type SetUserEmailPasswordParams struct {
-	ID             uuid.UUID
-	Email          string
-	HashedPassword string
+func (q *Queries) GetUserByID(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByID, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.LastLoginAt,
+		&i.Settings,
+	)
+	return i, err
+}
+
+const getUserSettings = `-- name: GetUserSettings :one
+SELECT settings FROM users WHERE id = $1
+`
+
+func (q *Queries) GetUserSettings(ctx context.Context, id uuid.UUID) (json.RawMessage, error) {
+	row := q.db.QueryRowContext(ctx, getUserSettings, id)
+	var settings json.RawMessage
+	err := row.Scan(&settings)
+	return settings, err
+}
+
+const getUsers = `-- name: GetUsers :many
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, last_login_at, settings FROM users
+ORDER BY created_at ASC
+LIMIT $1 OFFSET $2
+`
+
+type GetUsersParams struct {
+	Limit  int32
+	Offset int32
+}
+
+func (q *Queries) GetUsers(ctx context.Context, arg GetUsersParams) ([]User, error) {
+	rows, err := q.db.QueryContext(ctx, getUsers, arg.Limit, arg.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []User
+	for rows.Next() {
+		var i User
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Email,
+			&i.HashedPassword,
+			&i.IsChirpyRed,
+			&i.LastLoginAt,
+			&i.Settings,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUsersByIDs = `-- name: GetUsersByIDs :many
+SELECT id, email FROM users WHERE id = ANY($1::uuid[])
+`
+
+type GetUsersByIDsRow struct {
+	ID    uuid.UUID
+	Email string
+}
+
+func (q *Queries) GetUsersByIDs(ctx context.Context, ids []uuid.UUID) ([]GetUsersByIDsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getUsersByIDs, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetUsersByIDsRow
+	for rows.Next() {
+		var i GetUsersByIDsRow
+		if err := rows.Scan(&i.ID, &i.Email); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
-func (q *Queries) SetUserEmailPassword(ctx context.Context, arg SetUserEmailPasswordParams) error {
-	_, err := q.db.ExecContext(ctx, setUserEmailPassword, arg.ID, arg.Email, arg.HashedPassword)
+const setUserEmail = `-- name: SetUserEmail :exec
+UPDATE users SET email = $2, updated_at=now() WHERE id = $1
+`
+
+type SetUserEmailParams struct {
+	ID    uuid.UUID
+	Email string
+}
+
+func (q *Queries) SetUserEmail(ctx context.Context, arg SetUserEmailParams) error {
+	_, err := q.db.ExecContext(ctx, setUserEmail, arg.ID, arg.Email)
 	return err
 }
 
@@ -93,3 +212,55 @@ type SetUserIsChirpyRedParams struct {
 func (q *Queries) SetUserIsChirpyRed(ctx context.Context, arg SetUserIsChirpyRedParams) (sql.Result, error) {
 	return q.db.ExecContext(ctx, setUserIsChirpyRed, arg.ID, arg.IsChirpyRed)
 }
+
+const setUserLastLogin = `-- name: SetUserLastLogin :one
+UPDATE users SET last_login_at = now() WHERE id = $1
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, last_login_at, settings
+`
+
+func (q *Queries) SetUserLastLogin(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, setUserLastLogin, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.LastLoginAt,
+		&i.Settings,
+	)
+	return i, err
+}
+
+const setUserPassword = `-- name: SetUserPassword :exec
+UPDATE users SET hashed_password = $2, updated_at=now() WHERE id = $1
+`
+
+type SetUserPasswordParams struct {
+	ID             uuid.UUID
+	HashedPassword string
+}
+
+func (q *Queries) SetUserPassword(ctx context.Context, arg SetUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, setUserPassword, arg.ID, arg.HashedPassword)
+	return err
+}
+
+const setUserSettings = `-- name: SetUserSettings :execrows
+UPDATE users SET settings = $2, updated_at = now() WHERE id = $1
+`
+
+type SetUserSettingsParams struct {
+	ID       uuid.UUID
+	Settings json.RawMessage
+}
+
+func (q *Queries) SetUserSettings(ctx context.Context, arg SetUserSettingsParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setUserSettings, arg.ID, arg.Settings)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
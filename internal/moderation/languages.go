@@ -0,0 +1,120 @@
+package moderation
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FallbackLanguage is the list used when a request names no language that
+// has one.
+const FallbackLanguage = "en"
+
+// WordLists holds a bad-word list per language, keyed by lowercase language
+// tag ("en", "de", "pt-br").
+type WordLists map[string]map[string]bool
+
+// DefaultWordLists is just the default English list.
+func DefaultWordLists() WordLists {
+	return WordLists{FallbackLanguage: DefaultBadWords()}
+}
+
+// LoadWordLists reads one list per <language>.txt file in dir, with words
+// separated by whitespace and lines starting with # ignored. Without an
+// en.txt the default English list is kept as the fallback.
+func LoadWordLists(dir string) (WordLists, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no word lists (*.txt) in %s", dir)
+	}
+
+	lists := DefaultWordLists()
+	for _, path := range paths {
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		words := map[string]bool{}
+		for _, line := range strings.Split(string(dat), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "#") {
+				continue
+			}
+			for _, word := range strings.Fields(line) {
+				words[strings.ToLower(word)] = true
+			}
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".txt"))
+		lists[lang] = words
+	}
+	return lists, nil
+}
+
+// ForLanguage picks the list for an Accept-Language header value, trying
+// languages in order of preference and each one's base language after it
+// ("de-CH" then "de"). Anything unmatched gets the FallbackLanguage list.
+func (l WordLists) ForLanguage(acceptLanguage string) map[string]bool {
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		if words, ok := l[tag]; ok {
+			return words
+		}
+		if base, _, ok := strings.Cut(tag, "-"); ok {
+			if words, ok := l[base]; ok {
+				return words
+			}
+		}
+	}
+	return l[FallbackLanguage]
+}
+
+// parseAcceptLanguage returns the tags of an Accept-Language value, most
+// preferred first, leaving out "*" and any refused with q=0.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q, err := parseQuality(params)
+		if err != nil || q <= 0 {
+			continue
+		}
+		tags = append(tags, weighted{tag, q})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	out := make([]string, len(tags))
+	for i, t := range tags {
+		out[i] = t.tag
+	}
+	return out
+}
+
+// parseQuality reads the q parameter of one Accept-Language entry; without
+// one the quality is 1.
+func parseQuality(params string) (float64, error) {
+	for _, param := range strings.Split(params, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || strings.TrimSpace(key) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0, errors.New("invalid quality")
+		}
+		return q, nil
+	}
+	return 1, nil
+}
@@ -0,0 +1,24 @@
+package moderation
+
+import "strings"
+
+// DefaultBadWords returns the word list chirps are filtered against when no
+// other list is configured.
+func DefaultBadWords() map[string]bool {
+	return map[string]bool{"kerfuffle": true, "sharbert": true, "fornax": true}
+}
+
+// Clean replaces every space-separated word of body that appears in badWords
+// (case-insensitively) with "****". Words with attached punctuation are left
+// untouched.
+func Clean(body string, badWords map[string]bool) string {
+	bodyWords := strings.Split(body, " ")
+
+	for i := 0; i < len(bodyWords); i++ {
+		word := bodyWords[i]
+		if badWords[strings.ToLower(word)] {
+			bodyWords[i] = "****"
+		}
+	}
+	return strings.Join(bodyWords, " ")
+}
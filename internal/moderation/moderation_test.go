@@ -0,0 +1,97 @@
+package moderation
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	badWords := DefaultBadWords()
+	cases := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"no bad words", "I had something interesting for breakfast", "I had something interesting for breakfast"},
+		{"single bad word", "I really need a kerfuffle to go to bed sooner", "I really need a **** to go to bed sooner"},
+		{"mixed case", "I hear Mastodon is better than Chirpy. sharbert I need to migrate Fornax", "I hear Mastodon is better than Chirpy. **** I need to migrate ****"},
+		{"trailing punctuation", "I really need a kerfuffle! to go to bed", "I really need a kerfuffle! to go to bed"},
+		{"repeated words", "kerfuffle kerfuffle KERFUFFLE", "**** **** ****"},
+		{"empty body", "", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := Clean(c.body, badWords)
+			if got != c.want {
+				t.Fatalf("expected %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestCleanCustomWords(t *testing.T) {
+	got := Clean("hello kerfuffle world", map[string]bool{"hello": true})
+	if got != "**** kerfuffle world" {
+		t.Fatalf("expected %q, got %q", "**** kerfuffle world", got)
+	}
+}
+
+func TestWordListsForLanguage(t *testing.T) {
+	lists := WordLists{
+		"en":    {"kerfuffle": true},
+		"de":    {"quatsch": true},
+		"pt-br": {"bobagem": true},
+		"pt":    {"disparate": true},
+	}
+	cases := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "kerfuffle"},
+		{"de", "quatsch"},
+		{"DE-ch", "quatsch"},
+		{"fr, de;q=0.8, en;q=0.5", "quatsch"},
+		{"en;q=0.5, de;q=0.9", "quatsch"},
+		{"de;q=0, en", "kerfuffle"},
+		{"pt-BR", "bobagem"},
+		{"pt-PT", "disparate"},
+		{"ja, *;q=0.1", "kerfuffle"},
+		{"de;q=bogus, en", "kerfuffle"},
+	}
+	for _, c := range cases {
+		t.Run(c.acceptLanguage, func(t *testing.T) {
+			if got := lists.ForLanguage(c.acceptLanguage); !got[c.want] {
+				t.Fatalf("expected the list containing %q, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadWordLists(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "de.txt"), []byte("# German\nQuatsch\nmist blödsinn\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	lists, err := LoadWordLists(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"quatsch": true, "mist": true, "blödsinn": true}; !maps.Equal(lists["de"], want) {
+		t.Fatalf("expected %v, got %v", want, lists["de"])
+	}
+	// no en.txt, so English keeps the default list
+	if !maps.Equal(lists[FallbackLanguage], DefaultBadWords()) {
+		t.Fatalf("expected the default English list, got %v", lists[FallbackLanguage])
+	}
+	if got := Clean("so ein Quatsch", lists.ForLanguage("de-AT")); got != "so ein ****" {
+		t.Fatalf("expected the German list to apply, got %q", got)
+	}
+
+	if _, err := LoadWordLists(t.TempDir()); err == nil {
+		t.Fatal("expected an error for a directory without lists")
+	}
+}
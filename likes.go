@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// likeChirpHandler records that the authenticated user likes a chirp.
+// Liking it again is a no-op, so retries are safe.
+func (cfg *apiConfig) likeChirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpId, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	if _, err := cfg.db.GetChirp(ctx, database.GetChirpParams{ID: chirpId}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			returnError(w, http.StatusNotFound, errors.New("chirp not found"))
+			return
+		}
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := cfg.db.LikeChirp(ctx, database.LikeChirpParams{ChirpID: chirpId, UserID: userID}); err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unlikeChirpHandler takes back the authenticated user's like. Like
+// DELETE elsewhere it succeeds whether or not there was a like to remove.
+func (cfg *apiConfig) unlikeChirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpId, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	if _, err := cfg.db.UnlikeChirp(ctx, database.UnlikeChirpParams{ChirpID: chirpId, UserID: userID}); err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// attachLikes fills in like_count for each chirp and, when viewer is set,
+// whether they liked it.
+func (cfg *apiConfig) attachLikes(ctx context.Context, chirps []Chirp, viewer uuid.NullUUID) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(chirps))
+	for i, c := range chirps {
+		ids[i] = c.ID
+	}
+
+	rows, err := cfg.readDB.GetChirpLikes(ctx, database.GetChirpLikesParams{ViewerID: viewer, ChirpIds: ids})
+	if err != nil {
+		return err
+	}
+	likes := make(map[uuid.UUID]database.GetChirpLikesRow, len(rows))
+	for _, row := range rows {
+		likes[row.ChirpID] = row
+	}
+
+	for i := range chirps {
+		like := likes[chirps[i].ID]
+		chirps[i].LikeCount = like.LikeCount
+		if viewer.Valid {
+			chirps[i].LikedByMe = &like.LikedByMe
+		}
+	}
+	return nil
+}
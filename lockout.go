@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// loginLockout locks an account for cooldown after threshold consecutive
+// failed logins. Unlike per-IP rate limiting it also stops a brute force
+// spread across many addresses. A zero threshold or cooldown disables it.
+type loginLockout struct {
+	threshold int
+	cooldown  time.Duration
+}
+
+func (l loginLockout) enabled() bool {
+	return l.threshold > 0 && l.cooldown > 0
+}
+
+// loginUnlocked reports whether userID may try to log in. While the account
+// is locked it answers 423 with a Retry-After for when the lock lifts, even
+// if the password would have been right.
+func (cfg *apiConfig) loginUnlocked(w http.ResponseWriter, ctx context.Context, userID uuid.UUID) bool {
+	if !cfg.loginLockout.enabled() {
+		return true
+	}
+	lockedUntil, err := cfg.db.GetLoginLockedUntil(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return false
+	}
+
+	wait := time.Until(lockedUntil)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	returnError(w, http.StatusLocked, fmt.Errorf("account locked after %d failed logins; try again later", cfg.loginLockout.threshold))
+	return false
+}
+
+// recordLoginFailure counts a wrong password or two-factor code for userID
+// and locks the account once threshold have built up. Locking starts the
+// count over, so after the cooldown another threshold failures are allowed.
+func (cfg *apiConfig) recordLoginFailure(ctx context.Context, userID uuid.UUID) error {
+	if !cfg.loginLockout.enabled() {
+		return nil
+	}
+	failures, err := cfg.db.RecordLoginFailure(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if int(failures) < cfg.loginLockout.threshold {
+		return nil
+	}
+	lockedUntil := time.Now().Add(cfg.loginLockout.cooldown)
+	log.Printf("locking logins for user %s until %s after %d failures", userID, lockedUntil.Format(time.RFC3339), failures)
+	return cfg.db.LockLogin(ctx, database.LockLoginParams{UserID: userID, LockedUntil: sql.NullTime{Time: lockedUntil, Valid: true}})
+}
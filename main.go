@@ -1,22 +1,33 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
-	"sort"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/jsleep/learngo_httpserver/internal/auth"
 	"github.com/jsleep/learngo_httpserver/internal/database"
-	_ "github.com/lib/pq"
+	"github.com/jsleep/learngo_httpserver/internal/moderation"
+	"github.com/lib/pq"
 )
 
 func helloHandler(w http.ResponseWriter, r *http.Request) {
@@ -24,17 +35,55 @@ func helloHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	w.Header().Add("Content-Type", "Content-Type: text/plain; charset=utf-8")
 	w.Write([]byte("OK"))
 }
 
 type apiConfig struct {
-	fileserverHits atomic.Int32
-	db             *database.Queries
-	platform       string
-	secret         string
-	polkaKey       string
+	fileserverHits    atomic.Int32
+	maintenance       atomic.Bool
+	routeHits         routeCounters
+	httpMetrics       httpMetrics
+	db                *database.Queries
+	readDB            *database.Queries
+	conn              *sql.DB
+	platform          string
+	secret            string
+	secondarySecrets  []string
+	tokenType         string
+	totpBox           *auth.SecretBox
+	jwtIssuer         string
+	jwtAudience       string
+	tokenLeeway       time.Duration
+	proxies           proxyTrust
+	polkaKey          string
+	adminKey          string
+	dbTimeout         time.Duration
+	maxBodyBytes      int64
+	maxChirpBatch     int
+	maxChirpLength    int
+	maxSettingsBytes  int
+	maxTokenLifetime  time.Duration
+	maintenanceRetry  time.Duration
+	tokenRenewWindow  time.Duration
+	maxSessionAge     time.Duration
+	tokenCleanup      refreshTokenCleanup
+	staticDir         string
+	staticEmbedded    bool
+	staticMaxAge      time.Duration
+	staticSPA         bool
+	redirectRoot      bool
+	gzipMinSize       int
+	cors              corsPolicy
+	redNotifier       *chirpyRedNotifier
+	chirpHub          *chirpHub
+	chirpCache        *chirpCache
+	chirpQuota        chirpQuota
+	defaultSortDesc   bool
+	loginLockout      loginLockout
+	idempotencyKeyTTL time.Duration
+	badWords          moderation.WordLists
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -45,8 +94,15 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 }
 
 func (cfg *apiConfig) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		respondJSON(w, http.StatusOK, struct {
+			FileserverHits int32 `json:"fileserver_hits"`
+		}{cfg.fileserverHits.Load()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	w.Header().Add("Content-Type", "Content-Type: text/html")
 	w.Write([]byte(fmt.Sprintf(
 		`<html>
 			<body>
@@ -57,48 +113,237 @@ func (cfg *apiConfig) metricsHandler(w http.ResponseWriter, r *http.Request) {
 		cfg.fileserverHits.Load())))
 }
 
+// wantsJSON reports whether the client asked for JSON, either with
+// ?format=json or by listing application/json in its Accept header.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		if strings.TrimSpace(mediaType) == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin authorizes a request for the /admin routes. When ADMIN_KEY is
+// configured the request must carry it as "Authorization: ApiKey <key>";
+// otherwise admin access is only available on the dev platform.
+func (cfg *apiConfig) requireAdmin(r *http.Request) error {
+	if cfg.adminKey == "" {
+		if cfg.platform != "dev" {
+			return errors.New("admin access is disabled")
+		}
+		return nil
+	}
+
+	reqKey, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		return err
+	}
+	if !auth.CompareAPIKey(reqKey, cfg.adminKey) {
+		return errors.New("invalid admin key")
+	}
+	return nil
+}
+
+// resetTargets are what POST /admin/reset can clear.
+var resetTargets = []string{"users", "chirps", "refresh_tokens", "metrics"}
+
+// resetHandler clears the database and metrics. A JSON body like
+// {"clear": ["chirps", "metrics"]} limits it to those; without a body
+// everything goes. Clearing users takes their chirps and tokens with them.
 func (cfg *apiConfig) resetHandler(w http.ResponseWriter, r *http.Request) {
-	if cfg.platform != "dev" {
-		w.WriteHeader(http.StatusForbidden)
-		w.Header().Add("Content-Type", "Content-Type: text/plain; charset=utf-8")
-		w.Write([]byte("Forbidden"))
+	if err := cfg.requireAdmin(r); err != nil {
+		returnError(w, http.StatusForbidden, err)
 		return
 	}
 
-	err := cfg.db.ClearUsers(r.Context())
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Header().Add("Content-Type", "Content-Type: text/plain; charset=utf-8")
-		w.Write([]byte("Internal Server Error"))
+	type parameters struct {
+		Clear []string `json:"clear"`
+	}
+
+	targets := map[string]bool{}
+	if r.ContentLength == 0 {
+		for _, target := range resetTargets {
+			targets[target] = true
+		}
+	} else {
+		params := parameters{}
+		if !cfg.decodeJSON(w, r, &params) {
+			return
+		}
+		fe := fieldErrors{}
+		if len(params.Clear) == 0 {
+			fe.add("clear", "must name at least one of "+strings.Join(resetTargets, ", "))
+		}
+		for _, target := range params.Clear {
+			if !slices.Contains(resetTargets, target) {
+				fe.add("clear", fmt.Sprintf("unknown target %q", target))
+			}
+			targets[target] = true
+		}
+		if fe.any() {
+			returnValidationErrors(w, fe)
+			return
+		}
+	}
+
+	if targets["users"] || targets["chirps"] || targets["refresh_tokens"] {
+		ctx, cancel := cfg.dbContext(r)
+		defer cancel()
+
+		err := cfg.withTx(ctx, func(q *database.Queries) error {
+			if targets["refresh_tokens"] {
+				if err := q.ClearRefreshTokens(ctx); err != nil {
+					return err
+				}
+			}
+			if targets["chirps"] {
+				if err := q.ClearChirps(ctx); err != nil {
+					return err
+				}
+			}
+			if targets["users"] {
+				return q.ClearUsers(ctx)
+			}
+			return nil
+		})
+		if err != nil {
+			returnDBError(w, ctx, http.StatusInternalServerError, err)
+			return
+		}
+		cfg.chirpCache.purge()
 	}
+	if targets["metrics"] {
+		cfg.fileserverHits.Store(0)
+		cfg.routeHits.reset()
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	cfg.fileserverHits.Store(0)
-	w.Header().Add("Content-Type", "Content-Type: text/plain; charset=utf-8")
 	w.Write([]byte("OK"))
 }
 
-func Clean(body string) string {
-	bad_words := map[string]bool{"kerfuffle": true, "sharbert": true, "fornax": true}
+type User struct {
+	ID           uuid.UUID  `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	Email        string     `json:"email"`
+	Token        string     `json:"token,omitempty"`
+	RefreshToken string     `json:"refresh_token,omitempty"`
+	IsChirpyRed  bool       `json:"is_chirpy_red"`
+	LastLoginAt  *time.Time `json:"last_login_at"`
+}
 
-	body_words := strings.Split(body, " ")
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
 
-	for i := 0; i < len(body_words); i++ {
-		word := body_words[i]
-		if bad_words[strings.ToLower(word)] {
-			body_words[i] = "****"
+// parsePagination reads the limit and offset query params, applying the
+// default page size when limit is absent.
+func parsePagination(r *http.Request) (limit, offset int32, err error) {
+	limit = defaultPageLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
 		}
+		limit = int32(n)
 	}
-	return strings.Join(body_words, " ")
+	if s := r.URL.Query().Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > math.MaxInt32 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+		offset = int32(n)
+	}
+	return limit, offset, nil
 }
 
-type User struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	Email        string    `json:"email"`
-	Token        string    `json:"token"`
-	RefreshToken string    `json:"refresh_token"`
-	IsChirpyRed  bool      `json:"is_chirpy_red"`
+func (cfg *apiConfig) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.requireAdmin(r); err != nil {
+		returnError(w, http.StatusForbidden, err)
+		return
+	}
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	dbUsers, err := cfg.db.GetUsers(ctx, database.GetUsersParams{Limit: limit, Offset: offset})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	users := make([]User, len(dbUsers))
+	for i, dbUser := range dbUsers {
+		users[i] = userFromDB(dbUser)
+	}
+
+	respondJSON(w, http.StatusOK, users)
+}
+
+// canonicalEmail is the form emails are stored and looked up in, so that
+// addresses differing only in case belong to the same account.
+func canonicalEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateEmail checks that email is a bare address (no display name) and
+// returns its canonical form.
+func validateEmail(email string) (string, error) {
+	email = canonicalEmail(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", errors.New("invalid email address")
+	}
+	return email, nil
+}
+
+// nullTimePtr returns nil for a NULL timestamp so it serializes as JSON null.
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// nullStringPtr returns nil for a NULL string so it can be omitted from JSON.
+func nullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+// nullUUIDPtr returns nil for a NULL UUID so it can be omitted from JSON.
+func nullUUIDPtr(id uuid.NullUUID) *uuid.UUID {
+	if !id.Valid {
+		return nil
+	}
+	return &id.UUID
+}
+
+// userFromDB maps a database user to its API representation. Tokens are
+// left empty; only the login handler fills them in.
+func userFromDB(dbUser database.User) User {
+	return User{
+		ID:          dbUser.ID,
+		CreatedAt:   dbUser.CreatedAt,
+		UpdatedAt:   dbUser.UpdatedAt,
+		Email:       dbUser.Email,
+		IsChirpyRed: dbUser.IsChirpyRed,
+		LastLoginAt: nullTimePtr(dbUser.LastLoginAt),
+	}
 }
 
 func (cfg *apiConfig) addUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -107,9 +352,17 @@ func (cfg *apiConfig) addUserHandler(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	decoder.Decode(&params)
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
+
+	email, fe := validateCredentials(params.Email, params.Password)
+	if fe.any() {
+		returnValidationErrors(w, fe)
+		return
+	}
+	params.Email = email
 
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
@@ -118,153 +371,413 @@ func (cfg *apiConfig) addUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	databaseUser := database.CreateUserParams{Email: params.Email, HashedPassword: hashedPassword}
 
-	dbUser, err := cfg.db.CreateUser(r.Context(), databaseUser)
-	user := User{
-		ID:          dbUser.ID,
-		CreatedAt:   dbUser.CreatedAt,
-		UpdatedAt:   dbUser.UpdatedAt,
-		Email:       dbUser.Email,
-		IsChirpyRed: dbUser.IsChirpyRed,
-	}
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	dbUser, err := cfg.db.CreateUser(ctx, databaseUser)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		if isUniqueViolation(err) {
+			returnError(w, http.StatusConflict, errors.New("email already registered"))
+			return
+		}
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
 		return
 	}
+	user := userFromDB(dbUser)
 
-	statusCode := 201
-	dat, _ := json.Marshal(user)
+	w.Header().Set("Location", "/api/users/"+user.ID.String()+"/profile")
+	respondJSON(w, http.StatusCreated, user)
+}
 
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(dat)
+// defaultTokenLifetime is how long an access token lasts when the client
+// doesn't ask for something else at login.
+const defaultTokenLifetime = time.Hour
+
+// tokenLifetime turns the optional expires_in_seconds login field into an
+// access token lifetime, rejecting values that aren't positive or exceed
+// cfg.maxTokenLifetime.
+func (cfg *apiConfig) tokenLifetime(expiresInSeconds *int) (time.Duration, error) {
+	if expiresInSeconds == nil {
+		return defaultTokenLifetime, nil
+	}
+	// compared in seconds, since a huge value would overflow a Duration
+	maxSeconds := int64(cfg.maxTokenLifetime / time.Second)
+	if n := int64(*expiresInSeconds); n <= 0 || n > maxSeconds {
+		return 0, fmt.Errorf("must be between 1 and %d", maxSeconds)
+	}
+	return time.Duration(*expiresInSeconds) * time.Second, nil
 }
 
 func (cfg *apiConfig) loginHandler(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email            string `json:"email"`
+		Password         string `json:"password"`
+		TOTPCode         string `json:"totp_code"`
+		ExpiresInSeconds *int   `json:"expires_in_seconds"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	decoder.Decode(&params)
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
 
-	dbUser, err := cfg.db.GetUser(r.Context(), params.Email)
+	lifetime, err := cfg.tokenLifetime(params.ExpiresInSeconds)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		returnValidationErrors(w, fieldErrors{"expires_in_seconds": err.Error()})
 		return
 	}
 
-	err = auth.CheckPasswordHash(params.Password, dbUser.HashedPassword)
-	if err != nil {
-		dat := []byte(fmt.Sprintf("{error:\"%s\"}", err.Error()))
-		statusCode := http.StatusUnauthorized
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
 
-		w.WriteHeader(statusCode)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(dat)
+	// the same message for an unknown email and a wrong password, so the
+	// response doesn't reveal which accounts exist
+	errInvalidLogin := errors.New("invalid email or password")
+
+	dbUser, err := cfg.db.GetUser(ctx, canonicalEmail(params.Email))
+	if errors.Is(err, sql.ErrNoRows) {
+		returnError(w, http.StatusUnauthorized, errInvalidLogin)
+		return
+	}
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
 		return
 	}
 
-	user := User{
-		ID:          dbUser.ID,
-		CreatedAt:   dbUser.CreatedAt,
-		UpdatedAt:   dbUser.UpdatedAt,
-		Email:       dbUser.Email,
-		IsChirpyRed: dbUser.IsChirpyRed,
+	if !cfg.loginUnlocked(w, ctx, dbUser.ID) {
+		return
 	}
 
-	jwt_token, err := auth.MakeJWT(user.ID, cfg.secret, time.Duration(60)*time.Minute)
+	err = auth.CheckPasswordHash(params.Password, dbUser.HashedPassword)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		if err := cfg.recordLoginFailure(ctx, dbUser.ID); err != nil {
+			returnDBError(w, ctx, http.StatusInternalServerError, err)
+			return
+		}
+		returnError(w, http.StatusUnauthorized, errInvalidLogin)
 		return
 	}
 
-	user.Token = jwt_token
+	if !cfg.passesTOTP(w, ctx, dbUser.ID, params.TOTPCode) {
+		return
+	}
 
-	refresh_token, err := auth.MakeRefreshToken()
+	jwt_token, err := cfg.tokens().Make(dbUser.ID, lifetime)
 	if err != nil {
 		returnError(w, http.StatusBadRequest, err)
 		return
 	}
-	user.RefreshToken = refresh_token
 
-	_, err = cfg.db.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{UserID: user.ID, Token: refresh_token, ExpiresAt: time.Now().Add(time.Duration(60*24) * time.Hour)})
+	refresh_token, err := auth.MakeRefreshToken()
 	if err != nil {
 		returnError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	statusCode := 200
-	dat, _ := json.Marshal(user)
+	err = cfg.withTx(ctx, func(q *database.Queries) error {
+		dbUser, err = q.SetUserLastLogin(ctx, dbUser.ID)
+		if err != nil {
+			return err
+		}
+		// a successful login starts the failure count over
+		if cfg.loginLockout.enabled() {
+			if err := q.ClearLoginFailures(ctx, dbUser.ID); err != nil {
+				return err
+			}
+		}
+		_, err = q.CreateRefreshToken(ctx, database.CreateRefreshTokenParams{UserID: dbUser.ID, Token: refresh_token, ExpiresAt: time.Now().Add(time.Duration(60*24) * time.Hour)})
+		return err
+	})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
 
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(dat)
+	user := userFromDB(dbUser)
+	user.Token = jwt_token
+	user.RefreshToken = refresh_token
 
+	respondJSON(w, http.StatusOK, user)
 }
 
 type Chirp struct {
-	ID        uuid.UUID `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Body      string    `json:"body"`
-	UserID    uuid.UUID `json:"user_id"`
+	ID         uuid.UUID    `json:"id"`
+	CreatedAt  time.Time    `json:"created_at"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+	Body       string       `json:"body"`
+	UserID     uuid.UUID    `json:"user_id"`
+	ParentID   *uuid.UUID   `json:"parent_id,omitempty"`
+	ImageURL   *string      `json:"image_url,omitempty"`
+	LikeCount  int64        `json:"like_count"`
+	LikedByMe  *bool        `json:"liked_by_me,omitempty"`
+	ReplyCount int64        `json:"reply_count"`
+	Author     *ChirpAuthor `json:"author,omitempty"`
+	DeletedAt  *time.Time   `json:"deleted_at,omitempty"`
+}
+
+// ChirpAuthor is included in a chirp when the client asks for ?include=author.
+type ChirpAuthor struct {
+	Email string `json:"email"`
+}
+
+func chirpFromDB(dbChirp database.Chirp) Chirp {
+	return Chirp{
+		ID:        dbChirp.ID,
+		CreatedAt: dbChirp.CreatedAt,
+		UpdatedAt: dbChirp.UpdatedAt,
+		Body:      dbChirp.Body,
+		UserID:    dbChirp.UserID,
+		DeletedAt: nullTimePtr(dbChirp.DeletedAt),
+		ParentID:  nullUUIDPtr(dbChirp.ParentID),
+		ImageURL:  nullStringPtr(dbChirp.ImageUrl),
+	}
+}
+
+// includeDeleted reports whether the caller asked for soft-deleted chirps
+// with ?include_deleted=true, which only admins may do.
+func (cfg *apiConfig) includeDeleted(r *http.Request) (bool, error) {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		return false, nil
+	}
+	if err := cfg.requireAdmin(r); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// optionalViewer identifies the caller from an optional bearer token.
+// Without one (including admin requests, which send an ApiKey) the viewer is
+// anonymous; a bearer token that is present must be valid.
+func (cfg *apiConfig) optionalViewer(r *http.Request) (uuid.NullUUID, error) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return uuid.NullUUID{}, nil
+	}
+	session, err := cfg.authenticate(r)
+	if err != nil {
+		return uuid.NullUUID{}, err
+	}
+	return uuid.NullUUID{UUID: session.UserID, Valid: true}, nil
+}
+
+// includesAuthor reports whether ?include= asks for author details.
+func includesAuthor(r *http.Request) bool {
+	for _, include := range strings.Split(r.URL.Query().Get("include"), ",") {
+		if strings.TrimSpace(include) == "author" {
+			return true
+		}
+	}
+	return false
+}
+
+// attachAuthors fills in author for each chirp. The distinct authors are
+// looked up in one query, so a page costs the same however many there are.
+func (cfg *apiConfig) attachAuthors(ctx context.Context, chirps []Chirp) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+	seen := make(map[uuid.UUID]bool)
+	var ids []uuid.UUID
+	for _, c := range chirps {
+		if !seen[c.UserID] {
+			seen[c.UserID] = true
+			ids = append(ids, c.UserID)
+		}
+	}
+
+	rows, err := cfg.readDB.GetUsersByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+	authors := make(map[uuid.UUID]*ChirpAuthor, len(rows))
+	for _, row := range rows {
+		authors[row.ID] = &ChirpAuthor{Email: row.Email}
+	}
+
+	for i := range chirps {
+		chirps[i].Author = authors[chirps[i].UserID]
+	}
+	return nil
+}
+
+// defaultMaxChirpLength is the chirp length limit, in runes, used when
+// MAX_CHIRP_LENGTH is unset.
+const defaultMaxChirpLength = 140
+
+var (
+	errChirpEmpty   = errors.New("Chirp is empty")
+	errChirpTooLong = errors.New("Chirp is too long")
+)
+
+// validateChirpBody trims surrounding whitespace and checks the length in
+// runes, so multibyte characters count the same as ASCII ones. A zero
+// maxChirpLength leaves the length unchecked.
+func (cfg *apiConfig) validateChirpBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", errChirpEmpty
+	}
+	if cfg.maxChirpLength > 0 && utf8.RuneCountInString(body) > cfg.maxChirpLength {
+		return "", errChirpTooLong
+	}
+	return body, nil
+}
+
+// prepareChirpBody validates body and masks profanity in it, giving the
+// text a chirp would be stored with. The bad-word list is picked by the
+// request's Accept-Language, falling back to English.
+func (cfg *apiConfig) prepareChirpBody(r *http.Request, body string) (string, error) {
+	body, err := cfg.validateChirpBody(body)
+	if err != nil {
+		return "", err
+	}
+	return moderation.Clean(body, cfg.badWords.ForLanguage(r.Header.Get("Accept-Language"))), nil
+}
+
+// maxImageURLLength caps a chirp's image_url, in bytes.
+const maxImageURLLength = 2048
+
+// validateImageURL accepts absolute http and https URLs only, so a chirp
+// can't carry javascript: or data: links into clients that render it.
+func validateImageURL(s string) error {
+	if len(s) > maxImageURLLength {
+		return fmt.Errorf("image_url must be at most %d characters", maxImageURLLength)
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("image_url must be an http or https URL")
+	}
+	return nil
+}
+
+// chirpErrorCode maps a validateChirpBody error to its error code.
+func chirpErrorCode(err error) errorCode {
+	if errors.Is(err, errChirpTooLong) {
+		return codeChirpTooLong
+	}
+	return codeChirpEmpty
 }
 
 func (cfg *apiConfig) addChirpHandler(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Body string `json:"body"`
+		Body     string     `json:"body"`
+		ParentID *uuid.UUID `json:"parent_id"`
+		ImageURL *string    `json:"image_url"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	decoder.Decode(&params)
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	userID := requestUserID(r)
+
+	var err error
+	params.Body, err = cfg.prepareChirpBody(r, params.Body)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		returnErrorCode(w, http.StatusBadRequest, chirpErrorCode(err), err)
 		return
 	}
-	uuid, err := auth.ValidateJWT(token, cfg.secret)
+
+	dbParams := database.CreateChirpParams{Body: params.Body, UserID: userID}
+	if params.ParentID != nil {
+		dbParams.ParentID = uuid.NullUUID{UUID: *params.ParentID, Valid: true}
+	}
+	if params.ImageURL != nil {
+		if err := validateImageURL(*params.ImageURL); err != nil {
+			returnError(w, http.StatusBadRequest, err)
+			return
+		}
+		dbParams.ImageUrl = sql.NullString{String: *params.ImageURL, Valid: true}
+	}
+
+	key, err := cfg.idempotencyKey(r)
 	if err != nil {
-		returnError(w, http.StatusUnauthorized, err)
+		returnError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if len(params.Body) > 140 {
-		err = errors.New("Chirp is too long")
-		returnError(w, http.StatusBadRequest, err)
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	// a retried request gets the chirp its first attempt created
+	if key != "" {
+		prior, found, err := cfg.idempotentChirp(ctx, userID, key)
+		if err != nil {
+			returnDBError(w, ctx, http.StatusInternalServerError, err)
+			return
+		}
+		if found {
+			replayChirp(w, prior)
+			return
+		}
+	}
+
+	// replies must point at a chirp that is still there
+	if dbParams.ParentID.Valid {
+		if _, err := cfg.db.GetChirp(ctx, database.GetChirpParams{ID: dbParams.ParentID.UUID}); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				returnError(w, http.StatusNotFound, errors.New("parent chirp not found"))
+				return
+			}
+			returnDBError(w, ctx, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if !cfg.allowChirps(w, ctx, userID, 1) {
 		return
+	}
 
+	var dbChirp database.Chirp
+	if key == "" {
+		dbChirp, err = cfg.db.CreateChirp(ctx, dbParams)
 	} else {
-		params.Body = Clean(params.Body)
+		dbChirp, err = cfg.createChirpOnce(ctx, dbParams, key)
 	}
+	if errors.Is(err, errIdempotencyKeyTaken) {
+		// a concurrent retry won the race; answer with its chirp
+		dbChirp, _, err = cfg.idempotentChirp(ctx, userID, key)
+		if err != nil {
+			returnDBError(w, ctx, http.StatusInternalServerError, err)
+			return
+		}
+		replayChirp(w, dbChirp)
+		return
+	}
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	chirp := chirpFromDB(dbChirp)
+	cfg.chirpHub.publish(chirp)
 
-	dbParams := database.CreateChirpParams{Body: params.Body, UserID: uuid}
+	w.Header().Set("Location", "/api/chirps/"+chirp.ID.String())
+	respondJSON(w, http.StatusCreated, chirp)
+}
 
-	dbChirp, err := cfg.db.CreateChirp(r.Context(), dbParams)
-	chirp := Chirp{
-		ID:        dbChirp.ID,
-		CreatedAt: dbChirp.CreatedAt,
-		UpdatedAt: dbChirp.UpdatedAt,
-		Body:      dbChirp.Body,
-		UserID:    dbChirp.UserID,
+// validateChirpHandler runs the checks addChirpHandler would without
+// creating anything, so clients can show problems before the user posts.
+func (cfg *apiConfig) validateChirpHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
+	type response struct {
+		Valid       bool   `json:"valid"`
+		CleanedBody string `json:"cleaned_body"`
 	}
 
-	if err != nil {
-		err = errors.New("Chirp is too long")
-		returnError(w, http.StatusBadRequest, err)
+	params := parameters{}
+	if !cfg.decodeJSON(w, r, &params) {
 		return
-	} else {
-		statusCode := 201
-		dat, _ := json.Marshal(chirp)
+	}
 
-		w.WriteHeader(statusCode)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(dat)
+	body, err := cfg.prepareChirpBody(r, params.Body)
+	if err != nil {
+		returnErrorCode(w, http.StatusBadRequest, chirpErrorCode(err), err)
+		return
 	}
 
+	respondJSON(w, http.StatusOK, response{Valid: true, CleanedBody: body})
 }
 
 func (cfg *apiConfig) getChirpHandler(w http.ResponseWriter, r *http.Request) {
@@ -274,27 +787,94 @@ func (cfg *apiConfig) getChirpHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dbChirp, err := cfg.db.GetChirp(r.Context(), chirpId)
+	fields, err := parseChirpFields(r)
 	if err != nil {
-		returnError(w, http.StatusNotFound, err)
+		returnError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	chirp := Chirp{
-		ID:        dbChirp.ID,
-		CreatedAt: dbChirp.CreatedAt,
-		UpdatedAt: dbChirp.UpdatedAt,
-		Body:      dbChirp.Body,
-		UserID:    dbChirp.UserID,
+	withDeleted, err := cfg.includeDeleted(r)
+	if err != nil {
+		returnError(w, http.StatusForbidden, err)
+		return
+	}
+
+	// owners can still see their own soft-deleted chirps
+	viewer, err := cfg.optionalViewer(r)
+	if err != nil {
+		returnError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	var dbChirp database.Chirp
+	var author *ChirpAuthor
+	if includesAuthor(r) {
+		row, err := cfg.readDB.GetChirpWithAuthor(ctx, database.GetChirpWithAuthorParams{ID: chirpId, IncludeDeleted: withDeleted, ViewerID: viewer})
+		if err != nil {
+			returnDBError(w, ctx, http.StatusNotFound, err)
+			return
+		}
+		dbChirp = row.Chirp
+		author = &ChirpAuthor{Email: row.AuthorEmail}
+	} else if cached, ok := cfg.chirpCache.get(chirpId); ok {
+		dbChirp = cached
+	} else {
+		// misses go to the primary: a replica still behind an edit or
+		// delete would otherwise put the old chirp back in the cache
+		q := cfg.readDB
+		if cfg.chirpCache != nil {
+			q = cfg.db
+		}
+		dbChirp, err = q.GetChirp(ctx, database.GetChirpParams{ID: chirpId, IncludeDeleted: withDeleted, ViewerID: viewer})
+		if err != nil {
+			returnDBError(w, ctx, http.StatusNotFound, err)
+			return
+		}
+		cfg.chirpCache.add(dbChirp)
+	}
+
+	chirps := []Chirp{chirpFromDB(dbChirp)}
+	if err := cfg.attachCounts(ctx, chirps, viewer); err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
 	}
+	chirp := chirps[0]
+	chirp.Author = author
 
-	statusCode := 200
-	dat, _ := json.Marshal(chirp)
+	etag := chirpETag(chirp)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	respondChirp(w, http.StatusOK, chirp, fields)
+}
 
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(dat)
+// chirpETag identifies a version of a chirp as the caller sees it; an edit
+// bumps updated_at, and likes and replies change the counts (or the caller's
+// own flag).
+func chirpETag(c Chirp) string {
+	liked := c.LikedByMe != nil && *c.LikedByMe
+	return fmt.Sprintf(`W/"%s-%d-%d-%t-%d"`, c.ID, c.UpdatedAt.UnixNano(), c.LikeCount, liked, c.ReplyCount)
+}
 
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison GET requests call for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
 }
 
 func (cfg *apiConfig) deleteChirpHandler(w http.ResponseWriter, r *http.Request) {
@@ -304,105 +884,299 @@ func (cfg *apiConfig) deleteChirpHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	dbChirp, err := cfg.db.GetChirp(r.Context(), chirpId)
+	jwt_user_id := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	deleted, err := cfg.db.DeleteChirpForUser(ctx, database.DeleteChirpForUserParams{ID: chirpId, UserID: jwt_user_id})
 	if err != nil {
-		returnError(w, http.StatusNotFound, err)
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
 		return
 	}
+	cfg.chirpCache.forget(chirpId)
 
-	chirp := Chirp{
-		ID:        dbChirp.ID,
-		CreatedAt: dbChirp.CreatedAt,
-		UpdatedAt: dbChirp.UpdatedAt,
-		Body:      dbChirp.Body,
-		UserID:    dbChirp.UserID,
+	if deleted == 0 {
+		// nothing deleted: either the chirp doesn't exist or it isn't ours
+		_, err = cfg.db.GetChirp(ctx, database.GetChirpParams{ID: chirpId})
+		if err != nil {
+			returnDBError(w, ctx, http.StatusNotFound, err)
+			return
+		}
+		returnError(w, http.StatusForbidden, errors.New("You are not authorized to delete this chirp"))
+		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAuthorChirpsHandler soft-deletes every chirp of the authenticated
+// user. The author must be given explicitly as ?author=me (or the caller's
+// own ID) so a stray DELETE /api/chirps can't wipe a history by accident.
+func (cfg *apiConfig) deleteAuthorChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	switch author := r.URL.Query().Get("author"); author {
+	case "me", userID.String():
+	case "":
+		returnError(w, http.StatusBadRequest, errors.New("author is required; use author=me"))
+		return
+	default:
+		returnError(w, http.StatusForbidden, errors.New("You can only delete your own chirps"))
+		return
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	result, err := cfg.db.DeleteChirpsByAuthor(ctx, userID)
 	if err != nil {
-		returnError(w, http.StatusUnauthorized, err)
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	cfg.chirpCache.forgetAuthor(userID)
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	jwt_user_id, err := auth.ValidateJWT(token, cfg.secret)
+	w.Header().Set("X-Deleted-Count", strconv.FormatInt(deleted, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	fields, err := parseChirpFields(r)
 	if err != nil {
-		returnError(w, http.StatusUnauthorized, err)
+		returnError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if chirp.UserID != jwt_user_id {
-		returnError(w, 403, errors.New("You are not authorized to delete this chirp"))
+	withDeleted, err := cfg.includeDeleted(r)
+	if err != nil {
+		returnError(w, http.StatusForbidden, err)
 		return
 	}
 
-	err = cfg.db.DeleteChirp(r.Context(), chirpId)
+	// authenticated callers also learn which chirps they liked
+	viewer, err := cfg.optionalViewer(r)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		returnError(w, http.StatusUnauthorized, err)
 		return
 	}
 
-	statusCode := 204
-	dat, _ := json.Marshal(chirp)
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
 
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(dat)
+	q := r.URL.Query().Get("q")
 
-}
+	authorIDs, err := parseAuthorIDs(r)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+	authorId := uuid.NullUUID{}
+	if len(authorIDs) == 1 {
+		authorId = uuid.NullUUID{UUID: authorIDs[0], Valid: true}
+	}
 
-func (cfg *apiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
-	s := r.URL.Query().Get("author_id")
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
 
-	var dbChirps []database.Chirp
-	var err error
+	if usesCursor(r) {
+		cfg.getChirpsPage(w, r, ctx, authorIDs, withDeleted, viewer, limit, fields)
+		return
+	}
 
-	if s == "" {
-		dbChirps, err = cfg.db.GetChirps(r.Context())
+	sortBy := r.URL.Query().Get("sort_by")
+	if sortBy == "" {
+		sortBy = "created_at"
+	}
+	// only ever compared against literals in SQL, but rejected early so a
+	// typo doesn't silently fall back to created_at
+	if !chirpSortColumns[sortBy] {
+		returnError(w, http.StatusBadRequest, errors.New("sort_by must be created_at or updated_at"))
+		return
+	}
+	sortDesc, err := cfg.sortDescending(r)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	createdAfter := sql.NullTime{}
+	if s := r.URL.Query().Get("created_after"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
 		if err != nil {
-			returnError(w, http.StatusBadRequest, err)
+			returnError(w, http.StatusBadRequest, errors.New("created_after must be an RFC 3339 timestamp"))
 			return
 		}
-	} else {
-		authorId, err := uuid.Parse(s)
-		if err != nil {
-			returnError(w, http.StatusBadRequest, err)
-			return
+		createdAfter = sql.NullTime{Time: t, Valid: true}
+	}
+
+	// search and created_after still take a single author
+	if len(authorIDs) > 1 && (q != "" || createdAfter.Valid) {
+		returnError(w, http.StatusBadRequest, errors.New("several author_id values can't be combined with q or created_after"))
+		return
+	}
+
+	// every listing is counted and paged in SQL, so none of them loads more
+	// than a page of chirps
+	var dbChirps []database.Chirp
+	var total int64
+
+	if q != "" {
+		total, err = cfg.readDB.CountSearchChirps(ctx, database.CountSearchChirpsParams{
+			Pattern:        likePattern(q),
+			AuthorID:       authorId,
+			IncludeDeleted: withDeleted,
+			CreatedAfter:   createdAfter,
+		})
+		if err == nil {
+			dbChirps, err = cfg.readDB.SearchChirps(ctx, database.SearchChirpsParams{
+				Pattern:        likePattern(q),
+				AuthorID:       authorId,
+				IncludeDeleted: withDeleted,
+				CreatedAfter:   createdAfter,
+				SortDesc:       sortDesc,
+				SortBy:         sortBy,
+				PageLimit:      limit,
+				PageOffset:     offset,
+			})
 		}
-		dbChirps, err = cfg.db.GetChirpsFromAuthor(r.Context(), authorId)
-		if err != nil {
-			returnError(w, http.StatusBadRequest, err)
-			return
+	} else if createdAfter.Valid {
+		total, err = cfg.readDB.CountChirpsCreatedAfter(ctx, database.CountChirpsCreatedAfterParams{
+			CreatedAfter:   createdAfter.Time,
+			AuthorID:       authorId,
+			IncludeDeleted: withDeleted,
+		})
+		if err == nil {
+			dbChirps, err = cfg.readDB.GetChirpsCreatedAfter(ctx, database.GetChirpsCreatedAfterParams{
+				CreatedAfter:   createdAfter.Time,
+				AuthorID:       authorId,
+				IncludeDeleted: withDeleted,
+				SortDesc:       sortDesc,
+				SortBy:         sortBy,
+				PageLimit:      limit,
+				PageOffset:     offset,
+			})
+		}
+	} else if len(authorIDs) == 0 {
+		total, err = cfg.readDB.CountChirps(ctx, withDeleted)
+		if err == nil {
+			dbChirps, err = cfg.readDB.GetChirps(ctx, database.GetChirpsParams{
+				IncludeDeleted: withDeleted,
+				SortDesc:       sortDesc,
+				SortBy:         sortBy,
+				PageLimit:      limit,
+				PageOffset:     offset,
+			})
+		}
+	} else {
+		total, err = cfg.readDB.CountChirpsFromAuthors(ctx, database.CountChirpsFromAuthorsParams{AuthorIds: authorIDs, IncludeDeleted: withDeleted})
+		if err == nil {
+			dbChirps, err = cfg.readDB.GetChirpsFromAuthors(ctx, database.GetChirpsFromAuthorsParams{
+				AuthorIds:      authorIDs,
+				IncludeDeleted: withDeleted,
+				SortDesc:       sortDesc,
+				SortBy:         sortBy,
+				PageLimit:      limit,
+				PageOffset:     offset,
+			})
 		}
 	}
-
-	s = r.URL.Query().Get("sort")
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
 
 	chirps := make([]Chirp, len(dbChirps))
-
 	for i, dbChirp := range dbChirps {
-		chirps[i] = Chirp{
-			ID:        dbChirp.ID,
-			CreatedAt: dbChirp.CreatedAt,
-			UpdatedAt: dbChirp.UpdatedAt,
-			Body:      dbChirp.Body,
-			UserID:    dbChirp.UserID,
+		chirps[i] = chirpFromDB(dbChirp)
+	}
+
+	if err := cfg.attachCounts(ctx, chirps, viewer); err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	if includesAuthor(r) {
+		if err := cfg.attachAuthors(ctx, chirps); err != nil {
+			returnDBError(w, ctx, http.StatusInternalServerError, err)
+			return
 		}
 	}
 
-	// asc by default in db
-	if s == "desc" {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].CreatedAt.After(chirps[j].CreatedAt)
-		})
+	if wantsEnvelope(r) {
+		respondChirpsEnvelope(w, http.StatusOK, chirps, fields, pagination{Limit: limit, Offset: offset, Total: total})
+		return
 	}
+	respondChirps(w, http.StatusOK, chirps, fields)
+}
 
-	statusCode := 200
-	dat, _ := json.Marshal(chirps)
+// chirpSortColumns are the values ?sort_by accepts.
+var chirpSortColumns = map[string]bool{
+	"created_at": true,
+	"updated_at": true,
+}
 
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(dat)
+// sortDescending reads ?sort, asc or desc in any case. Without it chirps
+// come in the configured default order, ascending unless DEFAULT_CHIRP_SORT
+// says otherwise.
+func (cfg *apiConfig) sortDescending(r *http.Request) (bool, error) {
+	s := r.URL.Query().Get("sort")
+	if s == "" {
+		return cfg.defaultSortDesc, nil
+	}
+	return parseSortDirection(s)
+}
 
+// parseSortDirection reports whether s, "asc" or "desc" in any case, asks
+// for descending order.
+func parseSortDirection(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "asc":
+		return false, nil
+	case "desc":
+		return true, nil
+	}
+	return false, fmt.Errorf("sort must be asc or desc, not %q", s)
+}
+
+// maxAuthorIDs caps how many authors one GET /api/chirps may filter by.
+const maxAuthorIDs = 50
+
+// parseAuthorIDs collects ?author_id, which may be repeated or hold a
+// comma-separated list.
+func parseAuthorIDs(r *http.Request) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	for _, v := range r.URL.Query()["author_id"] {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			id, err := uuid.Parse(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid author_id %q", s)
+			}
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxAuthorIDs {
+		return nil, fmt.Errorf("at most %d author_id values are allowed", maxAuthorIDs)
+	}
+	return ids, nil
+}
+
+// likePattern builds a substring match for ILIKE, escaping the wildcard
+// characters so user input is matched literally.
+func likePattern(term string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return "%" + escaper.Replace(term) + "%"
 }
 
 type TokenResponse struct {
@@ -413,27 +1187,35 @@ func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, r *http.Request) {
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		returnError(w, http.StatusUnauthorized, err)
 		return
 	}
 
-	db_token, err := cfg.db.GetRefreshToken(r.Context(), token)
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	db_token, err := cfg.db.GetValidRefreshToken(ctx, token)
+	if errors.Is(err, sql.ErrNoRows) {
+		cfg.refreshTokenRejected(w, ctx, token)
+		return
+	}
 	if err != nil {
-		returnError(w, http.StatusUnauthorized, errors.New("Refresh token not found"))
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
 		return
 	}
 
+	// the query already filters these out; checked again in case the
+	// clocks of the app and database disagree
 	if db_token.ExpiresAt.Before(time.Now()) {
-		returnError(w, http.StatusUnauthorized, errors.New("Refresh token expired"))
+		returnErrorCode(w, http.StatusUnauthorized, codeRefreshTokenExpired, errors.New("Refresh token expired"))
 		return
 	}
-
-	if db_token.RevokedAt.Valid && db_token.RevokedAt.Time.Before(time.Now()) {
-		returnError(w, http.StatusUnauthorized, errors.New("Refresh token revoked"))
+	if db_token.RevokedAt.Valid {
+		returnErrorCode(w, http.StatusUnauthorized, codeRefreshTokenRevoked, errors.New("Refresh token revoked"))
 		return
 	}
 
-	jwt_token, err := auth.MakeJWT(db_token.UserID, cfg.secret, time.Duration(60)*time.Minute)
+	jwt_token, err := cfg.tokens().Make(db_token.UserID, time.Duration(60)*time.Minute)
 	if err != nil {
 		returnError(w, http.StatusInternalServerError, err)
 		return
@@ -441,30 +1223,60 @@ func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, r *http.Request) {
 
 	tokenResponse := TokenResponse{Token: jwt_token}
 
-	statusCode := 200
-	dat, _ := json.Marshal(tokenResponse)
-
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(dat)
+	respondJSON(w, http.StatusOK, tokenResponse)
+}
 
+// refreshTokenRejected looks up a token that isn't usable to tell the
+// client whether it was unknown, expired or revoked.
+func (cfg *apiConfig) refreshTokenRejected(w http.ResponseWriter, ctx context.Context, token string) {
+	db_token, err := cfg.db.GetRefreshToken(ctx, token)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		returnErrorCode(w, http.StatusUnauthorized, codeRefreshTokenNotFound, errors.New("Refresh token not found"))
+	case err != nil:
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+	case db_token.RevokedAt.Valid:
+		returnErrorCode(w, http.StatusUnauthorized, codeRefreshTokenRevoked, errors.New("Refresh token revoked"))
+	default:
+		returnErrorCode(w, http.StatusUnauthorized, codeRefreshTokenExpired, errors.New("Refresh token expired"))
+	}
 }
 
 func (cfg *apiConfig) revokeHandler(w http.ResponseWriter, r *http.Request) {
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		returnError(w, http.StatusUnauthorized, err)
 		return
 	}
 
-	err = cfg.db.RevokeRefreshToken(r.Context(), token)
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	err = cfg.db.RevokeRefreshToken(ctx, token)
 	if err != nil {
-		returnError(w, http.StatusUnauthorized, errors.New("refresh token not found"))
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeAllHandler logs the caller out everywhere by revoking every refresh
+// token they hold. Unlike revokeHandler it authenticates with the access
+// token, since the point is to kill refresh tokens the caller may not have.
+func (cfg *apiConfig) revokeAllHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	if err := cfg.db.RevokeAllUserRefreshTokens(ctx, userID); err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
 		return
 	}
 
-	w.WriteHeader(204)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (cfg *apiConfig) authHandler(w http.ResponseWriter, r *http.Request) {
@@ -473,59 +1285,142 @@ func (cfg *apiConfig) authHandler(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	decoder.Decode(&params)
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	uuid := requestUserID(r)
+
+	// only the email changes here; a password change has to prove the
+	// current one, which POST /api/users/password does
+	fe := fieldErrors{}
+	email, err := validateEmail(params.Email)
 	if err != nil {
-		returnError(w, http.StatusUnauthorized, err)
+		fe.add("email", "invalid format")
+	}
+	if params.Password != "" {
+		fe.add("password", "change it with POST /api/users/password")
+	}
+	if fe.any() {
+		returnValidationErrors(w, fe)
 		return
 	}
+	params.Email = email
 
-	uuid, err := auth.ValidateJWT(token, cfg.secret)
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	err = cfg.db.SetUserEmail(ctx, database.SetUserEmailParams{ID: uuid, Email: params.Email})
 	if err != nil {
-		returnError(w, http.StatusUnauthorized, err)
+		if isUniqueViolation(err) {
+			returnError(w, http.StatusConflict, errors.New("email already registered"))
+			return
+		}
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
 		return
 	}
 
-	hashedPassword, err := auth.HashPassword(params.Password)
+	dbUser, err := cfg.db.GetUserByID(ctx, uuid)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
 		return
 	}
+	user := userFromDB(dbUser)
+
+	respondJSON(w, http.StatusOK, user)
+}
 
-	err = cfg.db.SetUserEmailPassword(r.Context(), database.SetUserEmailPasswordParams{ID: uuid, Email: params.Email, HashedPassword: hashedPassword})
+// withTx runs fn against queries bound to a single transaction, committing
+// when fn succeeds and rolling back when it returns an error.
+func (cfg *apiConfig) withTx(ctx context.Context, fn func(q *database.Queries) error) error {
+	tx, err := cfg.conn.BeginTx(ctx, nil)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(cfg.db.WithTx(tx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// decodeJSON decodes the request body into v, refusing bodies over the
+// configured size limit. On failure it writes the error response and
+// returns false.
+func (cfg *apiConfig) decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, cfg.maxBodyBytes))
+	return cfg.checkDecode(w, decoder.Decode(v))
+}
+
+// decodeOptionalJSON is decodeJSON for endpoints whose body may be left out
+// entirely: an empty body leaves v untouched rather than being a 400.
+func (cfg *apiConfig) decodeOptionalJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, cfg.maxBodyBytes))
+	err := decoder.Decode(v)
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	return cfg.checkDecode(w, err)
+}
+
+// checkDecode reports a JSON decode error to the client, returning whether
+// decoding succeeded.
+func (cfg *apiConfig) checkDecode(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		returnError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", maxBytesErr.Limit))
+		return false
+	}
+	returnError(w, http.StatusBadRequest, errors.New("invalid JSON body"))
+	return false
+}
+
+// dbContext derives the context DB calls for r run under, bounded by the
+// configured DB timeout.
+func (cfg *apiConfig) dbContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if cfg.dbTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), cfg.dbTimeout)
+}
+
+func (cfg *apiConfig) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	// chirps and refresh tokens go with the user via ON DELETE CASCADE
+	result, err := cfg.db.DeleteUser(ctx, userID)
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
 		return
 	}
-	dbUser, err := cfg.db.GetUser(r.Context(), params.Email)
+	cfg.chirpCache.forgetAuthor(userID)
+
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		returnError(w, http.StatusBadRequest, err)
+		returnError(w, http.StatusInternalServerError, err)
 		return
 	}
-	user := User{
-		ID:          dbUser.ID,
-		CreatedAt:   dbUser.CreatedAt,
-		UpdatedAt:   dbUser.UpdatedAt,
-		Email:       dbUser.Email,
-		IsChirpyRed: dbUser.IsChirpyRed,
+	if rowsAffected == 0 {
+		returnError(w, http.StatusNotFound, errors.New("user not found"))
+		return
 	}
 
-	statusCode := 200
-	dat, _ := json.Marshal(user)
-
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(dat)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func returnError(w http.ResponseWriter, statusCode int, err error) {
-	dat := []byte(fmt.Sprintf("{error:\"%s\"}", err.Error()))
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(dat)
+// isUniqueViolation reports whether err is a postgres unique-constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
 }
 
 func (cfg *apiConfig) chirpyRedHandler(w http.ResponseWriter, r *http.Request) {
@@ -543,19 +1438,19 @@ func (cfg *apiConfig) chirpyRedHandler(w http.ResponseWriter, r *http.Request) {
 		returnError(w, http.StatusUnauthorized, err)
 		return
 	}
-	if reqKey != cfg.polkaKey {
+	if !auth.CompareAPIKey(reqKey, cfg.polkaKey) {
 		returnError(w, http.StatusUnauthorized, errors.New("invalid API key"))
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	decoder.Decode(&params)
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
 
 	if params.Event != "user.upgraded" {
-		w.WriteHeader(204)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte("{body:\"event != user.upgraded\"}"))
+		// not an event we act on; acknowledge it so Polka stops retrying
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
@@ -566,9 +1461,12 @@ func (cfg *apiConfig) chirpyRedHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	setChirpyParams := database.SetUserIsChirpyRedParams{ID: uuid, IsChirpyRed: true}
-	result, err := cfg.db.SetUserIsChirpyRed(r.Context(), setChirpyParams)
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	result, err := cfg.db.SetUserIsChirpyRed(ctx, setChirpyParams)
 	if err != nil {
-		returnError(w, http.StatusNotFound, err)
+		returnDBError(w, ctx, http.StatusNotFound, err)
 		return
 	}
 
@@ -583,42 +1481,242 @@ func (cfg *apiConfig) chirpyRedHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(204)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte("{body:\"user upgraded\"}"))
+	cfg.redNotifier.notify(chirpyRedEvent{UserID: uuid, IsChirpyRed: true})
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func main() {
-	serve_mux := http.NewServeMux()
-	godotenv.Load()
+// envDuration reads a time.ParseDuration value such as "5s" from the
+// environment, falling back to def when the variable is unset.
+func envDuration(key string, def time.Duration) time.Duration {
+	s := os.Getenv(key)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		panic(fmt.Sprintf("invalid %s: %v", key, err))
+	}
+	return d
+}
 
-	dbURL := os.Getenv("DB_URL")
-	db, err := sql.Open("postgres", dbURL)
+// envInt reads an integer from the environment, falling back to def when
+// the variable is unset.
+func envInt(key string, def int) int {
+	s := os.Getenv(key)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
 	if err != nil {
-		panic(err)
+		panic(fmt.Sprintf("invalid %s: %v", key, err))
 	}
-	dbQueries := database.New(db)
+	return n
+}
 
-	cfg := &apiConfig{db: dbQueries, platform: os.Getenv("PLATFORM"), secret: os.Getenv("SECRET"), polkaKey: os.Getenv("POLKA_KEY")}
+// routes registers every handler on a new mux.
+func (cfg *apiConfig) routes() *http.ServeMux {
+	serve_mux := http.NewServeMux()
 
-	fileServerHandler := http.StripPrefix("/app/", http.FileServer(http.Dir(".")))
-	serve_mux.Handle("/app/", cfg.middlewareMetricsInc(fileServerHandler))
+	fileServerHandler := http.StripPrefix("/app/", cfg.staticHandler())
+	serve_mux.Handle("/app/", cfg.middlewareMetricsInc(cfg.middlewareStaticCache(fileServerHandler)))
+	// the mux would redirect /app itself, but only temporarily
+	serve_mux.Handle("/app", redirectTo("/app/", http.StatusPermanentRedirect))
+	if cfg.redirectRoot {
+		// temporary, so browsers don't remember it if the setting is dropped
+		serve_mux.Handle("GET /{$}", redirectTo("/app/", http.StatusFound))
+	}
 	serve_mux.HandleFunc("GET /api/healthz", healthHandler)
+	serve_mux.HandleFunc("GET /api/openapi.json", openAPIHandler)
+	serve_mux.HandleFunc("GET /api/version", versionHandler)
+	serve_mux.HandleFunc("GET /metrics", cfg.prometheusHandler)
 	serve_mux.HandleFunc("GET /admin/metrics", cfg.metricsHandler)
+	serve_mux.HandleFunc("GET /admin/metrics/routes", cfg.routeMetricsHandler)
 	serve_mux.HandleFunc("POST /admin/reset", cfg.resetHandler)
-	serve_mux.HandleFunc("POST /api/users", cfg.addUserHandler)
-	serve_mux.HandleFunc("POST /api/login", cfg.loginHandler)
-	serve_mux.HandleFunc("PUT /api/users", cfg.authHandler)
-	serve_mux.HandleFunc("POST /api/chirps", cfg.addChirpHandler)
+	serve_mux.HandleFunc("POST /admin/seed", cfg.seedHandler)
+	serve_mux.HandleFunc("POST /admin/maintenance", requireJSON(cfg.maintenanceHandler))
+	serve_mux.HandleFunc("GET /admin/users", cfg.listUsersHandler)
+	serve_mux.HandleFunc("GET /admin/chirps/reported", cfg.reportedChirpsHandler)
+	serve_mux.HandleFunc("DELETE /admin/chirps/{chirpID}", cfg.adminDeleteChirpHandler)
+	serve_mux.HandleFunc("POST /api/users", requireJSON(cfg.addUserHandler))
+	serve_mux.HandleFunc("POST /api/login", requireJSON(cfg.loginHandler))
+	serve_mux.HandleFunc("PUT /api/users", cfg.requireAuth(requireJSON(cfg.authHandler)))
+	serve_mux.HandleFunc("POST /api/users/password", cfg.requireAuth(requireJSON(cfg.changePasswordHandler)))
+	serve_mux.HandleFunc("DELETE /api/users/me", cfg.requireAuth(cfg.deleteUserHandler))
+	serve_mux.HandleFunc("POST /api/users/me/2fa/enroll", cfg.requireAuth(cfg.enrollTOTPHandler))
+	serve_mux.HandleFunc("POST /api/users/me/2fa/confirm", cfg.requireAuth(requireJSON(cfg.confirmTOTPHandler)))
+	serve_mux.HandleFunc("GET /api/users/me/settings", cfg.requireAuth(cfg.getSettingsHandler))
+	serve_mux.HandleFunc("PUT /api/users/me/settings", cfg.requireAuth(requireJSON(cfg.putSettingsHandler)))
+	serve_mux.HandleFunc("GET /api/users/{userID}/profile", cfg.getUserProfileHandler)
+	serve_mux.HandleFunc("POST /api/chirps", cfg.requireAuth(requireJSON(cfg.addChirpHandler)))
+	serve_mux.HandleFunc("POST /api/chirps/batch", cfg.requireAuth(requireJSON(cfg.addChirpsBatchHandler)))
+	serve_mux.HandleFunc("POST /api/chirps/validate", requireJSON(cfg.validateChirpHandler))
 	serve_mux.HandleFunc("GET /api/chirps", cfg.getChirpsHandler)
+	serve_mux.HandleFunc("GET /api/chirps/stats", cfg.chirpStatsHandler)
+	serve_mux.HandleFunc("GET /api/chirps/stream", cfg.chirpStreamHandler)
+	serve_mux.HandleFunc("GET /api/chirps/export", cfg.requireAuth(cfg.exportChirpsHandler))
 	serve_mux.HandleFunc("GET /api/chirps/{chirpID}", cfg.getChirpHandler)
-	serve_mux.HandleFunc("DELETE /api/chirps/{chirpID}", cfg.deleteChirpHandler)
+	serve_mux.HandleFunc("DELETE /api/chirps/{chirpID}", cfg.requireAuth(cfg.deleteChirpHandler))
+	serve_mux.HandleFunc("PATCH /api/chirps/{chirpID}", cfg.requireAuth(requireJSON(cfg.editChirpHandler)))
+	serve_mux.HandleFunc("DELETE /api/chirps", cfg.requireAuth(cfg.deleteAuthorChirpsHandler))
+	serve_mux.HandleFunc("POST /api/chirps/{chirpID}/report", cfg.requireAuth(cfg.reportChirpHandler))
+	serve_mux.HandleFunc("POST /api/chirps/{chirpID}/like", cfg.requireAuth(cfg.likeChirpHandler))
+	serve_mux.HandleFunc("DELETE /api/chirps/{chirpID}/like", cfg.requireAuth(cfg.unlikeChirpHandler))
+	serve_mux.HandleFunc("GET /api/chirps/{chirpID}/replies", cfg.getChirpRepliesHandler)
+	serve_mux.HandleFunc("GET /api/chirps/{chirpID}/history", cfg.requireAuth(cfg.getChirpHistoryHandler))
 	serve_mux.HandleFunc("POST /api/refresh", cfg.refreshHandler)
 	serve_mux.HandleFunc("POST /api/revoke", cfg.revokeHandler)
+	serve_mux.HandleFunc("POST /api/revoke-all", cfg.requireAuth(cfg.revokeAllHandler))
 	serve_mux.HandleFunc("POST /api/polka/webhooks", cfg.chirpyRedHandler)
 
-	server := http.Server{Handler: serve_mux, Addr: ":8080"}
+	return serve_mux
+}
+
+// handler wraps the routes in the middleware every request passes through.
+func (cfg *apiConfig) handler() http.Handler {
+	return cfg.middlewareRequestID(cfg.middlewareHTTPMetrics(cfg.middlewareCORS(cfg.middlewareMaintenance(cfg.middlewareRouteCounts(cfg.middlewareGzip(middlewareMethodNotAllowed(cfg.routes())))))))
+}
+
+func main() {
+	godotenv.Load()
+
+	env, err := loadConfig(os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	db, err := sql.Open("postgres", env.dbURL)
+	if err != nil {
+		panic(err)
+	}
+	// opt-in so deployments that manage the schema externally aren't
+	// surprised by DDL at startup
+	if os.Getenv("RUN_MIGRATIONS") == "true" {
+		ctx, cancel := context.WithTimeout(context.Background(), envDuration("MIGRATION_TIMEOUT", 5*time.Minute))
+		err := runMigrations(ctx, db)
+		cancel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	dbQueries := database.New(db)
+
+	// chirp listings can be served from a replica; everything else,
+	// including reads that must see the caller's own writes, uses db
+	var readConn database.DBTX = db
+	if env.replicaURL != "" {
+		replica, err := sql.Open("postgres", env.replicaURL)
+		if err != nil {
+			panic(err)
+		}
+		readConn = replica
+	}
+	// reads are safe to repeat, so they ride out a failover
+	readQueries := database.New(retryingDB{DBTX: readConn, policy: retryPolicy{
+		attempts:  envInt("DB_RETRY_ATTEMPTS", 3),
+		baseDelay: envDuration("DB_RETRY_BASE_DELAY", 50*time.Millisecond),
+		maxDelay:  envDuration("DB_RETRY_MAX_DELAY", time.Second),
+	}})
+
+	cfg := &apiConfig{db: dbQueries, readDB: readQueries, conn: db, platform: env.platform, secret: env.secret, polkaKey: env.polkaKey, adminKey: os.Getenv("ADMIN_KEY"), badWords: moderation.DefaultWordLists()}
+	cfg.dbTimeout = envDuration("DB_TIMEOUT", 5*time.Second)
+	cfg.maxBodyBytes = int64(envInt("MAX_BODY_BYTES", 1<<20))
+	cfg.maxChirpBatch = envInt("MAX_CHIRP_BATCH", 100)
+	cfg.maxChirpLength = envInt("MAX_CHIRP_LENGTH", defaultMaxChirpLength)
+	cfg.maxSettingsBytes = envInt("MAX_SETTINGS_BYTES", defaultMaxSettingsBytes)
+	cfg.chirpQuota = chirpQuota{limit: envInt("CHIRP_RATE_LIMIT", 30), window: envDuration("CHIRP_RATE_WINDOW", 10*time.Minute)}
+	cfg.loginLockout = loginLockout{threshold: envInt("LOGIN_LOCKOUT_THRESHOLD", 5), cooldown: envDuration("LOGIN_LOCKOUT_COOLDOWN", 15*time.Minute)}
+	cfg.idempotencyKeyTTL = envDuration("IDEMPOTENCY_KEY_TTL", defaultIdempotencyKeyTTL)
+	cfg.chirpHub = newChirpHub(envInt("MAX_STREAM_CONNECTIONS", 100))
+	cfg.chirpCache = newChirpCache(envInt("CHIRP_CACHE_SIZE", defaultChirpCacheSize), envDuration("CHIRP_CACHE_TTL", defaultChirpCacheTTL))
+	cfg.secondarySecrets = env.secondarySecrets
+	cfg.tokenType = env.tokenType
+	if env.totpKey != "" {
+		if cfg.totpBox, err = auth.NewSecretBox(env.totpKey); err != nil {
+			panic(err)
+		}
+	}
+	proxies, err := newProxyTrust(os.Getenv("TRUST_PROXY") == "true", os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		panic(fmt.Sprintf("invalid TRUSTED_PROXIES: %v", err))
+	}
+	cfg.proxies = proxies
+	if s := os.Getenv("DEFAULT_CHIRP_SORT"); s != "" {
+		cfg.defaultSortDesc, err = parseSortDirection(s)
+		if err != nil {
+			panic(fmt.Sprintf("invalid DEFAULT_CHIRP_SORT: %v", err))
+		}
+	}
+	cfg.jwtIssuer = os.Getenv("JWT_ISSUER")
+	cfg.jwtAudience = os.Getenv("JWT_AUDIENCE")
+	cfg.tokenLeeway = envDuration("JWT_LEEWAY", defaultTokenLeeway)
+	cfg.maintenanceRetry = envDuration("MAINTENANCE_RETRY_AFTER", defaultMaintenanceRetryAfter)
+	cfg.maxTokenLifetime = envDuration("MAX_TOKEN_LIFETIME", 24*time.Hour)
+	cfg.tokenCleanup = refreshTokenCleanup{interval: envDuration("REFRESH_TOKEN_CLEANUP_INTERVAL", time.Hour), revokedRetention: envDuration("REVOKED_TOKEN_RETENTION", 7*24*time.Hour)}
+	cfg.tokenRenewWindow = envDuration("ACCESS_TOKEN_RENEW_WINDOW", 10*time.Minute)
+	cfg.maxSessionAge = envDuration("MAX_SESSION_AGE", defaultMaxSessionAge)
+	if sinkURL := os.Getenv("CHIRPY_RED_SINK_URL"); sinkURL != "" {
+		cfg.redNotifier = newChirpyRedNotifier(sinkURL, envDuration("CHIRPY_RED_SINK_TIMEOUT", 5*time.Second), 100)
+	}
+	cfg.cors = newCORSPolicy(os.Getenv("CORS_ALLOWED_ORIGINS"), os.Getenv("CORS_ALLOWED_METHODS"), os.Getenv("CORS_ALLOWED_HEADERS"))
+	cfg.staticDir = os.Getenv("STATIC_DIR")
+	if cfg.staticDir == "" {
+		cfg.staticDir = "public"
+	}
+	switch source := os.Getenv("STATIC_SOURCE"); source {
+	case "", "disk":
+	case "embed":
+		cfg.staticEmbedded = true
+	default:
+		panic(fmt.Sprintf("invalid STATIC_SOURCE %q: must be disk or embed", source))
+	}
+	cfg.staticMaxAge = envDuration("STATIC_CACHE_MAX_AGE", time.Hour)
+	cfg.staticSPA = os.Getenv("STATIC_SPA_FALLBACK") == "true"
+	cfg.redirectRoot = os.Getenv("REDIRECT_ROOT_TO_APP") == "true"
+	if dir := os.Getenv("BAD_WORDS_DIR"); dir != "" {
+		cfg.badWords, err = moderation.LoadWordLists(dir)
+		if err != nil {
+			panic(fmt.Sprintf("invalid BAD_WORDS_DIR: %v", err))
+		}
+	}
+	cfg.gzipMinSize = envInt("GZIP_MIN_SIZE", defaultGzipMinSize)
+
+	server := http.Server{
+		Handler:           cfg.handler(),
+		Addr:              ":8080",
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      envDuration("WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 60*time.Second),
+	}
+
+	// SIGINT/SIGTERM stop background jobs and let in-flight requests finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go cfg.runRefreshTokenCleanup(ctx)
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 10*time.Second))
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
 
 	// fmt.Println("Starting server on :8080")
-	server.ListenAndServe()
+	if env.useTLS() {
+		err = server.ListenAndServeTLS(env.tlsCertFile, env.tlsKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
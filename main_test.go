@@ -0,0 +1,5326 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/jsleep/learngo_httpserver/internal/auth"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+	"github.com/jsleep/learngo_httpserver/internal/moderation"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testSecret = "test-secret"
+
+func newTestConfig(t *testing.T) (*apiConfig, *fakeDB) {
+	t.Helper()
+	f, conn := newFakeDB(t)
+	queries := database.New(conn)
+	cfg := &apiConfig{db: queries, readDB: queries, conn: conn, platform: "dev", secret: testSecret, polkaKey: "polka", badWords: moderation.DefaultWordLists(), maxBodyBytes: 1 << 20, maxChirpBatch: 100, maxChirpLength: defaultMaxChirpLength, maxSettingsBytes: defaultMaxSettingsBytes, maxTokenLifetime: 24 * time.Hour}
+	totpBox, err := auth.NewSecretBox(testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.totpBox = totpBox
+	// no likes, replies or two-factor setup unless a test scripts some
+	f.on("GetChirpLikes", func(args []driver.Value) fakeResult { return fakeResult{} })
+	f.on("GetReplyCounts", func(args []driver.Value) fakeResult { return fakeResult{} })
+	f.on("GetTOTP", func(args []driver.Value) fakeResult { return fakeResult{} })
+	return cfg, f
+}
+
+func chirpRow(c database.Chirp) []driver.Value {
+	return row(c.ID, c.CreatedAt, c.UpdatedAt, c.UserID, c.Body, c.DeletedAt, c.ParentID, c.ImageUrl)
+}
+
+// countRows answers a COUNT(*) query with n.
+func countRows(n int) fakeHandler {
+	return func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(int64(n))}}
+	}
+}
+
+// listedChirps answers a chirp listing with chirps ordered and paged by the
+// query's trailing sort_desc, sort_by, page_limit and page_offset arguments,
+// as the ORDER BY and LIMIT in chirps.sql do.
+func listedChirps(chirps []database.Chirp) fakeHandler {
+	return func(args []driver.Value) fakeResult {
+		page := args[len(args)-4:]
+		desc, sortBy := page[0].(bool), page[1].(string)
+		limit, offset := int(page[2].(int32)), int(page[3].(int32))
+		key := func(c database.Chirp) time.Time { return c.CreatedAt }
+		if sortBy == "updated_at" {
+			key = func(c database.Chirp) time.Time { return c.UpdatedAt }
+		}
+		sorted := append([]database.Chirp(nil), chirps...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if desc {
+				return key(sorted[i]).After(key(sorted[j]))
+			}
+			return key(sorted[i]).Before(key(sorted[j]))
+		})
+		var rows [][]driver.Value
+		for i := offset; i < offset+limit && i < len(sorted); i++ {
+			rows = append(rows, chirpRow(sorted[i]))
+		}
+		return fakeResult{rows: rows}
+	}
+}
+
+func userRow(u database.User) []driver.Value {
+	return row(u.ID, u.CreatedAt, u.UpdatedAt, u.Email, u.HashedPassword, u.IsChirpyRed, u.LastLoginAt, []byte(u.Settings))
+}
+
+// validRefreshTokens applies GetValidRefreshToken's WHERE clause to the rows
+// h returns, so tests can script GetRefreshToken and get both queries.
+func validRefreshTokens(h fakeHandler) fakeHandler {
+	return func(args []driver.Value) fakeResult {
+		res := h(args)
+		var rows [][]driver.Value
+		for _, r := range res.rows {
+			if r[4].(time.Time).After(time.Now()) && r[5] == nil {
+				rows = append(rows, r)
+			}
+		}
+		res.rows = rows
+		return res
+	}
+}
+
+func bearer(t *testing.T, userID uuid.UUID) string {
+	t.Helper()
+	token, err := auth.MakeJWT(userID, testSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func newJSONRequest(method, target, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestAddChirpSetsLocation(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	chirpID := uuid.New()
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		now := time.Now()
+		return fakeResult{rows: [][]driver.Value{chirpRow(database.Chirp{ID: chirpID, CreatedAt: now, UpdatedAt: now, UserID: userID, Body: args[0].(string)})}}
+	})
+
+	req := newJSONRequest("POST", "/api/chirps", `{"body":"hello world"}`)
+	req.Header.Set("Authorization", bearer(t, userID))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.addChirpHandler)(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("Location"), "/api/chirps/"+chirpID.String(); got != want {
+		t.Fatalf("expected Location %q, got %q", want, got)
+	}
+}
+
+func TestValidateChirpBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"ascii at limit", strings.Repeat("a", 140), strings.Repeat("a", 140), false},
+		{"ascii over limit", strings.Repeat("a", 141), "", true},
+		{"emoji at limit", strings.Repeat("🐦", 140), strings.Repeat("🐦", 140), false},
+		{"emoji over limit", strings.Repeat("🐦", 141), "", true},
+		{"accented at limit", strings.Repeat("é", 140), strings.Repeat("é", 140), false},
+		{"whitespace not counted", "  " + strings.Repeat("a", 140) + "\n\t", strings.Repeat("a", 140), false},
+		{"all whitespace", " \t\n ", "", true},
+		{"empty", "", "", true},
+	}
+	cfg, _ := newTestConfig(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cfg.validateChirpBody(tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateChirpBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("validateChirpBody() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChirpImageURL(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		imageURL := sql.NullString{}
+		if args[3] != nil {
+			imageURL = sql.NullString{String: args[3].(string), Valid: true}
+		}
+		now := time.Now()
+		return fakeResult{rows: [][]driver.Value{chirpRow(database.Chirp{ID: uuid.New(), CreatedAt: now, UpdatedAt: now, UserID: userID, Body: args[0].(string), ImageUrl: imageURL})}}
+	})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		f.calls = nil
+		req := newJSONRequest("POST", "/api/chirps", body)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.addChirpHandler)(w, req)
+		return w
+	}
+
+	w := post(`{"body":"look at this","image_url":"https://img.example.com/cat.png?size=large"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["image_url"] != "https://img.example.com/cat.png?size=large" {
+		t.Fatalf("expected the image URL back, got %v", got["image_url"])
+	}
+
+	w = post(`{"body":"no picture"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	got = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["image_url"]; ok {
+		t.Fatalf("expected image_url to be omitted, got %v", got["image_url"])
+	}
+
+	for _, imageURL := range []string{
+		"javascript:alert(1)",
+		"ftp://example.com/cat.png",
+		"data:image/png;base64,AAAA",
+		"/relative/cat.png",
+		"https://",
+		"https://example.com/" + strings.Repeat("a", maxImageURLLength),
+	} {
+		w := post(`{"body":"bad picture","image_url":"` + imageURL + `"}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%.40s: expected 400, got %d", imageURL, w.Code)
+		}
+		if f.called("CreateChirp") != 0 {
+			t.Errorf("%.40s: expected nothing stored", imageURL)
+		}
+	}
+}
+
+func TestMaxChirpLengthConfigurable(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{chirpRow(database.Chirp{ID: uuid.New(), UserID: userID, Body: args[0].(string)})}}
+	})
+
+	post := func(body string) int {
+		req := newJSONRequest("POST", "/api/chirps", `{"body":"`+body+`"}`)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.addChirpHandler)(w, req)
+		return w.Code
+	}
+
+	cfg.maxChirpLength = 280
+	if code := post(strings.Repeat("a", 280)); code != http.StatusCreated {
+		t.Fatalf("at the limit: expected 201, got %d", code)
+	}
+	if code := post(strings.Repeat("a", 281)); code != http.StatusBadRequest {
+		t.Fatalf("over the limit: expected 400, got %d", code)
+	}
+
+	cfg.maxChirpLength = 0
+	if code := post(strings.Repeat("a", 5000)); code != http.StatusCreated {
+		t.Fatalf("unlimited: expected 201, got %d", code)
+	}
+}
+
+func TestAddChirpStoresTrimmedBody(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	var stored string
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		stored = args[0].(string)
+		now := time.Now()
+		return fakeResult{rows: [][]driver.Value{chirpRow(database.Chirp{ID: uuid.New(), CreatedAt: now, UpdatedAt: now, UserID: userID, Body: stored})}}
+	})
+
+	req := newJSONRequest("POST", "/api/chirps", `{"body":"  héllo 🐦  "}`)
+	req.Header.Set("Authorization", bearer(t, userID))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.addChirpHandler)(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if stored != "héllo 🐦" {
+		t.Fatalf("expected trimmed body, got %q", stored)
+	}
+}
+
+func TestAddChirpRejectsBlankBody(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+
+	req := newJSONRequest("POST", "/api/chirps", `{"body":"   "}`)
+	req.Header.Set("Authorization", bearer(t, userID))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.addChirpHandler)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+	if n := f.called("CreateChirp"); n != 0 {
+		t.Fatalf("expected no insert, got %d", n)
+	}
+}
+
+func TestValidateChirp(t *testing.T) {
+	cfg, f := newTestConfig(t)
+
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		code    errorCode
+		cleaned string
+	}{
+		{"valid", `{"body":"  héllo 🐦  "}`, http.StatusOK, "", "héllo 🐦"},
+		{"profane", `{"body":"what a Kerfuffle this is"}`, http.StatusOK, "", "what a **** this is"},
+		{"too long", `{"body":"` + strings.Repeat("é", defaultMaxChirpLength+1) + `"}`, http.StatusBadRequest, codeChirpTooLong, ""},
+		{"empty", `{"body":"  "}`, http.StatusBadRequest, codeChirpEmpty, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cfg.routes().ServeHTTP(w, newJSONRequest("POST", "/api/chirps/validate", tt.body))
+			if w.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				var body errorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Error.Code != tt.code {
+					t.Fatalf("expected code %q, got %q", tt.code, body.Error.Code)
+				}
+				return
+			}
+			var got struct {
+				Valid       bool   `json:"valid"`
+				CleanedBody string `json:"cleaned_body"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !got.Valid || got.CleanedBody != tt.cleaned {
+				t.Fatalf("expected valid %q, got %+v", tt.cleaned, got)
+			}
+		})
+	}
+	if len(f.calls) != 0 {
+		t.Fatalf("validating shouldn't touch the database, ran %v", f.calls)
+	}
+}
+
+func TestChirpBadWordsByLanguage(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.badWords = moderation.WordLists{
+		"en": moderation.DefaultBadWords(),
+		"de": {"quatsch": true},
+	}
+	userID := uuid.New()
+	var stored string
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		stored = args[0].(string)
+		return fakeResult{rows: [][]driver.Value{chirpRow(database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: userID, Body: stored})}}
+	})
+
+	cases := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "**** quatsch"},
+		{"de-DE,de;q=0.9", "kerfuffle ****"},
+		{"fr, de;q=0.5", "kerfuffle ****"},
+		{"fr", "**** quatsch"},
+	}
+	for _, c := range cases {
+		req := newJSONRequest("POST", "/api/chirps", `{"body":"kerfuffle quatsch"}`)
+		req.Header.Set("Authorization", bearer(t, userID))
+		req.Header.Set("Accept-Language", c.acceptLanguage)
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.addChirpHandler)(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%q: expected 201, got %d: %s", c.acceptLanguage, w.Code, w.Body)
+		}
+		if stored != c.want {
+			t.Errorf("Accept-Language %q: expected %q, got %q", c.acceptLanguage, c.want, stored)
+		}
+	}
+}
+
+func TestListUsersIncludesLastLogin(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.adminKey = "admin-key"
+	loggedIn := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	f.on("GetUsers", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			userRow(database.User{ID: uuid.New(), Email: "a@example.com", HashedPassword: "hash", LastLoginAt: sql.NullTime{Time: loggedIn, Valid: true}}),
+			userRow(database.User{ID: uuid.New(), Email: "b@example.com", HashedPassword: "hash"}),
+		}}
+	})
+
+	req := httptest.NewRequest("GET", "/admin/users", nil)
+	req.Header.Set("Authorization", "ApiKey admin-key")
+	w := httptest.NewRecorder()
+	cfg.listUsersHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var users []User
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].LastLoginAt == nil || !users[0].LastLoginAt.Equal(loggedIn) || users[1].LastLoginAt != nil {
+		t.Fatalf("expected last_login_at for the user who logged in only, got %+v", users)
+	}
+	if strings.Contains(w.Body.String(), "hash") {
+		t.Fatal("password hashes must not be listed")
+	}
+}
+
+func TestAddUserSetsLocation(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	f.on("CreateUser", func(args []driver.Value) fakeResult {
+		now := time.Now()
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, CreatedAt: now, UpdatedAt: now, Email: args[0].(string), HashedPassword: args[1].(string)})}}
+	})
+
+	w := httptest.NewRecorder()
+	cfg.addUserHandler(w, newJSONRequest("POST", "/api/users", `{"email":"a@example.com","password":"hunter2"}`))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("Location"), "/api/users/"+userID.String()+"/profile"; got != want {
+		t.Fatalf("expected Location %q, got %q", want, got)
+	}
+}
+
+func TestTokenFieldsOnlyWhenIssued(t *testing.T) {
+	hash, err := auth.HashPassword("correct-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	f.on("CreateUser", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, Email: args[0].(string), HashedPassword: args[1].(string)})}}
+	})
+	f.on("GetUser", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, Email: "a@example.com", HashedPassword: hash})}}
+	})
+	f.on("SetUserLastLogin", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, Email: "a@example.com", HashedPassword: hash})}}
+	})
+	f.on("CreateRefreshToken", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(args[0], time.Now(), time.Now(), userID, args[2], nil)}}
+	})
+
+	fields := func(w *httptest.ResponseRecorder) map[string]any {
+		t.Helper()
+		var got map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	w := httptest.NewRecorder()
+	cfg.addUserHandler(w, newJSONRequest("POST", "/api/users", `{"email":"a@example.com","password":"correct-password"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signup: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	signup := fields(w)
+	if _, ok := signup["token"]; ok {
+		t.Fatalf("signup must not include a token: %v", signup)
+	}
+	if _, ok := signup["refresh_token"]; ok {
+		t.Fatalf("signup must not include a refresh token: %v", signup)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.loginHandler(w, newJSONRequest("POST", "/api/login", `{"email":"a@example.com","password":"correct-password"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	login := fields(w)
+	if token, _ := login["token"].(string); token == "" {
+		t.Fatalf("login must include a token: %v", login)
+	}
+	if token, _ := login["refresh_token"].(string); token == "" {
+		t.Fatalf("login must include a refresh token: %v", login)
+	}
+}
+
+func TestSlowQueryTimesOut(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.dbTimeout = 10 * time.Millisecond
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		time.Sleep(50 * time.Millisecond)
+		return fakeResult{}
+	})
+
+	req := httptest.NewRequest("GET", "/api/chirps/x", nil)
+	req.SetPathValue("chirpID", uuid.NewString())
+	w := httptest.NewRecorder()
+	cfg.getChirpHandler(w, req)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestQueryErrorIsInternal(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.dbTimeout = time.Second
+	f.on("CountChirps", countRows(0))
+	f.on("GetChirps", func(args []driver.Value) fakeResult {
+		return fakeResult{err: errors.New("connection refused")}
+	})
+
+	w := httptest.NewRecorder()
+	cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestOversizedBodyRejected(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.maxBodyBytes = 64
+
+	body := `{"body":"` + strings.Repeat("a", 1000) + `"}`
+	req := newJSONRequest("POST", "/api/chirps", body)
+	req.Header.Set("Authorization", bearer(t, uuid.New()))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.addChirpHandler)(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPasswordChangeRevokesRefreshTokens(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	hash, err := auth.HashPassword("current-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const refreshToken = "refresh-token"
+	revokedAt := sql.NullTime{}
+
+	getToken := func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(refreshToken, time.Now(), time.Now(), userID, time.Now().Add(time.Hour), revokedAt)}}
+	}
+	f.on("GetRefreshToken", getToken)
+	f.on("GetValidRefreshToken", validRefreshTokens(getToken))
+	f.on("SetUserPassword", func(args []driver.Value) fakeResult { return fakeResult{} })
+	f.on("RevokeAllUserRefreshTokens", func(args []driver.Value) fakeResult {
+		if args[0] == userID.String() {
+			revokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+		return fakeResult{}
+	})
+	f.on("GetUserByID", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, Email: "a@example.com", HashedPassword: hash})}}
+	})
+
+	refresh := func() int {
+		req := httptest.NewRequest("POST", "/api/refresh", nil)
+		req.Header.Set("Authorization", "Bearer "+refreshToken)
+		w := httptest.NewRecorder()
+		cfg.refreshHandler(w, req)
+		return w.Code
+	}
+
+	if code := refresh(); code != http.StatusOK {
+		t.Fatalf("expected refresh to succeed before password change, got %d", code)
+	}
+
+	req := newJSONRequest("POST", "/api/users/password", `{"current_password":"current-password","new_password":"brand-new-password"}`)
+	req.Header.Set("Authorization", bearer(t, userID))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.changePasswordHandler)(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	if code := refresh(); code != http.StatusUnauthorized {
+		t.Fatalf("expected refresh to fail after password change, got %d", code)
+	}
+}
+
+func TestRefreshErrorCodes(t *testing.T) {
+	userID := uuid.New()
+	cases := []struct {
+		name      string
+		result    fakeResult
+		wantCode  int
+		wantError string
+	}{
+		{"not found", fakeResult{}, http.StatusUnauthorized, "refresh_token_not_found"},
+		{"expired", fakeResult{rows: [][]driver.Value{row("t", nil, nil, userID, time.Now().Add(-time.Hour), nil)}}, http.StatusUnauthorized, "refresh_token_expired"},
+		{"revoked", fakeResult{rows: [][]driver.Value{row("t", nil, nil, userID, time.Now().Add(time.Hour), time.Now().Add(time.Hour))}}, http.StatusUnauthorized, "refresh_token_revoked"},
+		{"valid", fakeResult{rows: [][]driver.Value{row("t", nil, nil, userID, time.Now().Add(time.Hour), nil)}}, http.StatusOK, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, f := newTestConfig(t)
+			getToken := func(args []driver.Value) fakeResult { return c.result }
+			f.on("GetRefreshToken", getToken)
+			f.on("GetValidRefreshToken", validRefreshTokens(getToken))
+
+			req := httptest.NewRequest("POST", "/api/refresh", nil)
+			req.Header.Set("Authorization", "Bearer t")
+			w := httptest.NewRecorder()
+			cfg.refreshHandler(w, req)
+
+			if w.Code != c.wantCode {
+				t.Fatalf("expected %d, got %d: %s", c.wantCode, w.Code, w.Body)
+			}
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if string(body.Error.Code) != c.wantError {
+				t.Fatalf("expected code %q, got %q", c.wantError, body.Error.Code)
+			}
+			if c.wantCode == http.StatusOK && f.called("GetRefreshToken") != 0 {
+				t.Fatal("expected a usable token to need only GetValidRefreshToken")
+			}
+		})
+	}
+}
+
+func TestUserFromDB(t *testing.T) {
+	now := time.Now()
+	dbUser := database.User{
+		ID:             uuid.New(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Email:          "a@example.com",
+		HashedPassword: "hash",
+		IsChirpyRed:    true,
+		LastLoginAt:    sql.NullTime{Time: now, Valid: true},
+	}
+
+	user := userFromDB(dbUser)
+	if user.ID != dbUser.ID || user.Email != dbUser.Email || !user.IsChirpyRed || !user.CreatedAt.Equal(now) || !user.UpdatedAt.Equal(now) {
+		t.Fatalf("fields not copied: %+v", user)
+	}
+	if user.LastLoginAt == nil || !user.LastLoginAt.Equal(now) {
+		t.Fatalf("expected last_login_at %v, got %v", now, user.LastLoginAt)
+	}
+	if user.Token != "" || user.RefreshToken != "" {
+		t.Fatalf("expected no tokens, got %+v", user)
+	}
+
+	if got := userFromDB(database.User{}).LastLoginAt; got != nil {
+		t.Fatalf("expected nil last_login_at for NULL, got %v", got)
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"user@example.com", "user@example.com", false},
+		{"User@Example.COM", "user@example.com", false},
+		{"  user@example.com ", "user@example.com", false},
+		{"not-an-email", "", true},
+		{"", "", true},
+		{"Alice <alice@example.com>", "", true},
+	}
+
+	for _, c := range cases {
+		got, err := validateEmail(c.in)
+		if (err != nil) != c.wantErr {
+			t.Fatalf("validateEmail(%q): unexpected error %v", c.in, err)
+		}
+		if got != c.want {
+			t.Fatalf("validateEmail(%q): expected %q, got %q", c.in, c.want, got)
+		}
+	}
+}
+
+func TestAddUserRejectsInvalidEmail(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+
+	w := httptest.NewRecorder()
+	cfg.addUserHandler(w, newJSONRequest("POST", "/api/users", `{"email":"not-an-email","password":"hunter2"}`))
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestValidationErrorsNameFields(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+
+	// the update handler refuses any password, so send one that is invalid
+	// for both
+	body := `{"email":"not-an-email","password":"` + strings.Repeat("x", maxPasswordBytes+1) + `"}`
+	cases := map[string]struct {
+		handle   http.HandlerFunc
+		password string
+	}{
+		"create": {cfg.addUserHandler, "too long"},
+		"update": {cfg.requireAuth(cfg.authHandler), "change it with POST /api/users/password"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := newJSONRequest("POST", "/api/users", body)
+			req.Header.Set("Authorization", bearer(t, uuid.New()))
+			w := httptest.NewRecorder()
+			c.handle(w, req)
+
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("expected 422, got %d: %s", w.Code, w.Body)
+			}
+			var resp errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error.Code != codeValidationFailed {
+				t.Fatalf("expected code %q, got %q", codeValidationFailed, resp.Error.Code)
+			}
+			if resp.Error.Fields["email"] != "invalid format" || resp.Error.Fields["password"] != c.password {
+				t.Fatalf("unexpected field errors: %v", resp.Error.Fields)
+			}
+		})
+	}
+}
+
+func TestAddUserStoresLowercaseEmail(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	var stored string
+	f.on("CreateUser", func(args []driver.Value) fakeResult {
+		stored = args[0].(string)
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: uuid.New(), Email: stored})}}
+	})
+
+	w := httptest.NewRecorder()
+	cfg.addUserHandler(w, newJSONRequest("POST", "/api/users", `{"email":"User@X.com","password":"hunter2"}`))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if stored != "user@x.com" {
+		t.Fatalf("expected email stored as %q, got %q", "user@x.com", stored)
+	}
+}
+
+func TestFailedPasswordChangeRollsBack(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	hash, err := auth.HashPassword("current-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.on("GetUserByID", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, Email: "a@example.com", HashedPassword: hash})}}
+	})
+	f.on("SetUserPassword", func(args []driver.Value) fakeResult { return fakeResult{} })
+	f.on("RevokeAllUserRefreshTokens", func(args []driver.Value) fakeResult {
+		return fakeResult{err: errors.New("connection reset")}
+	})
+
+	req := newJSONRequest("POST", "/api/users/password", `{"current_password":"current-password","new_password":"brand-new-password"}`)
+	req.Header.Set("Authorization", bearer(t, userID))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.changePasswordHandler)(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", w.Code, w.Body)
+	}
+	if f.called("BEGIN") != 1 || f.called("ROLLBACK") != 1 || f.called("COMMIT") != 0 {
+		t.Fatalf("expected the transaction to be rolled back, got calls %v", f.calls)
+	}
+}
+
+func TestLoginFailureIsGeneric(t *testing.T) {
+	hash, err := auth.HashPassword("correct-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		body string
+	}{
+		{"wrong password", `{"email":"known@example.com","password":"wrong-password"}`},
+		{"unknown email", `{"email":"unknown@example.com","password":"correct-password"}`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, f := newTestConfig(t)
+			f.on("GetUser", func(args []driver.Value) fakeResult {
+				if args[0] != "known@example.com" {
+					return fakeResult{}
+				}
+				return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: uuid.New(), Email: "known@example.com", HashedPassword: hash})}}
+			})
+
+			w := httptest.NewRecorder()
+			cfg.loginHandler(w, newJSONRequest("POST", "/api/login", c.body))
+
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Fatalf("expected application/json, got %q", got)
+			}
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("error body is not valid JSON: %v", err)
+			}
+			if body.Error.Message != "invalid email or password" {
+				t.Fatalf("unexpected error message %q", body.Error.Message)
+			}
+		})
+	}
+}
+
+func TestChirpStatsSkipDeletedChirps(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	mux := cfg.routes()
+	alice, bob := uuid.New(), uuid.New()
+	now := time.Now().UTC().Truncate(time.Second)
+	chirps := []database.Chirp{
+		{ID: uuid.New(), CreatedAt: now.Add(-3 * time.Hour), UserID: alice, Body: "first"},
+		{ID: uuid.New(), CreatedAt: now.Add(-2 * time.Hour), UserID: alice, Body: "second"},
+		{ID: uuid.New(), CreatedAt: now.Add(-time.Hour), UserID: bob, Body: "third"},
+	}
+	// live applies the deleted_at IS NULL the stats queries filter on
+	live := func() []database.Chirp {
+		var out []database.Chirp
+		for _, c := range chirps {
+			if !c.DeletedAt.Valid {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	f.on("DeleteChirpForUser", func(args []driver.Value) fakeResult {
+		for i, c := range chirps {
+			if c.ID.String() == args[0] && c.UserID.String() == args[1] && !c.DeletedAt.Valid {
+				chirps[i].DeletedAt = sql.NullTime{Time: time.Now(), Valid: true}
+				return fakeResult{rowsAffected: 1}
+			}
+		}
+		return fakeResult{}
+	})
+	f.on("GetChirpStats", func(args []driver.Value) fakeResult {
+		cs := live()
+		return fakeResult{rows: [][]driver.Value{row(int64(len(cs)), cs[0].CreatedAt, cs[len(cs)-1].CreatedAt)}}
+	})
+	f.on("GetTopChirpAuthors", func(args []driver.Value) fakeResult {
+		counts := map[uuid.UUID]int64{}
+		for _, c := range live() {
+			counts[c.UserID]++
+		}
+		var rows [][]driver.Value
+		for _, id := range []uuid.UUID{alice, bob} {
+			if counts[id] > 0 {
+				rows = append(rows, row(id, counts[id]))
+			}
+		}
+		return fakeResult{rows: rows}
+	})
+
+	stats := func() ChirpStats {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/chirps/stats", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var got ChirpStats
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	if got := stats(); got.Total != 3 || !got.Earliest.Equal(chirps[0].CreatedAt) || got.TopAuthors[0].ChirpCount != 2 {
+		t.Fatalf("unexpected stats before deleting: %+v", got)
+	}
+
+	req := httptest.NewRequest("DELETE", "/api/chirps/"+chirps[0].ID.String(), nil)
+	req.Header.Set("Authorization", bearer(t, alice))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	got := stats()
+	if got.Total != 2 || !got.Earliest.Equal(chirps[1].CreatedAt) || !got.Latest.Equal(chirps[2].CreatedAt) {
+		t.Fatalf("a deleted chirp still counts: %+v", got)
+	}
+	want := []AuthorChirpCount{{UserID: alice, ChirpCount: 1}, {UserID: bob, ChirpCount: 1}}
+	if !slices.Equal(got.TopAuthors, want) {
+		t.Fatalf("expected top authors %+v, got %+v", want, got.TopAuthors)
+	}
+}
+
+func TestGetSoftDeletedChirp(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.adminKey = "admin-key"
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: "hello", DeletedAt: sql.NullTime{Time: time.Now(), Valid: true}}
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		// mirror the query's filter: deleted rows only come back on request
+		if args[1] != true {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+
+	get := func(target, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetPathValue("chirpID", chirp.ID.String())
+		if apiKey != "" {
+			req.Header.Set("Authorization", "ApiKey "+apiKey)
+		}
+		w := httptest.NewRecorder()
+		cfg.getChirpHandler(w, req)
+		return w
+	}
+
+	path := "/api/chirps/" + chirp.ID.String()
+	if w := get(path, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a deleted chirp, got %d: %s", w.Code, w.Body)
+	}
+	if w := get(path+"?include_deleted=true", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a non-admin, got %d: %s", w.Code, w.Body)
+	}
+
+	w := get(path+"?include_deleted=true", "admin-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for an admin, got %d: %s", w.Code, w.Body)
+	}
+	var got Chirp
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.DeletedAt == nil {
+		t.Fatal("expected deleted_at in the response")
+	}
+}
+
+func TestGetChirpConditional(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: "hello"}
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/chirps/"+chirp.ID.String(), nil)
+		req.SetPathValue("chirpID", chirp.ID.String())
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		cfg.getChirpHandler(w, req)
+		return w
+	}
+
+	w := get("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag header")
+	}
+
+	w = get(etag)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Fatalf("expected an empty body, got %q", w.Body)
+	}
+
+	chirp.UpdatedAt = chirp.UpdatedAt.Add(time.Second)
+	w = get(etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 after the chirp changed, got %d", w.Code)
+	}
+}
+
+func TestGetChirpsIncludeAuthor(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: "hello"}
+	f.on("CountChirps", countRows(1))
+	f.on("GetChirps", listedChirps([]database.Chirp{chirp}))
+	f.on("GetUsersByIDs", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(chirp.UserID, "author@example.com")}}
+	})
+
+	get := func(target string) []map[string]any {
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var chirps []map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &chirps); err != nil {
+			t.Fatal(err)
+		}
+		if len(chirps) != 1 {
+			t.Fatalf("expected 1 chirp, got %d", len(chirps))
+		}
+		return chirps
+	}
+
+	if _, ok := get("/api/chirps")[0]["author"]; ok {
+		t.Fatal("expected no author without ?include=author")
+	}
+
+	author, ok := get("/api/chirps?include=author")[0]["author"].(map[string]any)
+	if !ok || author["email"] != "author@example.com" {
+		t.Fatalf("expected author email in response, got %v", author)
+	}
+}
+
+func TestGetChirpsIncludeAuthorBatched(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	alice, bob := uuid.New(), uuid.New()
+	var chirps [][]driver.Value
+	for i, author := range []uuid.UUID{alice, bob, alice, bob, alice} {
+		chirps = append(chirps, chirpRow(database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: author, Body: fmt.Sprint("chirp ", i)}))
+	}
+	f.on("CountChirps", countRows(len(chirps)))
+	f.on("GetChirps", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: chirps}
+	})
+	var lookedUp string
+	f.on("GetUsersByIDs", func(args []driver.Value) fakeResult {
+		lookedUp = fmt.Sprint(args[0])
+		return fakeResult{rows: [][]driver.Value{
+			row(alice, "alice@example.com"),
+			row(bob, "bob@example.com"),
+		}}
+	})
+
+	w := httptest.NewRecorder()
+	cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?include=author", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	if n := f.called("GetChirps"); n != 1 {
+		t.Fatalf("expected one chirp query, got %d", n)
+	}
+	if n := f.called("GetUsersByIDs"); n != 1 {
+		t.Fatalf("expected one author query, got %d", n)
+	}
+	if want := fmt.Sprintf(`{"%s","%s"}`, alice, bob); lookedUp != want {
+		t.Fatalf("expected distinct authors %s, got %s", want, lookedUp)
+	}
+
+	var got []Chirp
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	emails := map[uuid.UUID]string{alice: "alice@example.com", bob: "bob@example.com"}
+	for _, c := range got {
+		if c.Author == nil || c.Author.Email != emails[c.UserID] {
+			t.Fatalf("expected %s for chirp %q, got %+v", emails[c.UserID], c.Body, c.Author)
+		}
+	}
+}
+
+func TestGetChirpIncludeAuthor(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: "hello"}
+	f.on("GetChirpWithAuthor", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{append(chirpRow(chirp), "author@example.com")}}
+	})
+
+	req := httptest.NewRequest("GET", "/api/chirps/"+chirp.ID.String()+"?include=author", nil)
+	req.SetPathValue("chirpID", chirp.ID.String())
+	w := httptest.NewRecorder()
+	cfg.getChirpHandler(w, req)
+
+	var got Chirp
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Author == nil || got.Author.Email != "author@example.com" {
+		t.Fatalf("expected author email in response, got %+v", got.Author)
+	}
+}
+
+func TestMetricsHTML(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.fileserverHits.Store(3)
+
+	w := httptest.NewRecorder()
+	cfg.metricsHandler(w, httptest.NewRequest("GET", "/admin/metrics", nil))
+
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Fatalf("expected text/html, got %q", got)
+	}
+	if !strings.Contains(w.Body.String(), "Chirpy has been visited 3 times!") {
+		t.Fatalf("unexpected body %q", w.Body)
+	}
+}
+
+func TestMetricsJSON(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.fileserverHits.Store(3)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/admin/metrics?format=json", nil),
+		func() *http.Request {
+			req := httptest.NewRequest("GET", "/admin/metrics", nil)
+			req.Header.Set("Accept", "application/json")
+			return req
+		}(),
+	} {
+		w := httptest.NewRecorder()
+		cfg.metricsHandler(w, req)
+
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Fatalf("expected application/json, got %q", got)
+		}
+		if w.Body.String() != `{"fileserver_hits":3}` {
+			t.Fatalf("unexpected body %q", w.Body)
+		}
+	}
+}
+
+func TestResetSelective(t *testing.T) {
+	cases := []struct {
+		name    string
+		body    string
+		queries []string
+		metrics bool
+	}{
+		{"everything without a body", "", []string{"BEGIN", "ClearRefreshTokens", "ClearChirps", "ClearUsers", "COMMIT"}, true},
+		{"users", `{"clear": ["users"]}`, []string{"BEGIN", "ClearUsers", "COMMIT"}, false},
+		{"chirps", `{"clear": ["chirps"]}`, []string{"BEGIN", "ClearChirps", "COMMIT"}, false},
+		{"refresh tokens", `{"clear": ["refresh_tokens"]}`, []string{"BEGIN", "ClearRefreshTokens", "COMMIT"}, false},
+		{"metrics only", `{"clear": ["metrics"]}`, nil, true},
+		{"chirps and metrics", `{"clear": ["metrics", "chirps"]}`, []string{"BEGIN", "ClearChirps", "COMMIT"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, f := newTestConfig(t)
+			for _, name := range []string{"ClearRefreshTokens", "ClearChirps", "ClearUsers"} {
+				f.on(name, func(args []driver.Value) fakeResult { return fakeResult{} })
+			}
+			cfg.adminKey = "admin-key"
+			cfg.fileserverHits.Store(3)
+			cfg.routeHits.inc("GET /api/healthz")
+
+			var req *http.Request
+			if c.body == "" {
+				req = httptest.NewRequest("POST", "/admin/reset", nil)
+			} else {
+				req = newJSONRequest("POST", "/admin/reset", c.body)
+			}
+			req.Header.Set("Authorization", "ApiKey admin-key")
+			w := httptest.NewRecorder()
+			cfg.resetHandler(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+				t.Fatalf("expected text/plain, got %q", got)
+			}
+			if !slices.Equal(f.calls, c.queries) {
+				t.Fatalf("expected queries %v, got %v", c.queries, f.calls)
+			}
+			cleared := cfg.fileserverHits.Load() == 0 && len(cfg.routeHits.snapshot()) == 0
+			if cleared != c.metrics {
+				t.Fatalf("expected metrics cleared to be %t, got %t", c.metrics, cleared)
+			}
+		})
+	}
+
+	for _, body := range []string{`{"clear": []}`, `{"clear": ["likes"]}`, `{}`} {
+		cfg, f := newTestConfig(t)
+		cfg.adminKey = "admin-key"
+		req := newJSONRequest("POST", "/admin/reset", body)
+		req.Header.Set("Authorization", "ApiKey admin-key")
+		w := httptest.NewRecorder()
+		cfg.resetHandler(w, req)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: expected 422, got %d", body, w.Code)
+		}
+		if len(f.calls) != 0 {
+			t.Fatalf("%s: expected nothing cleared, ran %v", body, f.calls)
+		}
+	}
+}
+
+// headerCounter records every status a handler writes, so a second
+// WriteHeader shows up instead of being dropped with a log line.
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	statuses []int
+}
+
+func (w *headerCounter) WriteHeader(code int) {
+	w.statuses = append(w.statuses, code)
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func TestResetFailure(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.adminKey = "admin-key"
+	cfg.fileserverHits.Store(3)
+	f.on("ClearRefreshTokens", func(args []driver.Value) fakeResult { return fakeResult{} })
+	f.on("ClearChirps", func(args []driver.Value) fakeResult { return fakeResult{} })
+	f.on("ClearUsers", func(args []driver.Value) fakeResult {
+		return fakeResult{err: errors.New("connection reset")}
+	})
+
+	req := httptest.NewRequest("POST", "/admin/reset", nil)
+	req.Header.Set("Authorization", "ApiKey admin-key")
+	w := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+	cfg.resetHandler(w, req)
+
+	if !slices.Equal(w.statuses, []int{http.StatusInternalServerError}) {
+		t.Fatalf("expected a single 500, got %v", w.statuses)
+	}
+	if strings.Contains(w.Body.String(), "OK") {
+		t.Fatalf("expected only the error in the body, got %s", w.Body)
+	}
+	if cfg.fileserverHits.Load() != 3 {
+		t.Fatal("metrics shouldn't be cleared when the reset failed")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	w := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+	healthHandler(w, httptest.NewRequest("GET", "/api/healthz", nil))
+	if !slices.Equal(w.statuses, []int{http.StatusOK}) || w.Body.String() != "OK" {
+		t.Fatalf("expected a single 200 OK, got %v %q", w.statuses, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Fatalf("expected text/plain, got %q", got)
+	}
+}
+
+func TestRouteCountsConcurrent(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/healthz", healthHandler)
+	mux.HandleFunc("GET /api/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) {})
+	handler := cfg.middlewareRouteCounts(mux)
+
+	const workers, perWorker = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/healthz", nil))
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/chirps/"+uuid.NewString(), nil))
+			}
+		}()
+	}
+	wg.Wait()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nope", nil))
+
+	counts := cfg.routeHits.snapshot()
+	if counts["GET /api/healthz"] != workers*perWorker {
+		t.Fatalf("expected %d healthz hits, got %d", workers*perWorker, counts["GET /api/healthz"])
+	}
+	if counts["GET /api/chirps/{chirpID}"] != workers*perWorker {
+		t.Fatalf("expected %d chirp hits, got %d", workers*perWorker, counts["GET /api/chirps/{chirpID}"])
+	}
+	if counts["unmatched"] != 1 {
+		t.Fatalf("expected 1 unmatched hit, got %d", counts["unmatched"])
+	}
+
+	cfg.routeHits.reset()
+	if len(cfg.routeHits.snapshot()) != 0 {
+		t.Fatal("expected counters to be empty after reset")
+	}
+}
+
+func TestOpenAPISpecIsValidJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	openAPIHandler(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("expected application/json, got %q", got)
+	}
+	var spec struct {
+		OpenAPI string         `json:"openapi"`
+		Paths   map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.OpenAPI == "" || spec.Paths["/api/chirps"] == nil {
+		t.Fatalf("spec is missing expected fields: %+v", spec)
+	}
+}
+
+func TestAddChirpsBatch(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		now := time.Now()
+		return fakeResult{rows: [][]driver.Value{chirpRow(database.Chirp{ID: uuid.New(), CreatedAt: now, UpdatedAt: now, UserID: userID, Body: args[0].(string)})}}
+	})
+
+	req := newJSONRequest("POST", "/api/chirps/batch", `[{"body":"first"},{"body":" second "}]`)
+	req.Header.Set("Authorization", bearer(t, userID))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.addChirpsBatchHandler)(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var chirps []Chirp
+	if err := json.Unmarshal(w.Body.Bytes(), &chirps); err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 || chirps[1].Body != "second" {
+		t.Fatalf("unexpected chirps: %+v", chirps)
+	}
+	if f.called("BEGIN") != 1 || f.called("COMMIT") != 1 {
+		t.Fatalf("expected one transaction, got calls %v", f.calls)
+	}
+}
+
+func TestAddChirpsBatchRejectsInvalidChirp(t *testing.T) {
+	cfg, f := newTestConfig(t)
+
+	req := newJSONRequest("POST", "/api/chirps/batch", `[{"body":"fine"},{"body":"`+strings.Repeat("a", 141)+`"}]`)
+	req.Header.Set("Authorization", bearer(t, uuid.New()))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.addChirpsBatchHandler)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.Index == nil || *resp.Error.Index != 1 {
+		t.Fatalf("expected index 1, got %v", resp.Error.Index)
+	}
+	if resp.Error.Code != codeChirpTooLong {
+		t.Fatalf("expected code %q, got %q", codeChirpTooLong, resp.Error.Code)
+	}
+	if n := f.called("CreateChirp"); n != 0 {
+		t.Fatalf("expected no inserts, got %d", n)
+	}
+}
+
+func TestAddChirpsBatchCapsSize(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.maxChirpBatch = 2
+
+	req := newJSONRequest("POST", "/api/chirps/batch", `[{"body":"a"},{"body":"b"},{"body":"c"}]`)
+	req.Header.Set("Authorization", bearer(t, uuid.New()))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.addChirpsBatchHandler)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestStaticCacheControl(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.staticDir = t.TempDir()
+	cfg.staticMaxAge = time.Hour
+	mux := cfg.routes()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/app/", nil))
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=3600" {
+		t.Fatalf("expected static Cache-Control, got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/healthz", nil))
+	if got := w.Header().Get("Cache-Control"); got != "" {
+		t.Fatalf("expected no Cache-Control on API responses, got %q", got)
+	}
+
+	cfg.staticMaxAge = 0
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/app/", nil))
+	if got := w.Header().Get("Cache-Control"); got != "" {
+		t.Fatalf("expected caching disabled, got %q", got)
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.staticDir = t.TempDir()
+	for name, content := range map[string]string{
+		"index.html": "<h1>Chirpy</h1>",
+		"404.html":   "<h1>missing</h1>",
+		".env":       "SECRET=hunter2",
+	} {
+		if err := os.WriteFile(filepath.Join(cfg.staticDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := cfg.routes()
+
+	cases := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"/app/", http.StatusOK, "<h1>Chirpy</h1>"},
+		{"/app/.env", http.StatusNotFound, "<h1>missing</h1>"},
+		{"/app/nope.html", http.StatusNotFound, "<h1>missing</h1>"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+		if w.Code != c.wantCode {
+			t.Fatalf("%s: expected %d, got %d", c.path, c.wantCode, w.Code)
+		}
+		if w.Body.String() != c.wantBody {
+			t.Fatalf("%s: expected body %q, got %q", c.path, c.wantBody, w.Body)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	var seen string
+	handler := cfg.middlewareRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+		returnError(w, http.StatusBadRequest, errors.New("bad"))
+	}))
+
+	req := httptest.NewRequest("GET", "/api/chirps", nil)
+	req.Header.Set("X-Request-Id", "abc-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if seen != "abc-123" {
+		t.Fatalf("expected context request ID abc-123, got %q", seen)
+	}
+	if got := w.Header().Get("X-Request-Id"); got != "abc-123" {
+		t.Fatalf("expected echoed header abc-123, got %q", got)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.RequestID != "abc-123" {
+		t.Fatalf("expected request_id in error body, got %q", body.Error.RequestID)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/chirps", nil))
+	if _, err := uuid.Parse(w.Header().Get("X-Request-Id")); err != nil {
+		t.Fatalf("expected a generated uuid, got %q", w.Header().Get("X-Request-Id"))
+	}
+}
+
+func TestTokenLifetime(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.maxTokenLifetime = time.Hour
+	seconds := func(n int) *int { return &n }
+
+	cases := []struct {
+		name    string
+		in      *int
+		want    time.Duration
+		wantErr bool
+	}{
+		{"default", nil, defaultTokenLifetime, false},
+		{"custom", seconds(120), 2 * time.Minute, false},
+		{"at cap", seconds(3600), time.Hour, false},
+		{"over cap", seconds(3601), 0, true},
+		{"zero", seconds(0), 0, true},
+		{"negative", seconds(-5), 0, true},
+		// wraps to a negative Duration if converted before the check
+		{"overflows a duration", seconds(9223372037), 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := cfg.tokenLifetime(c.in)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("tokenLifetime() error = %v, wantErr %v", err, c.wantErr)
+			}
+			if got != c.want {
+				t.Fatalf("tokenLifetime() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLoginTokenLifetime(t *testing.T) {
+	hash, err := auth.HashPassword("correct-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, f := newTestConfig(t)
+	cfg.maxTokenLifetime = time.Hour
+	userID := uuid.New()
+	f.on("GetUser", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, Email: "a@example.com", HashedPassword: hash})}}
+	})
+	f.on("SetUserLastLogin", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, Email: "a@example.com", HashedPassword: hash})}}
+	})
+	f.on("CreateRefreshToken", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(args[0], time.Now(), time.Now(), userID, args[2], nil)}}
+	})
+
+	w := httptest.NewRecorder()
+	cfg.loginHandler(w, newJSONRequest("POST", "/api/login", `{"email":"a@example.com","password":"correct-password","expires_in_seconds":120}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var user User
+	if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	claims := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(user.Token, claims); err != nil {
+		t.Fatal(err)
+	}
+	if got := claims.ExpiresAt.Sub(claims.IssuedAt.Time); got != 2*time.Minute {
+		t.Fatalf("expected a 2m token, got %v", got)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.loginHandler(w, newJSONRequest("POST", "/api/login", `{"email":"a@example.com","password":"correct-password","expires_in_seconds":7200}`))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 over the cap, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestGetChirpsPagedInSQL(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	authorID := uuid.New()
+	start := time.Now().Add(-time.Hour)
+	var all []database.Chirp
+	for i := 0; i < 5; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		all = append(all, database.Chirp{ID: uuid.New(), CreatedAt: at, UpdatedAt: at, UserID: authorID, Body: fmt.Sprintf("chirp %d", i)})
+	}
+	for _, name := range []string{"CountChirps", "CountSearchChirps", "CountChirpsCreatedAfter"} {
+		f.on(name, countRows(len(all)))
+	}
+	for _, name := range []string{"GetChirps", "SearchChirps", "GetChirpsCreatedAfter"} {
+		f.on(name, listedChirps(all))
+	}
+
+	// limit and offset apply to every listing, not just by author
+	for _, query := range []string{
+		"",
+		"&q=chirp",
+		"&created_after=" + start.Add(-time.Minute).Format(time.RFC3339),
+	} {
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?limit=2&offset=1"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: expected 200, got %d: %s", query, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Total-Count"); got != "5" {
+			t.Fatalf("%q: expected X-Total-Count 5, got %q", query, got)
+		}
+		var chirps []Chirp
+		if err := json.Unmarshal(w.Body.Bytes(), &chirps); err != nil {
+			t.Fatal(err)
+		}
+		if len(chirps) != 2 || chirps[0].Body != "chirp 1" || chirps[1].Body != "chirp 2" {
+			t.Fatalf("%q: unexpected page: %+v", query, chirps)
+		}
+	}
+}
+
+func TestGetChirpsFromAuthorPaged(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	authorID := uuid.New()
+	start := time.Now().Add(-time.Hour)
+	var all []database.Chirp
+	for i := 0; i < 5; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		all = append(all, database.Chirp{ID: uuid.New(), CreatedAt: at, UpdatedAt: at, UserID: authorID, Body: fmt.Sprintf("chirp %d", i)})
+	}
+	f.on("CountChirpsFromAuthors", func(args []driver.Value) fakeResult {
+		if args[0] != "{\""+authorID.String()+"\"}" {
+			t.Errorf("count ignored the author filter: %v", args[0])
+		}
+		return fakeResult{rows: [][]driver.Value{row(int64(len(all)))}}
+	})
+	f.on("GetChirpsFromAuthors", func(args []driver.Value) fakeResult {
+		limit, offset := int(args[4].(int32)), int(args[5].(int32))
+		var rows [][]driver.Value
+		for i := offset; i < offset+limit && i < len(all); i++ {
+			rows = append(rows, chirpRow(all[i]))
+		}
+		return fakeResult{rows: rows}
+	})
+
+	w := httptest.NewRecorder()
+	cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?author_id="+authorID.String()+"&limit=2&offset=2", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "5" {
+		t.Fatalf("expected X-Total-Count 5, got %q", got)
+	}
+	var chirps []Chirp
+	if err := json.Unmarshal(w.Body.Bytes(), &chirps); err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 || chirps[0].Body != "chirp 2" || chirps[1].Body != "chirp 3" {
+		t.Fatalf("unexpected page: %+v", chirps)
+	}
+}
+
+// ilikeMatches reports whether body matches an ILIKE pattern the way
+// postgres does, with backslash as the escape character.
+func ilikeMatches(pattern, body string) bool {
+	var re strings.Builder
+	re.WriteString("(?is)^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '%':
+			re.WriteString(".*")
+		case c == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	return regexp.MustCompile(re.String()).MatchString(body)
+}
+
+func TestSearchChirpsMatchesWildcardsLiterally(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	var all []database.Chirp
+	for _, body := range []string{"50% off today", "500 off today", "snake_case", "snakeXcase", `C:\temp`, "C:temp"} {
+		all = append(all, database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: body})
+	}
+	matching := func(args []driver.Value) []database.Chirp {
+		var out []database.Chirp
+		for _, c := range all {
+			if ilikeMatches(args[0].(string), c.Body) {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	f.on("CountSearchChirps", func(args []driver.Value) fakeResult {
+		return countRows(len(matching(args)))(args)
+	})
+	f.on("SearchChirps", func(args []driver.Value) fakeResult {
+		return listedChirps(matching(args))(args)
+	})
+
+	cases := []struct {
+		q    string
+		want string
+	}{
+		{"50%", "50% off today"},
+		{"e_c", "snake_case"},
+		{`C:\t`, `C:\temp`},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?q="+url.QueryEscape(c.q), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", c.q, w.Code, w.Body)
+		}
+		var got []Chirp
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].Body != c.want {
+			t.Errorf("%s: expected only %q, got %+v", c.q, c.want, got)
+		}
+	}
+}
+
+func TestGetChirpsEnvelope(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	authorID := uuid.New()
+	start := time.Now().Add(-time.Hour)
+	var all []database.Chirp
+	for i := 0; i < 5; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		all = append(all, database.Chirp{ID: uuid.New(), CreatedAt: at, UpdatedAt: at, UserID: authorID, Body: fmt.Sprintf("chirp %d", i)})
+	}
+	f.on("CountChirps", countRows(len(all)))
+	f.on("GetChirps", listedChirps(all))
+	f.on("CountSearchChirps", countRows(len(all)))
+	f.on("SearchChirps", listedChirps(all))
+	f.on("CountChirpsFromAuthors", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(int64(len(all)))}}
+	})
+	f.on("GetChirpsFromAuthors", func(args []driver.Value) fakeResult {
+		limit, offset := int(args[4].(int32)), int(args[5].(int32))
+		var rows [][]driver.Value
+		for i := offset; i < offset+limit && i < len(all); i++ {
+			rows = append(rows, chirpRow(all[i]))
+		}
+		return fakeResult{rows: rows}
+	})
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps"+query, nil))
+		return w
+	}
+
+	// without envelope=true the listing stays a bare array, paged all the same
+	w := get("?limit=2")
+	var bare []Chirp
+	if err := json.Unmarshal(w.Body.Bytes(), &bare); err != nil {
+		t.Fatalf("expected a bare array: %v: %s", err, w.Body)
+	}
+	if len(bare) != 2 {
+		t.Fatalf("expected a page of 2 chirps, got %d", len(bare))
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "5" {
+		t.Fatalf("expected X-Total-Count 5, got %q", got)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+		page  pagination
+	}{
+		{"all chirps", "?envelope=true&limit=2&offset=1", []string{"chirp 1", "chirp 2"}, pagination{Limit: 2, Offset: 1, Total: 5}},
+		{"past the end", "?envelope=true&offset=10", []string{}, pagination{Limit: defaultPageLimit, Offset: 10, Total: 5}},
+		{"by author", "?envelope=true&author_id=" + authorID.String() + "&limit=2&offset=2", []string{"chirp 2", "chirp 3"}, pagination{Limit: 2, Offset: 2, Total: 5}},
+		{"search, newest first", "?envelope=true&q=chirp&sort=desc&limit=2", []string{"chirp 4", "chirp 3"}, pagination{Limit: 2, Offset: 0, Total: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+			}
+			var got struct {
+				Data       []Chirp    `json:"data"`
+				Pagination pagination `json:"pagination"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Data == nil {
+				t.Fatalf("expected data to be an array: %s", w.Body)
+			}
+			bodies := []string{}
+			for _, c := range got.Data {
+				bodies = append(bodies, c.Body)
+			}
+			if !slices.Equal(bodies, tt.want) || got.Pagination != tt.page {
+				t.Fatalf("expected %v %+v, got %v %+v", tt.want, tt.page, bodies, got.Pagination)
+			}
+		})
+	}
+
+	w = get("?envelope=true&limit=1&fields=body")
+	if got := strings.TrimSpace(w.Body.String()); got != `{"data":[{"body":"chirp 0"}],"pagination":{"limit":1,"offset":0,"total":5}}` {
+		t.Fatalf("unexpected enveloped fields: %s", got)
+	}
+}
+
+func TestGetChirpsFromSeveralAuthors(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	all := []database.Chirp{
+		{ID: uuid.New(), UserID: alice, Body: "from alice"},
+		{ID: uuid.New(), UserID: bob, Body: "from bob"},
+		{ID: uuid.New(), UserID: carol, Body: "from carol"},
+	}
+	// authors decodes the text form lib/pq sends a uuid[] parameter in
+	authors := func(arg driver.Value) map[string]bool {
+		set := map[string]bool{}
+		for _, id := range strings.Split(strings.Trim(arg.(string), "{}"), ",") {
+			set[strings.Trim(id, `"`)] = true
+		}
+		return set
+	}
+	matching := func(arg driver.Value) []database.Chirp {
+		set := authors(arg)
+		var out []database.Chirp
+		for _, c := range all {
+			if set[c.UserID.String()] {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	f.on("CountChirpsFromAuthors", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(int64(len(matching(args[0]))))}}
+	})
+	f.on("GetChirpsFromAuthors", func(args []driver.Value) fakeResult {
+		var rows [][]driver.Value
+		for _, c := range matching(args[0]) {
+			rows = append(rows, chirpRow(c))
+		}
+		return fakeResult{rows: rows}
+	})
+
+	get := func(query string) (*httptest.ResponseRecorder, []string) {
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?"+query, nil))
+		var chirps []Chirp
+		json.Unmarshal(w.Body.Bytes(), &chirps)
+		var bodies []string
+		for _, c := range chirps {
+			bodies = append(bodies, c.Body)
+		}
+		return w, bodies
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"single", "author_id=" + alice.String(), []string{"from alice"}},
+		{"repeated", "author_id=" + alice.String() + "&author_id=" + carol.String(), []string{"from alice", "from carol"}},
+		{"comma separated", "author_id=" + bob.String() + "," + carol.String(), []string{"from bob", "from carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, bodies := get(tt.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+			}
+			if fmt.Sprint(bodies) != fmt.Sprint(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, bodies)
+			}
+			if got := w.Header().Get("X-Total-Count"); got != strconv.Itoa(len(tt.want)) {
+				t.Fatalf("expected X-Total-Count %d, got %q", len(tt.want), got)
+			}
+		})
+	}
+
+	many := make([]string, maxAuthorIDs+1)
+	for i := range many {
+		many[i] = uuid.NewString()
+	}
+	for name, query := range map[string]string{
+		"invalid id":     "author_id=" + alice.String() + ",not-a-uuid",
+		"too many":       "author_id=" + strings.Join(many, ","),
+		"several with q": "author_id=" + alice.String() + "&author_id=" + bob.String() + "&q=hi",
+	} {
+		if w, _ := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestGetChirpsCursorPages(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	start := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+	var all []database.Chirp
+	add := func(at time.Time, body string) {
+		all = append(all, database.Chirp{ID: uuid.New(), CreatedAt: at, UpdatedAt: at, UserID: uuid.New(), Body: body})
+	}
+	for i := 0; i < 5; i++ {
+		// two chirps per timestamp so ties are broken by id
+		add(start.Add(time.Duration(i/2)*time.Minute), fmt.Sprintf("chirp %d", i))
+	}
+
+	// page applies the keyset queries to all, newest first when desc.
+	page := func(desc bool) fakeHandler {
+		return func(args []driver.Value) fakeResult {
+			key := func(c database.Chirp) string {
+				return c.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000") + c.ID.String()
+			}
+			sorted := append([]database.Chirp(nil), all...)
+			sort.Slice(sorted, func(i, j int) bool {
+				if desc {
+					return key(sorted[i]) > key(sorted[j])
+				}
+				return key(sorted[i]) < key(sorted[j])
+			})
+			var cursor string
+			if args[0] != nil {
+				cursor = args[0].(time.Time).UTC().Format("2006-01-02T15:04:05.000000") + args[1].(string)
+			}
+			var rows [][]driver.Value
+			for _, c := range sorted {
+				if cursor != "" && (desc && key(c) >= cursor || !desc && key(c) <= cursor) {
+					continue
+				}
+				if len(rows) < int(args[4].(int32)) {
+					rows = append(rows, chirpRow(c))
+				}
+			}
+			return fakeResult{rows: rows}
+		}
+	}
+	f.on("GetChirpsPageAfter", page(false))
+	f.on("GetChirpsPageBefore", page(true))
+
+	fetch := func(query string) ([]string, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", query, w.Code, w.Body)
+		}
+		var chirps []Chirp
+		json.Unmarshal(w.Body.Bytes(), &chirps)
+		var bodies []string
+		for _, c := range chirps {
+			bodies = append(bodies, c.Body)
+		}
+		return bodies, w.Header().Get("X-Next-Cursor")
+	}
+
+	t.Run("after", func(t *testing.T) {
+		var seen []string
+		bodies, next := fetch("after=&limit=2")
+		seen = append(seen, bodies...)
+		// new chirps land while the client is paging
+		add(time.Now(), "late 1")
+		for next != "" {
+			bodies, next = fetch("after=" + next + "&limit=2")
+			seen = append(seen, bodies...)
+			if len(all) == 6 {
+				add(time.Now().Add(time.Second), "late 2")
+			}
+		}
+		// ties on created_at come back in id order, which is random here
+		sort.Strings(seen)
+		want := "[chirp 0 chirp 1 chirp 2 chirp 3 chirp 4 late 1 late 2]"
+		if fmt.Sprint(seen) != want {
+			t.Fatalf("expected %s, got %v", want, seen)
+		}
+	})
+
+	t.Run("before", func(t *testing.T) {
+		older := len(all)
+		first, next := fetch("before=&limit=4")
+		// chirps posted after the first page must not push older ones
+		// onto the next page a second time
+		add(time.Now().Add(time.Minute), "newest")
+		rest, next := fetch("before=" + next + "&limit=4")
+		seen := map[string]bool{}
+		for _, b := range append(first, rest...) {
+			if seen[b] {
+				t.Fatalf("%q returned twice", b)
+			}
+			seen[b] = true
+		}
+		if len(seen) != older || seen["newest"] {
+			t.Fatalf("expected the %d older chirps, got %v %v", older, first, rest)
+		}
+		if next != "" {
+			t.Fatalf("expected no cursor after a short page, got %q", next)
+		}
+	})
+
+	t.Run("envelope", func(t *testing.T) {
+		page := func(query string) (int, cursorPagination, string) {
+			w := httptest.NewRecorder()
+			cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?envelope=true&"+query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected 200, got %d: %s", query, w.Code, w.Body)
+			}
+			var got struct {
+				Data       []Chirp          `json:"data"`
+				Pagination cursorPagination `json:"pagination"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			return len(got.Data), got.Pagination, w.Header().Get(nextCursorHeader)
+		}
+
+		n, pagination, header := page("after=&limit=2")
+		if n != 2 || pagination.Limit != 2 || pagination.NextCursor == "" || pagination.NextCursor != header {
+			t.Fatalf("expected 2 chirps and the header's cursor in the body, got %d %+v (header %q)", n, pagination, header)
+		}
+		if _, pagination, _ := page("after=&limit=1000"); pagination.NextCursor != "" {
+			t.Fatalf("expected no next_cursor after a short page, got %q", pagination.NextCursor)
+		}
+	})
+
+	for name, query := range map[string]string{
+		"bad cursor":     "after=not-a-cursor",
+		"both":           "after=&before=",
+		"with offset":    "after=&offset=2",
+		"sort by update": "before=&sort_by=updated_at",
+	} {
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestReadReplicaRouting(t *testing.T) {
+	cfg, primary := newTestConfig(t)
+	replica, replicaConn := newFakeDB(t)
+	cfg.readDB = database.New(replicaConn)
+	userID := uuid.New()
+	chirp := database.Chirp{ID: uuid.New(), UserID: userID, Body: "hello"}
+
+	for _, f := range []*fakeDB{primary, replica} {
+		f.on("CountChirps", countRows(1))
+		f.on("GetChirps", func(args []driver.Value) fakeResult {
+			return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+		})
+		f.on("GetChirp", func(args []driver.Value) fakeResult {
+			return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+		})
+		f.on("CreateChirp", func(args []driver.Value) fakeResult {
+			return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+		})
+		f.on("GetChirpLikes", func(args []driver.Value) fakeResult { return fakeResult{} })
+		f.on("GetReplyCounts", func(args []driver.Value) fakeResult { return fakeResult{} })
+		f.on("GetChirpStats", func(args []driver.Value) fakeResult {
+			return fakeResult{rows: [][]driver.Value{row(int64(1), nil, nil)}}
+		})
+		f.on("GetTopChirpAuthors", func(args []driver.Value) fakeResult { return fakeResult{} })
+	}
+
+	w := httptest.NewRecorder()
+	cfg.chirpStatsHandler(w, httptest.NewRequest("GET", "/api/chirps/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("stats: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if replica.called("GetChirpStats") != 1 || replica.called("GetTopChirpAuthors") != 1 || primary.called("GetChirpStats") != 0 || primary.called("GetTopChirpAuthors") != 0 {
+		t.Fatalf("stats should come from the replica: replica %v, primary %v", replica.calls, primary.calls)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	req := httptest.NewRequest("GET", "/api/chirps/"+chirp.ID.String(), nil)
+	req.SetPathValue("chirpID", chirp.ID.String())
+	w = httptest.NewRecorder()
+	cfg.getChirpHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get: expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	req = newJSONRequest("POST", "/api/chirps", `{"body":"hello"}`)
+	req.Header.Set("Authorization", bearer(t, userID))
+	w = httptest.NewRecorder()
+	cfg.requireAuth(cfg.addChirpHandler)(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	if replica.called("GetChirps") != 1 || replica.called("GetChirp") != 1 || replica.called("CreateChirp") != 0 {
+		t.Fatalf("replica saw %v", replica.calls)
+	}
+	if replica.called("GetChirpLikes") != 2 || primary.called("GetChirpLikes") != 0 {
+		t.Fatalf("like counts should come from the replica too: replica %v, primary %v", replica.calls, primary.calls)
+	}
+	if replica.called("GetReplyCounts") != 2 || primary.called("GetReplyCounts") != 0 {
+		t.Fatalf("reply counts should come from the replica too: replica %v, primary %v", replica.calls, primary.calls)
+	}
+	if primary.called("GetChirps") != 0 || primary.called("GetChirp") != 0 || primary.called("CreateChirp") != 1 {
+		t.Fatalf("primary saw %v", primary.calls)
+	}
+}
+
+func TestGzipChirpList(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.gzipMinSize = defaultGzipMinSize
+	var rows [][]driver.Value
+	for i := 0; i < 50; i++ {
+		rows = append(rows, chirpRow(database.Chirp{ID: uuid.New(), UserID: uuid.New(), Body: fmt.Sprintf("chirp number %d", i)}))
+	}
+	f.on("CountChirps", countRows(len(rows)))
+	f.on("GetChirps", func(args []driver.Value) fakeResult { return fakeResult{rows: rows} })
+	handler := cfg.middlewareHTTPMetrics(cfg.middlewareGzip(http.HandlerFunc(cfg.getChirpsHandler)))
+
+	req := httptest.NewRequest("GET", "/api/chirps", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected gzip encoding, got %q", got)
+	}
+	if w.Header().Get("Content-Length") != "" {
+		t.Fatal("Content-Length must not describe the uncompressed body")
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chirps []Chirp
+	if err := json.Unmarshal(plain, &chirps); err != nil || len(chirps) != len(rows) {
+		t.Fatalf("expected %d chirps after decompressing, got %d (%v)", len(rows), len(chirps), err)
+	}
+	if n := cfg.httpMetrics.byClass["2xx"]; n != 1 {
+		t.Fatalf("metrics should record the handler's 200, got %v", cfg.httpMetrics.byClass)
+	}
+
+	// without Accept-Encoding, or below the threshold, the body is plain
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/chirps", nil))
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatal("compressed a response the client didn't ask to be compressed")
+	}
+	rows = rows[:1]
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "" || !json.Valid(w.Body.Bytes()) {
+		t.Fatalf("expected a small plain response, got %q", w.Body)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip;q=1": true,
+		"br, *":             true,
+		"gzip;q=0":          false,
+		"identity":          false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := embeddedMigrationSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	// goose only parses a file when it runs it, so run each direction
+	// against a database that refuses every statement: a file that parses
+	// fails on execution, one that doesn't fails before it
+	_, db := newFakeDB(t)
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Fatalf("%s: expected version %d", m.Source, i+1)
+		}
+		for _, err := range []error{m.UpContext(context.Background(), db), m.DownContext(context.Background(), db)} {
+			if err != nil && strings.Contains(err.Error(), "failed to parse") {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// newScratchDB creates an empty database on the server named by
+// TEST_DATABASE_URL and drops it when the test ends. Tests that need
+// postgres skip when that isn't set.
+func newScratchDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	if err := admin.Ping(); err != nil {
+		t.Skipf("database unavailable: %v", err)
+	}
+
+	name := "chirpy_test_" + uuid.NewString()[:8]
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Skipf("can't create a scratch database: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP DATABASE " + name) })
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Path = "/" + name
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestRunMigrations(t *testing.T) {
+	db := newScratchDB(t)
+
+	ctx := context.Background()
+	if err := runMigrations(ctx, db); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	// a second run finds nothing pending
+	if err := runMigrations(ctx, db); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+
+	migrations, _ := embeddedMigrationSet()
+	var applied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM goose_db_version WHERE is_applied").Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Fatalf("expected %d applied migrations, got %d", len(migrations), applied)
+	}
+	if _, err := db.Exec("SELECT id, body, deleted_at FROM chirps LIMIT 0"); err != nil {
+		t.Fatalf("schema incomplete: %v", err)
+	}
+}
+
+func TestChirpLikes(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	alice, bob := uuid.New(), uuid.New()
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: alice, Body: "hello"}
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		if args[0] != chirp.ID.String() {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+
+	likes := map[string]bool{}
+	f.on("LikeChirp", func(args []driver.Value) fakeResult {
+		key := args[0].(string) + "/" + args[1].(string)
+		if likes[key] {
+			return fakeResult{rowsAffected: 0}
+		}
+		likes[key] = true
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("UnlikeChirp", func(args []driver.Value) fakeResult {
+		key := args[0].(string) + "/" + args[1].(string)
+		if !likes[key] {
+			return fakeResult{rowsAffected: 0}
+		}
+		delete(likes, key)
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("GetChirpLikes", func(args []driver.Value) fakeResult {
+		var n int64
+		mine := false
+		for key := range likes {
+			chirpID, userID, _ := strings.Cut(key, "/")
+			if chirpID == chirp.ID.String() {
+				n++
+				mine = mine || userID == args[0]
+			}
+		}
+		if n == 0 {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{row(chirp.ID, n, mine)}}
+	})
+
+	call := func(method string, user uuid.UUID, chirpID string) int {
+		req := httptest.NewRequest(method, "/api/chirps/"+chirpID+"/like", nil)
+		req.SetPathValue("chirpID", chirpID)
+		req.Header.Set("Authorization", bearer(t, user))
+		w := httptest.NewRecorder()
+		handler := cfg.likeChirpHandler
+		if method == "DELETE" {
+			handler = cfg.unlikeChirpHandler
+		}
+		cfg.requireAuth(handler)(w, req)
+		return w.Code
+	}
+	view := func(user *uuid.UUID) map[string]any {
+		req := httptest.NewRequest("GET", "/api/chirps/"+chirp.ID.String(), nil)
+		req.SetPathValue("chirpID", chirp.ID.String())
+		if user != nil {
+			req.Header.Set("Authorization", bearer(t, *user))
+		}
+		w := httptest.NewRecorder()
+		cfg.getChirpHandler(w, req)
+		var got map[string]any
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return got
+	}
+
+	// liking your own chirp is allowed, and liking twice is harmless
+	for _, user := range []uuid.UUID{alice, bob, bob} {
+		if code := call("POST", user, chirp.ID.String()); code != http.StatusNoContent {
+			t.Fatalf("like: expected 204, got %d", code)
+		}
+	}
+	if got := view(&bob); got["like_count"] != float64(2) || got["liked_by_me"] != true {
+		t.Fatalf("after likes: unexpected %v", got)
+	}
+	if got := view(nil); got["like_count"] != float64(2) || got["liked_by_me"] != nil {
+		t.Fatalf("anonymous view: unexpected %v", got)
+	}
+
+	if code := call("DELETE", bob, chirp.ID.String()); code != http.StatusNoContent {
+		t.Fatalf("unlike: expected 204, got %d", code)
+	}
+	if code := call("DELETE", bob, chirp.ID.String()); code != http.StatusNoContent {
+		t.Fatalf("second unlike: expected 204, got %d", code)
+	}
+	if got := view(&bob); got["like_count"] != float64(1) || got["liked_by_me"] != false {
+		t.Fatalf("after unlike: unexpected %v", got)
+	}
+
+	if code := call("POST", bob, uuid.NewString()); code != http.StatusNotFound {
+		t.Fatalf("unknown chirp: expected 404, got %d", code)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.chirpHub = newChirpHub(1)
+	handler := middlewareMethodNotAllowed(cfg.routes())
+
+	tests := []struct {
+		method, path, allow string
+	}{
+		{"DELETE", "/api/healthz", "GET, HEAD"},
+		{"PATCH", "/api/chirps", "DELETE, GET, HEAD, POST"},
+		{"PUT", "/api/chirps/" + uuid.NewString(), "DELETE, GET, HEAD, PATCH"},
+		{"GET", "/api/refresh", "POST"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: expected 405, got %d", tt.method, tt.path, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", tt.method, tt.path, tt.allow, got)
+		}
+		var body errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Code != codeMethodNotAllowed {
+			t.Errorf("%s %s: expected a method_not_allowed error, got %q", tt.method, tt.path, w.Body)
+		}
+	}
+
+	// unknown paths are still 404s
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown path: expected 404, got %d", w.Code)
+	}
+}
+
+func TestRespondJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Location", "/api/chirps/1")
+	respondJSON(w, http.StatusCreated, map[string]int{"n": 1})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	if ct := w.Result().Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected the Content-Type to reach the client, got %q", ct)
+	}
+	if w.Body.String() != `{"n":1}` {
+		t.Fatalf("unexpected body %q", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	respondJSON(w, http.StatusOK, map[string]any{"ch": make(chan int)})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unencodable payload: expected 500, got %d", w.Code)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Code != codeInternal {
+		t.Fatalf("unencodable payload: expected an internal error body, got %q", w.Body)
+	}
+}
+
+func TestRequireAuthChecksIssuer(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.jwtIssuer = "chirpy-staging"
+	handler := cfg.requireAuth(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	// bearer mints with the default issuer
+	req := httptest.NewRequest("POST", "/api/revoke-all", nil)
+	req.Header.Set("Authorization", bearer(t, uuid.New()))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("foreign issuer: expected 401, got %d", w.Code)
+	}
+
+	token, err := cfg.tokens().Make(uuid.New(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("own issuer: expected 204, got %d", w.Code)
+	}
+}
+
+func TestDeleteExpiredRefreshTokens(t *testing.T) {
+	db := newScratchDB(t)
+	ctx := context.Background()
+	if err := runMigrations(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	q := database.New(db)
+	user, err := q.CreateUser(ctx, database.CreateUserParams{Email: "a@example.com", HashedPassword: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := []struct {
+		token     string
+		expiresAt time.Time
+		revokedAt any
+		kept      bool
+	}{
+		{"valid", time.Now().Add(time.Hour), nil, true},
+		{"expired", time.Now().Add(-time.Hour), nil, false},
+		{"revoked-recently", time.Now().Add(time.Hour), time.Now().Add(-time.Hour), true},
+		{"revoked-long-ago", time.Now().Add(time.Hour), time.Now().Add(-30 * 24 * time.Hour), false},
+	}
+	for _, tok := range tokens {
+		if _, err := q.CreateRefreshToken(ctx, database.CreateRefreshTokenParams{Token: tok.token, UserID: user.ID, ExpiresAt: tok.expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+		if tok.revokedAt != nil {
+			if _, err := db.Exec("UPDATE refresh_tokens SET revoked_at = $1 WHERE token = $2", tok.revokedAt, tok.token); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	n, err := q.DeleteExpiredRefreshTokens(ctx, time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 tokens purged, got %d", n)
+	}
+	for _, tok := range tokens {
+		_, err := q.GetRefreshToken(ctx, tok.token)
+		if kept := err == nil; kept != tok.kept {
+			t.Errorf("%s: kept = %v, want %v (%v)", tok.token, kept, tok.kept, err)
+		}
+	}
+}
+
+func TestRefreshTokenCleanupStops(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.tokenCleanup = refreshTokenCleanup{interval: time.Millisecond, revokedRetention: 24 * time.Hour}
+	purged := make(chan time.Time, 100)
+	f.on("DeleteExpiredRefreshTokens", func(args []driver.Value) fakeResult {
+		purged <- args[0].(time.Time)
+		return fakeResult{rowsAffected: 3}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		cfg.runRefreshTokenCleanup(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case before := <-purged:
+			if d := time.Since(before); d < 24*time.Hour || d > 24*time.Hour+time.Minute {
+				t.Fatalf("expected revoked tokens older than a day to go, cutoff was %s ago", d)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("cleanup didn't run")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup didn't stop after cancel")
+	}
+}
+
+func TestChirpFieldSelection(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: "hello"}
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+	f.on("CountChirps", countRows(2))
+	f.on("GetChirps", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp), chirpRow(chirp)}}
+	})
+
+	keys := func(m map[string]json.RawMessage) []string {
+		var out []string
+		for k := range m {
+			out = append(out, k)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	t.Run("single chirp", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/chirps/"+chirp.ID.String()+"?fields=id,body", nil)
+		req.SetPathValue("chirpID", chirp.ID.String())
+		w := httptest.NewRecorder()
+		cfg.getChirpHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var got map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if k := keys(got); !slices.Equal(k, []string{"body", "id"}) {
+			t.Fatalf("expected only body and id, got %v", k)
+		}
+		if string(got["body"]) != `"hello"` {
+			t.Fatalf("expected body hello, got %s", got["body"])
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/chirps?fields=like_count,%20user_id", nil)
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var got []map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 {
+			t.Fatalf("expected 2 chirps, got %d", len(got))
+		}
+		for _, c := range got {
+			if k := keys(c); !slices.Equal(k, []string{"like_count", "user_id"}) {
+				t.Fatalf("expected only like_count and user_id, got %v", k)
+			}
+		}
+	})
+
+	t.Run("absent means everything", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/chirps", nil)
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, req)
+		var got []map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == 0 || len(got[0]) < 6 {
+			t.Fatalf("expected full chirps, got %s", w.Body)
+		}
+	})
+
+	for _, fields := range []string{"id,password", "", ",", "ID"} {
+		t.Run("invalid "+fields, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/chirps?fields="+fields, nil)
+			w := httptest.NewRecorder()
+			cfg.getChirpsHandler(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestChirpReplies(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	parent := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: "first"}
+	reply := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: userID, Body: "second", ParentID: uuid.NullUUID{UUID: parent.ID, Valid: true}}
+
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		if args[0] == parent.ID.String() {
+			return fakeResult{rows: [][]driver.Value{chirpRow(parent)}}
+		}
+		return fakeResult{}
+	})
+	f.on("CountRecentChirps", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(int64(0), nil)}}
+	})
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		if args[2] != parent.ID.String() {
+			t.Errorf("expected parent_id %s stored, got %v", parent.ID, args[2])
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(reply)}}
+	})
+	f.on("GetChirpReplies", func(args []driver.Value) fakeResult {
+		if args[0] != parent.ID.String() {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(reply)}}
+	})
+	f.on("GetReplyCounts", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(parent.ID, int64(1))}}
+	})
+
+	t.Run("create reply", func(t *testing.T) {
+		req := newJSONRequest("POST", "/api/chirps", `{"body":"second","parent_id":"`+parent.ID.String()+`"}`)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.addChirpHandler)(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+		}
+		var got Chirp
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.ParentID == nil || *got.ParentID != parent.ID {
+			t.Fatalf("expected parent_id %s, got %v", parent.ID, got.ParentID)
+		}
+	})
+
+	t.Run("missing parent", func(t *testing.T) {
+		created := f.called("CreateChirp")
+		req := newJSONRequest("POST", "/api/chirps", `{"body":"second","parent_id":"`+uuid.NewString()+`"}`)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.addChirpHandler)(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d: %s", w.Code, w.Body)
+		}
+		if f.called("CreateChirp") != created {
+			t.Fatal("a reply to a missing chirp shouldn't be stored")
+		}
+	})
+
+	t.Run("list replies", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/chirps/"+parent.ID.String()+"/replies", nil)
+		req.SetPathValue("chirpID", parent.ID.String())
+		w := httptest.NewRecorder()
+		cfg.getChirpRepliesHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var got []Chirp
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].ID != reply.ID {
+			t.Fatalf("expected the one reply, got %+v", got)
+		}
+	})
+
+	t.Run("replies of missing chirp", func(t *testing.T) {
+		id := uuid.NewString()
+		req := httptest.NewRequest("GET", "/api/chirps/"+id+"/replies", nil)
+		req.SetPathValue("chirpID", id)
+		w := httptest.NewRecorder()
+		cfg.getChirpRepliesHandler(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("reply_count", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/chirps/"+parent.ID.String(), nil)
+		req.SetPathValue("chirpID", parent.ID.String())
+		w := httptest.NewRecorder()
+		cfg.getChirpHandler(w, req)
+		var got Chirp
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.ReplyCount != 1 {
+			t.Fatalf("expected reply_count 1, got %d", got.ReplyCount)
+		}
+		if got.ParentID != nil {
+			t.Fatalf("a top-level chirp has no parent_id, got %v", got.ParentID)
+		}
+	})
+}
+
+func TestDeleteAccount(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.chirpCache = newChirpCache(10, time.Minute)
+	mux := cfg.routes()
+	userID := uuid.New()
+	const refreshToken = "refresh-token"
+
+	// the migrations cascade a user's deletion to their chirps and refresh
+	// tokens; the fake below does the same
+	for _, file := range []string{"sql/schema/002_chirps.sql", "sql/schema/004_refresh_tokens.sql"} {
+		schema, err := fs.ReadFile(embeddedMigrations, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(schema), "REFERENCES users (id) ON DELETE CASCADE") {
+			t.Fatalf("%s doesn't cascade user deletion", file)
+		}
+	}
+	userExists := true
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: userID, Body: "mine"}
+	chirps := map[uuid.UUID]database.Chirp{chirp.ID: chirp}
+	tokens := map[string]uuid.UUID{refreshToken: userID}
+	f.on("DeleteUser", func(args []driver.Value) fakeResult {
+		if args[0] != userID.String() || !userExists {
+			return fakeResult{}
+		}
+		userExists = false
+		for id, c := range chirps {
+			if c.UserID == userID {
+				delete(chirps, id)
+			}
+		}
+		for token, owner := range tokens {
+			if owner == userID {
+				delete(tokens, token)
+			}
+		}
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		c, ok := chirps[uuid.MustParse(args[0].(string))]
+		if !ok {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(c)}}
+	})
+	getToken := func(args []driver.Value) fakeResult {
+		owner, ok := tokens[args[0].(string)]
+		if !ok {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{row(args[0], time.Now(), time.Now(), owner, time.Now().Add(time.Hour), nil)}}
+	}
+	f.on("GetRefreshToken", getToken)
+	f.on("GetValidRefreshToken", validRefreshTokens(getToken))
+
+	serve := func(method, target, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// fetching the chirp first puts it in the cache
+	if w := serve("GET", "/api/chirps/"+chirp.ID.String(), ""); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 before deleting, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve("POST", "/api/refresh", "Bearer "+refreshToken); w.Code != http.StatusOK {
+		t.Fatalf("expected the refresh token to work before deleting, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := serve("DELETE", "/api/users/me", bearer(t, userID)); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := serve("GET", "/api/chirps/"+chirp.ID.String(), ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the deleted user's chirp to be gone, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve("POST", "/api/refresh", "Bearer "+refreshToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the deleted user's refresh token to be rejected, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve("DELETE", "/api/users/me", bearer(t, userID)); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 deleting the account again, got %d", w.Code)
+	}
+}
+
+func TestUserProfile(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	user := database.User{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), Email: "a@example.com", HashedPassword: "hash", IsChirpyRed: true}
+	f.on("GetUserByID", func(args []driver.Value) fakeResult {
+		if args[0] != user.ID.String() {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{userRow(user)}}
+	})
+	f.on("GetChirpStats", func(args []driver.Value) fakeResult {
+		if args[0] != user.ID.String() {
+			t.Errorf("expected chirps counted for %s, got %v", user.ID, args[0])
+		}
+		return fakeResult{rows: [][]driver.Value{row(int64(3), nil, nil)}}
+	})
+
+	req := httptest.NewRequest("GET", "/api/users/"+user.ID.String()+"/profile", nil)
+	req.SetPathValue("userID", user.ID.String())
+	w := httptest.NewRecorder()
+	cfg.getUserProfileHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"email", "hashed_password", "token", "refresh_token"} {
+		if _, ok := got[key]; ok {
+			t.Errorf("profile shouldn't include %s: %s", key, w.Body)
+		}
+	}
+	if got["id"] != user.ID.String() || got["is_chirpy_red"] != true || got["chirp_count"] != float64(3) {
+		t.Fatalf("unexpected profile %s", w.Body)
+	}
+	if _, ok := got["created_at"]; !ok {
+		t.Fatalf("expected created_at in %s", w.Body)
+	}
+
+	id := uuid.NewString()
+	req = httptest.NewRequest("GET", "/api/users/"+id+"/profile", nil)
+	req.SetPathValue("userID", id)
+	w = httptest.NewRecorder()
+	cfg.getUserProfileHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d", w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusting, err := newProxyTrust(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	narrow, err := newProxyTrust(true, "10.0.0.0/8, 203.0.113.7/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newProxyTrust(true, "not-a-cidr"); err == nil {
+		t.Fatal("expected an invalid CIDR to be rejected")
+	}
+
+	cases := []struct {
+		name    string
+		proxies proxyTrust
+		remote  string
+		xff     []string
+		realIP  string
+		want    string
+	}{
+		{"untrusted mode ignores headers", proxyTrust{}, "10.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.2", "10.0.0.1"},
+		{"no headers", trusting, "10.0.0.1:5000", nil, "", "10.0.0.1"},
+		{"single hop", trusting, "10.0.0.1:5000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"spoofed left entries skipped", trusting, "10.0.0.1:5000", []string{"1.2.3.4, 198.51.100.1, 10.0.0.2"}, "", "198.51.100.1"},
+		{"repeated headers", trusting, "10.0.0.1:5000", []string{"1.2.3.4", "198.51.100.1"}, "", "198.51.100.1"},
+		{"peer not a proxy", trusting, "198.51.100.9:5000", []string{"1.2.3.4"}, "", "198.51.100.9"},
+		{"all hops trusted", trusting, "10.0.0.1:5000", []string{"192.168.1.5, 10.0.0.2"}, "", "192.168.1.5"},
+		{"garbage hop", trusting, "10.0.0.1:5000", []string{"evil, 10.0.0.2"}, "", "10.0.0.2"},
+		{"x-real-ip", trusting, "10.0.0.1:5000", nil, "198.51.100.3", "198.51.100.3"},
+		{"bad x-real-ip", trusting, "10.0.0.1:5000", nil, "nope", "10.0.0.1"},
+		{"custom proxy list", narrow, "203.0.113.7:443", []string{"192.168.1.5"}, "", "192.168.1.5"},
+		{"custom list excludes private", narrow, "192.168.0.1:443", []string{"198.51.100.1"}, "", "192.168.0.1"},
+		{"ipv6 peer", trusting, "[::1]:5000", []string{"2001:db8::1"}, "", "2001:db8::1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &apiConfig{proxies: c.proxies}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = c.remote
+			for _, v := range c.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if c.realIP != "" {
+				req.Header.Set("X-Real-IP", c.realIP)
+			}
+			if got := cfg.clientIP(req); got != c.want {
+				t.Fatalf("expected %s, got %s", c.want, got)
+			}
+		})
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.adminKey = "admin-key"
+	cfg.maintenanceRetry = 2 * time.Minute
+	f.on("CountChirps", countRows(0))
+	f.on("GetChirps", func(args []driver.Value) fakeResult { return fakeResult{} })
+	handler := cfg.middlewareMaintenance(cfg.routes())
+
+	toggle := func(body, apiKey string) *httptest.ResponseRecorder {
+		req := newJSONRequest("POST", "/admin/maintenance", body)
+		req.Header.Set("Authorization", "ApiKey "+apiKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	if w := toggle(`{"enabled":true}`, "wrong"); w.Code != http.StatusForbidden || cfg.maintenance.Load() {
+		t.Fatalf("non-admins can't toggle maintenance: got %d", w.Code)
+	}
+	if w := toggle(`{}`, "admin-key"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without enabled, got %d", w.Code)
+	}
+
+	if w := toggle(`{"enabled":true}`, "admin-key"); w.Code != http.StatusOK || !cfg.maintenance.Load() {
+		t.Fatalf("expected maintenance on, got %d: %s", w.Code, w.Body)
+	}
+	w := get("/api/chirps")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 during maintenance, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "120" {
+		t.Fatalf("expected Retry-After 120, got %q", got)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Code != codeUnavailable {
+		t.Fatalf("expected an unavailable error body, got %s", w.Body)
+	}
+	if w := get("/api/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("healthz should keep answering during maintenance, got %d", w.Code)
+	}
+
+	if w := toggle(`{"enabled":false}`, "admin-key"); w.Code != http.StatusOK || cfg.maintenance.Load() {
+		t.Fatalf("expected maintenance off, got %d: %s", w.Code, w.Body)
+	}
+	if w := get("/api/chirps"); w.Code != http.StatusOK {
+		t.Fatalf("expected normal service after maintenance, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestUserSettings(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.maxSettingsBytes = 64
+	userID := uuid.New()
+	stored := []byte("{}")
+	f.on("GetUserSettings", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(stored)}}
+	})
+	f.on("SetUserSettings", func(args []driver.Value) fakeResult {
+		stored = args[1].(json.RawMessage)
+		return fakeResult{rowsAffected: 1}
+	})
+
+	get := func() string {
+		req := httptest.NewRequest("GET", "/api/users/me/settings", nil)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.getSettingsHandler)(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("get: expected 200, got %d: %s", w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+	put := func(body string) *httptest.ResponseRecorder {
+		req := newJSONRequest("PUT", "/api/users/me/settings", body)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.putSettingsHandler)(w, req)
+		return w
+	}
+
+	if got := get(); got != "{}" {
+		t.Fatalf("expected an empty object by default, got %s", got)
+	}
+
+	if w := put(`{ "theme": "dark", "compact": true }`); w.Code != http.StatusOK {
+		t.Fatalf("put: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if got := get(); got != `{"theme":"dark","compact":true}` {
+		t.Fatalf("expected stored settings back, got %s", got)
+	}
+
+	if w := put(`{"theme":"` + strings.Repeat("x", 64) + `"}`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for oversized settings, got %d: %s", w.Code, w.Body)
+	}
+	for _, body := range []string{`[1,2]`, `"dark"`, `null`, `{"theme":`} {
+		if w := put(body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d: %s", body, w.Code, w.Body)
+		}
+	}
+	if got := get(); got != `{"theme":"dark","compact":true}` {
+		t.Fatalf("rejected writes shouldn't change settings, got %s", got)
+	}
+}
+
+func TestReadRetriesTransientErrors(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.readDB = database.New(retryingDB{DBTX: cfg.conn, policy: retryPolicy{attempts: 3, baseDelay: time.Millisecond}})
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: "hello"}
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/chirps/"+chirp.ID.String(), nil)
+		req.SetPathValue("chirpID", chirp.ID.String())
+		w := httptest.NewRecorder()
+		cfg.getChirpHandler(w, req)
+		return w
+	}
+	failFirst := func(n int, err error) fakeHandler {
+		calls := 0
+		return func(args []driver.Value) fakeResult {
+			calls++
+			if calls <= n {
+				return fakeResult{err: err}
+			}
+			return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+		}
+	}
+
+	// a failover drops connections and then refuses new ones briefly
+	f.on("GetChirp", failFirst(2, &pq.Error{Code: "57P01"}))
+	if w := get(); w.Code != http.StatusOK {
+		t.Fatalf("expected the third try to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if n := f.called("GetChirp"); n != 3 {
+		t.Fatalf("expected 3 tries, got %d", n)
+	}
+
+	f.calls = nil
+	f.on("GetChirp", failFirst(3, &pq.Error{Code: "40001"}))
+	if w := get(); w.Code == http.StatusOK {
+		t.Fatal("expected the error to surface once attempts run out")
+	}
+	if n := f.called("GetChirp"); n != 3 {
+		t.Fatalf("expected 3 tries, got %d", n)
+	}
+
+	f.calls = nil
+	f.on("GetChirp", failFirst(1, &pq.Error{Code: "23505"}))
+	get()
+	if n := f.called("GetChirp"); n != 1 {
+		t.Fatalf("constraint violations shouldn't be retried, got %d tries", n)
+	}
+}
+
+func TestIsTransientDBError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "57P03"}, true},
+		{fmt.Errorf("query: %w", io.ErrUnexpectedEOF), true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{&pq.Error{Code: "23505"}, false},
+		{&pq.Error{Code: "22P02"}, false},
+		{sql.ErrNoRows, false},
+		{context.DeadlineExceeded, false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := isTransientDBError(c.err); got != c.want {
+			t.Errorf("%v: expected %v, got %v", c.err, c.want, got)
+		}
+	}
+}
+
+func TestDeleteChirpOwnership(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	mux := cfg.routes()
+	owner, other := uuid.New(), uuid.New()
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: owner, Body: "mine"}
+	f.on("DeleteChirpForUser", func(args []driver.Value) fakeResult {
+		if args[0] != chirp.ID.String() || args[1] != chirp.UserID.String() || chirp.DeletedAt.Valid {
+			return fakeResult{}
+		}
+		chirp.DeletedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		if args[0] != chirp.ID.String() {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+
+	del := func(id string, userID uuid.UUID) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/api/chirps/"+id, nil)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := del(chirp.ID.String(), other); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for someone else's chirp, got %d: %s", w.Code, w.Body)
+	}
+	if chirp.DeletedAt.Valid {
+		t.Fatal("a non-owner's request deleted the chirp")
+	}
+	if w := del(uuid.NewString(), other); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing chirp, got %d", w.Code)
+	}
+
+	w := del(chirp.ID.String(), owner)
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("expected an empty 204 for the owner, got %d: %q", w.Code, w.Body)
+	}
+	if !chirp.DeletedAt.Valid {
+		t.Fatal("the owner's request didn't delete the chirp")
+	}
+}
+
+func TestAdminDeletesAnyChirp(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.adminKey = "admin-key"
+	mux := cfg.routes()
+	owner, other := uuid.New(), uuid.New()
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: owner, Body: "abuse"}
+	f.on("DeleteChirp", func(args []driver.Value) fakeResult {
+		if args[0] != chirp.ID.String() {
+			return fakeResult{rowsAffected: 0}
+		}
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("DeleteChirpForUser", func(args []driver.Value) fakeResult {
+		if args[1] != owner.String() {
+			return fakeResult{rowsAffected: 0}
+		}
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		if args[0] != chirp.ID.String() {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+
+	del := func(target, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", target, nil)
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := del("/api/chirps/"+chirp.ID.String(), bearer(t, other)); w.Code != http.StatusForbidden {
+		t.Fatalf("non-admins can't delete others' chirps: got %d", w.Code)
+	}
+	// the user route takes no admin key; admins have their own
+	if w := del("/api/chirps/"+chirp.ID.String(), "ApiKey admin-key"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an admin key on the user route, got %d", w.Code)
+	}
+	if f.called("DeleteChirp") != 0 {
+		t.Fatal("a user request shouldn't take the admin path")
+	}
+	if w := del("/admin/chirps/"+chirp.ID.String(), "ApiKey wrong"); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a bad admin key, got %d", w.Code)
+	}
+	if w := del("/admin/chirps/"+chirp.ID.String(), bearer(t, other)); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a user token on the admin route, got %d", w.Code)
+	}
+	if w := del("/admin/chirps/"+chirp.ID.String(), "ApiKey admin-key"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected admins to delete any chirp, got %d: %s", w.Code, w.Body)
+	}
+	if f.called("DeleteChirp") != 1 {
+		t.Fatalf("expected one admin delete, saw %v", f.calls)
+	}
+	if w := del("/admin/chirps/"+uuid.NewString(), "ApiKey admin-key"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing chirp, got %d", w.Code)
+	}
+}
+
+func TestAppRedirects(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		middlewareMethodNotAllowed(cfg.routes()).ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	cases := []struct {
+		redirectRoot bool
+		target       string
+		status       int
+		location     string
+	}{
+		{false, "/app", http.StatusPermanentRedirect, "/app/"},
+		{false, "/app?ref=home", http.StatusPermanentRedirect, "/app/?ref=home"},
+		{false, "/", http.StatusNotFound, ""},
+		{true, "/", http.StatusFound, "/app/"},
+		{true, "/?ref=home", http.StatusFound, "/app/?ref=home"},
+		{true, "/missing", http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		cfg.redirectRoot = c.redirectRoot
+		w := get(c.target)
+		if w.Code != c.status || w.Header().Get("Location") != c.location {
+			t.Errorf("%s (redirectRoot %t): expected %d to %q, got %d to %q", c.target, c.redirectRoot, c.status, c.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestStaticSPAFallback(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.staticDir = t.TempDir()
+	cfg.staticMaxAge = time.Hour
+	for name, content := range map[string]string{
+		"index.html":  "<h1>Chirpy</h1>",
+		"404.html":    "<h1>missing</h1>",
+		"app.js":      "console.log('chirp')",
+		".env":        "SECRET=hunter2",
+		"docs/a.html": "<p>a</p>",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(cfg.staticDir, name)), 0o755)
+		if err := os.WriteFile(filepath.Join(cfg.staticDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		cfg.routes().ServeHTTP(w, req)
+		return w
+	}
+
+	cfg.staticSPA = true
+	for _, target := range []string{"/app/chirps", "/app/users/42/settings"} {
+		w := get(target, "text/html")
+		if w.Code != http.StatusOK || w.Body.String() != "<h1>Chirpy</h1>" {
+			t.Fatalf("%s: expected index.html, got %d %q", target, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-cache" {
+			t.Fatalf("%s: the fallback shouldn't be cached, got %q", target, got)
+		}
+	}
+	if w := get("/app/app.js", ""); w.Code != http.StatusOK || w.Body.String() != "console.log('chirp')" {
+		t.Fatalf("existing assets are served as-is, got %d %q", w.Code, w.Body)
+	}
+	if w := get("/app/missing.js", ""); w.Code != http.StatusNotFound || w.Body.String() != "<h1>missing</h1>" {
+		t.Fatalf("missing assets keep the 404 page, got %d %q", w.Code, w.Body)
+	}
+	if w := get("/app/.env", ""); w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "hunter2") {
+		t.Fatalf("dot files stay hidden, got %d %q", w.Code, w.Body)
+	}
+
+	w := get("/app/missing.js", "application/json")
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected a JSON 404, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Code != codeNotFound {
+		t.Fatalf("expected a not_found error body, got %s", w.Body)
+	}
+
+	cfg.staticSPA = false
+	if w := get("/app/chirps", "text/html"); w.Code != http.StatusNotFound {
+		t.Fatalf("without the fallback client routes 404, got %d", w.Code)
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	hash, err := auth.HashPassword("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := database.User{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), Email: "a@example.com", HashedPassword: hash}
+	totp := database.UserTotp{UserID: user.ID}
+
+	f.on("GetUser", func(args []driver.Value) fakeResult { return fakeResult{rows: [][]driver.Value{userRow(user)}} })
+	f.on("GetUserByID", func(args []driver.Value) fakeResult { return fakeResult{rows: [][]driver.Value{userRow(user)}} })
+	f.on("SetUserLastLogin", func(args []driver.Value) fakeResult { return fakeResult{rows: [][]driver.Value{userRow(user)}} })
+	f.on("CreateRefreshToken", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(args[0], time.Now(), time.Now(), user.ID, args[2], nil)}}
+	})
+	// the fake keeps user_totp in totp, following the queries' WHERE clauses
+	f.on("SaveTOTPSecret", func(args []driver.Value) fakeResult {
+		if totp.EnabledAt.Valid {
+			return fakeResult{rowsAffected: 0}
+		}
+		totp.Secret, totp.LastUsedStep = args[1].(string), 0
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("GetTOTP", func(args []driver.Value) fakeResult {
+		if totp.Secret == "" {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{row(totp.UserID, totp.Secret, time.Now(), totp.EnabledAt, totp.LastUsedStep)}}
+	})
+	f.on("EnableTOTP", func(args []driver.Value) fakeResult {
+		totp.EnabledAt = sql.NullTime{Time: time.Now(), Valid: true}
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("UseTOTPStep", func(args []driver.Value) fakeResult {
+		step := args[0].(int64)
+		if totp.LastUsedStep >= step {
+			return fakeResult{rowsAffected: 0}
+		}
+		totp.LastUsedStep = step
+		return fakeResult{rowsAffected: 1}
+	})
+
+	// code is what an authenticator app holding secret shows offset steps
+	// from now
+	var secret string
+	code := func(offset int64) string {
+		key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg [8]byte
+		binary.BigEndian.PutUint64(msg[:], uint64(auth.TOTPStep(time.Now())+offset))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(msg[:])
+		sum := mac.Sum(nil)
+		value := binary.BigEndian.Uint32(sum[sum[len(sum)-1]&0x0f:]) & 0x7fffffff
+		return fmt.Sprintf("%06d", value%1_000_000)
+	}
+	login := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cfg.loginHandler(w, newJSONRequest("POST", "/api/login", body))
+		return w
+	}
+	authed := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req := newJSONRequest("POST", "/api/users/me/2fa", body)
+		req.Header.Set("Authorization", bearer(t, user.ID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(handler)(w, req)
+		return w
+	}
+
+	if w := authed(cfg.confirmTOTPHandler, `{"code":"123456"}`); w.Code != http.StatusConflict {
+		t.Fatalf("confirming before enrolling: expected 409, got %d", w.Code)
+	}
+
+	w := authed(cfg.enrollTOTPHandler, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var enrolled struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &enrolled); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrolled.OtpauthURI, "otpauth://totp/Chirpy:a@example.com?") {
+		t.Fatalf("unexpected enrollment %+v", enrolled)
+	}
+	secret = enrolled.Secret
+	// the stored secret is encrypted, and only for this user's row
+	if strings.Contains(totp.Secret, secret) {
+		t.Fatalf("secret stored in the clear: %q", totp.Secret)
+	}
+	if opened, err := cfg.totpBox.Open(totp.Secret, user.ID.String()); err != nil || opened != secret {
+		t.Fatalf("expected the stored secret to open to %q, got %q, %v", secret, opened, err)
+	}
+
+	// enrolled but unconfirmed: logging in still only needs the password
+	if w := login(`{"email":"a@example.com","password":"hunter22"}`); w.Code != http.StatusOK {
+		t.Fatalf("login before confirming: expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := authed(cfg.confirmTOTPHandler, `{"code":"not-a-code"}`); w.Code != http.StatusBadRequest || totp.EnabledAt.Valid {
+		t.Fatalf("a wrong code shouldn't enable 2FA: got %d", w.Code)
+	}
+	if w := authed(cfg.confirmTOTPHandler, `{"code":"`+code(-1)+`"}`); w.Code != http.StatusNoContent || !totp.EnabledAt.Valid {
+		t.Fatalf("confirm: expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := authed(cfg.enrollTOTPHandler, ""); w.Code != http.StatusConflict {
+		t.Fatalf("re-enrolling once enabled: expected 409, got %d", w.Code)
+	}
+
+	errCode := func(w *httptest.ResponseRecorder) errorCode {
+		var body errorResponse
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return body.Error.Code
+	}
+	w = login(`{"email":"a@example.com","password":"hunter22"}`)
+	if w.Code != http.StatusUnauthorized || errCode(w) != codeTOTPRequired {
+		t.Fatalf("login without a code: expected 401 totp_required, got %d: %s", w.Code, w.Body)
+	}
+	if w := login(`{"email":"a@example.com","password":"hunter22","totp_code":"000000x"}`); w.Code != http.StatusUnauthorized || errCode(w) != codeTOTPInvalid {
+		t.Fatalf("login with a bad code: expected 401 totp_invalid, got %d: %s", w.Code, w.Body)
+	}
+	if w := login(`{"email":"a@example.com","password":"wrong","totp_code":"` + code(0) + `"}`); w.Code != http.StatusUnauthorized || f.called("SetUserLastLogin") != 1 {
+		t.Fatalf("a valid code doesn't make up for a wrong password: got %d", w.Code)
+	}
+	now := code(0)
+	if w := login(`{"email":"a@example.com","password":"hunter22","totp_code":"` + now + `"}`); w.Code != http.StatusOK {
+		t.Fatalf("login with a code: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := login(`{"email":"a@example.com","password":"hunter22","totp_code":"` + now + `"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("replaying a code: expected 401, got %d", w.Code)
+	}
+}
+
+func TestTwoFactorWithoutKey(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.totpBox = nil
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter22"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := database.User{ID: uuid.New(), Email: "a@example.com", HashedPassword: string(hash)}
+	f.on("GetUser", func(args []driver.Value) fakeResult { return fakeResult{rows: [][]driver.Value{userRow(user)}} })
+	f.on("GetTOTP", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(user.ID, "v1:sealed", time.Now(), time.Now(), int64(0))}}
+	})
+
+	for name, handler := range map[string]http.HandlerFunc{"enroll": cfg.enrollTOTPHandler, "confirm": cfg.confirmTOTPHandler} {
+		req := newJSONRequest("POST", "/api/users/me/2fa", `{"code":"123456"}`)
+		req.Header.Set("Authorization", bearer(t, user.ID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(handler)(w, req)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: expected 503, got %d: %s", name, w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	cfg.loginHandler(w, newJSONRequest("POST", "/api/login", `{"email":"a@example.com","password":"hunter22","totp_code":"123456"}`))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("login with 2FA enabled: expected 503, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTwoFactorLoginLockout(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.loginLockout = loginLockout{threshold: 3, cooldown: time.Minute}
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter22"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := database.User{ID: uuid.New(), Email: "a@example.com", HashedPassword: string(hash)}
+	const secret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+	sealed, err := cfg.totpBox.Seal(secret, user.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failures int64
+	var lockedUntil time.Time
+	f.on("GetUser", func(args []driver.Value) fakeResult { return fakeResult{rows: [][]driver.Value{userRow(user)}} })
+	f.on("GetTOTP", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(user.ID, sealed, time.Now(), time.Now(), int64(0))}}
+	})
+	f.on("GetLoginLockedUntil", func(args []driver.Value) fakeResult {
+		if !lockedUntil.After(time.Now()) {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{row(lockedUntil)}}
+	})
+	f.on("RecordLoginFailure", func(args []driver.Value) fakeResult {
+		failures++
+		return fakeResult{rows: [][]driver.Value{row(failures)}}
+	})
+	f.on("LockLogin", func(args []driver.Value) fakeResult {
+		failures, lockedUntil = 0, args[1].(time.Time)
+		return fakeResult{}
+	})
+
+	// any six digits the authenticator isn't showing right now
+	var wrong string
+	for i := 0; ; i++ {
+		wrong = fmt.Sprintf("%06d", i)
+		if _, err := auth.ValidateTOTP(wrong, secret, time.Now()); err != nil {
+			break
+		}
+	}
+	login := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cfg.loginHandler(w, newJSONRequest("POST", "/api/login", `{"email":"a@example.com","password":"hunter22","totp_code":"`+wrong+`"}`))
+		return w
+	}
+
+	// asking for a code isn't a failure, only a wrong one is
+	w := httptest.NewRecorder()
+	cfg.loginHandler(w, newJSONRequest("POST", "/api/login", `{"email":"a@example.com","password":"hunter22"}`))
+	if w.Code != http.StatusUnauthorized || f.called("RecordLoginFailure") != 0 {
+		t.Fatalf("login without a code: expected 401 and nothing counted, got %d with %d failures", w.Code, f.called("RecordLoginFailure"))
+	}
+
+	for i := 1; i <= cfg.loginLockout.threshold; i++ {
+		if w := login(); w.Code != http.StatusUnauthorized {
+			t.Fatalf("bad code %d: expected 401, got %d: %s", i, w.Code, w.Body)
+		}
+	}
+	if !lockedUntil.After(time.Now()) {
+		t.Fatalf("expected the account to be locked after %d bad codes", cfg.loginLockout.threshold)
+	}
+	if w := login(); w.Code != http.StatusLocked {
+		t.Fatalf("while locked: expected 423, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPASETOAccessTokens(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.tokenType = tokenTypePASETO
+	userID := uuid.New()
+
+	token, err := cfg.tokens().Make(userID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, "v4.local.") {
+		t.Fatalf("expected a PASETO token, got %q", token)
+	}
+
+	var got uuid.UUID
+	handler := cfg.requireAuth(func(w http.ResponseWriter, r *http.Request) { got = requestUserID(r) })
+	req := httptest.NewRequest("GET", "/api/users/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK || got != userID {
+		t.Fatalf("expected the PASETO token to authenticate %s, got %d for %s", userID, w.Code, got)
+	}
+
+	// JWTs from before the switch are no longer accepted
+	req.Header.Set("Authorization", bearer(t, userID))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a JWT to be rejected, got %d", w.Code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.loginLockout = loginLockout{threshold: 3, cooldown: time.Minute}
+	// a cheap hash keeps the many logins below fast
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter22"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := database.User{ID: uuid.New(), Email: "a@example.com", HashedPassword: string(hash)}
+
+	// the fake keeps user's login_failures row in failures and lockedUntil
+	var failures int64
+	var lockedUntil time.Time
+	f.on("GetUser", func(args []driver.Value) fakeResult { return fakeResult{rows: [][]driver.Value{userRow(user)}} })
+	f.on("SetUserLastLogin", func(args []driver.Value) fakeResult { return fakeResult{rows: [][]driver.Value{userRow(user)}} })
+	f.on("CreateRefreshToken", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(args[0], time.Now(), time.Now(), user.ID, args[2], nil)}}
+	})
+	f.on("GetLoginLockedUntil", func(args []driver.Value) fakeResult {
+		if !lockedUntil.After(time.Now()) {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{row(lockedUntil)}}
+	})
+	f.on("RecordLoginFailure", func(args []driver.Value) fakeResult {
+		failures++
+		return fakeResult{rows: [][]driver.Value{row(failures)}}
+	})
+	f.on("LockLogin", func(args []driver.Value) fakeResult {
+		failures, lockedUntil = 0, args[1].(time.Time)
+		return fakeResult{}
+	})
+	f.on("ClearLoginFailures", func(args []driver.Value) fakeResult {
+		failures, lockedUntil = 0, time.Time{}
+		return fakeResult{}
+	})
+
+	login := func(password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cfg.loginHandler(w, newJSONRequest("POST", "/api/login", `{"email":"a@example.com","password":"`+password+`"}`))
+		return w
+	}
+
+	for i := 1; i < cfg.loginLockout.threshold; i++ {
+		if w := login("wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: expected 401, got %d", i, w.Code)
+		}
+	}
+	if failures != int64(cfg.loginLockout.threshold-1) {
+		t.Fatalf("expected %d failures counted, got %d", cfg.loginLockout.threshold-1, failures)
+	}
+
+	// a success resets the count, so the failures so far don't add up
+	if w := login("hunter22"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if failures != 0 {
+		t.Fatalf("expected a successful login to reset the count, got %d", failures)
+	}
+
+	for i := 1; i <= cfg.loginLockout.threshold; i++ {
+		if w := login("wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: expected 401, got %d", i, w.Code)
+		}
+	}
+	if !lockedUntil.After(time.Now()) {
+		t.Fatalf("expected the account to be locked after %d failures", cfg.loginLockout.threshold)
+	}
+
+	// locked: even the right password is refused, and nothing more is counted
+	recorded := f.called("RecordLoginFailure")
+	for _, password := range []string{"hunter22", "wrong"} {
+		w := login(password)
+		var body errorResponse
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusLocked || body.Error.Code != codeAccountLocked {
+			t.Fatalf("%s while locked: expected 423 account_locked, got %d: %s", password, w.Code, w.Body)
+		}
+		if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 || retryAfter > 60 {
+			t.Fatalf("expected Retry-After within the cooldown, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+	if n := f.called("RecordLoginFailure"); n != recorded {
+		t.Fatalf("expected no failures counted while locked, got %d more", n-recorded)
+	}
+
+	// once the cooldown has passed the right password works again
+	lockedUntil = time.Now().Add(-time.Second)
+	if w := login("hunter22"); w.Code != http.StatusOK {
+		t.Fatalf("after the cooldown: expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// with lockout disabled no failures are tracked
+	cfg.loginLockout = loginLockout{}
+	recorded = f.called("RecordLoginFailure")
+	for i := 0; i < 5; i++ {
+		login("wrong")
+	}
+	if n := f.called("RecordLoginFailure"); n != recorded {
+		t.Fatalf("expected no failures counted with lockout disabled, got %d", n-recorded)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	defer func(v, c, b string) { version, commit, buildTime = v, c, b }(version, commit, buildTime)
+	version, commit, buildTime = "v1.4.0", "0123abc", "2025-03-01T12:00:00Z"
+
+	cfg, _ := newTestConfig(t)
+	w := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	want := `{"version":"v1.4.0","commit":"0123abc","build_time":"2025-03-01T12:00:00Z"}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestExportChirps(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// one more than a batch, so the export has to come back for the rest
+	chirps := make([]database.Chirp, exportBatchSize+1)
+	for i := range chirps {
+		chirps[i] = database.Chirp{ID: uuid.New(), CreatedAt: start.Add(time.Duration(i) * time.Minute), UserID: userID, Body: fmt.Sprint("chirp ", i)}
+	}
+	chirps[0].Body = `commas, "quotes"` + "\nand a newline"
+	f.on("GetChirpsPageAfter", func(args []driver.Value) fakeResult {
+		if args[2] != fmt.Sprintf(`{"%s"}`, userID) {
+			t.Errorf("expected only the caller's chirps, got authors %v", args[2])
+		}
+		page := chirps[:exportBatchSize]
+		if args[0] != nil {
+			page = chirps[exportBatchSize:]
+		}
+		var rows [][]driver.Value
+		for _, c := range page {
+			rows = append(rows, chirpRow(c))
+		}
+		return fakeResult{rows: rows}
+	})
+
+	mux := cfg.routes()
+	export := func(query string) *httptest.ResponseRecorder {
+		f.calls = nil
+		req := httptest.NewRequest("GET", "/api/chirps/export"+query, nil)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := export("?format=csv")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/csv") {
+		t.Fatalf("expected text/csv, got %q", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="chirps.csv"` {
+		t.Fatalf("expected an attachment, got %q", got)
+	}
+	if n := f.called("GetChirpsPageAfter"); n != 2 {
+		t.Fatalf("expected the export to read two batches, got %d", n)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(chirps)+1 {
+		t.Fatalf("expected a header and %d rows, got %d records", len(chirps), len(records))
+	}
+	if !slices.Equal(records[0], []string{"id", "created_at", "body"}) {
+		t.Fatalf("unexpected header row %v", records[0])
+	}
+	want := []string{chirps[0].ID.String(), "2024-05-01T12:00:00Z", chirps[0].Body}
+	if !slices.Equal(records[1], want) {
+		t.Fatalf("expected first row %q, got %q", want, records[1])
+	}
+	if last := records[len(records)-1]; last[0] != chirps[len(chirps)-1].ID.String() {
+		t.Fatalf("expected the last chirp to end the export, got %v", last)
+	}
+
+	w = export("?format=json")
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="chirps.json"` {
+		t.Fatalf("expected an attachment, got %q", got)
+	}
+	var exported []exportedChirp
+	if err := json.Unmarshal(w.Body.Bytes(), &exported); err != nil {
+		t.Fatalf("expected a JSON array: %v", err)
+	}
+	if len(exported) != len(chirps) || exported[0].Body != chirps[0].Body || !exported[0].CreatedAt.Equal(start) {
+		t.Fatalf("unexpected JSON export starting %+v", exported[0])
+	}
+
+	if w := export("?format=xml"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown format, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/chirps/export", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+}
+
+func TestChirpCacheLRU(t *testing.T) {
+	c := newChirpCache(2, time.Hour)
+	alice, bob := uuid.New(), uuid.New()
+	a := database.Chirp{ID: uuid.New(), UserID: alice, Body: "a"}
+	b := database.Chirp{ID: uuid.New(), UserID: bob, Body: "b"}
+	d := database.Chirp{ID: uuid.New(), UserID: alice, Body: "d"}
+
+	c.add(a)
+	c.add(b)
+	c.get(a.ID) // a is now more recent than b
+	c.add(d)
+	if _, ok := c.get(b.ID); ok {
+		t.Fatal("expected the least recently used chirp to be evicted")
+	}
+	if got, ok := c.get(a.ID); !ok || got.Body != "a" {
+		t.Fatalf("expected a to stay cached, got %+v %t", got, ok)
+	}
+
+	a.Body = "a, edited"
+	c.add(a)
+	if got, _ := c.get(a.ID); got.Body != "a, edited" {
+		t.Fatalf("expected add to replace the entry, got %q", got.Body)
+	}
+
+	c.forget(a.ID)
+	if _, ok := c.get(a.ID); ok {
+		t.Fatal("expected a forgotten chirp to miss")
+	}
+
+	c.add(a)
+	c.add(b)
+	c.forgetAuthor(alice)
+	if _, ok := c.get(a.ID); ok {
+		t.Fatal("expected forgetAuthor to drop the author's chirps")
+	}
+	if _, ok := c.get(b.ID); !ok {
+		t.Fatal("expected other authors' chirps to stay")
+	}
+	c.purge()
+	if _, ok := c.get(b.ID); ok {
+		t.Fatal("expected purge to empty the cache")
+	}
+
+	deleted := database.Chirp{ID: uuid.New(), DeletedAt: sql.NullTime{Time: time.Now(), Valid: true}}
+	c.add(deleted)
+	if _, ok := c.get(deleted.ID); ok {
+		t.Fatal("deleted chirps shouldn't be cached")
+	}
+
+	short := newChirpCache(2, time.Millisecond)
+	short.add(a)
+	time.Sleep(2 * time.Millisecond)
+	if _, ok := short.get(a.ID); ok {
+		t.Fatal("expected an expired chirp to miss")
+	}
+
+	// a size of 0 disables the cache, and the nil cache ignores everything
+	disabled := newChirpCache(0, time.Hour)
+	disabled.add(a)
+	disabled.forget(a.ID)
+	disabled.forgetAuthor(alice)
+	disabled.purge()
+	if _, ok := disabled.get(a.ID); ok {
+		t.Fatal("expected a disabled cache to miss")
+	}
+}
+
+func TestGetChirpCached(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.chirpCache = newChirpCache(10, time.Hour)
+	ownerID := uuid.New()
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: ownerID, Body: "first draft"}
+
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+	f.on("CreateChirpRevision", func(args []driver.Value) fakeResult {
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("UpdateChirpBody", func(args []driver.Value) fakeResult {
+		chirp.Body, chirp.UpdatedAt = args[1].(string), time.Now()
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+	f.on("DeleteChirpForUser", func(args []driver.Value) fakeResult {
+		chirp.DeletedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		return fakeResult{rowsAffected: 1}
+	})
+
+	mux := cfg.routes()
+	path := "/api/chirps/" + chirp.ID.String()
+	send := func(method, body string) *httptest.ResponseRecorder {
+		req := newJSONRequest(method, path, body)
+		req.Header.Set("Authorization", bearer(t, ownerID))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	read := func() (Chirp, int) {
+		f.calls = nil
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var got Chirp
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return got, f.called("GetChirp")
+	}
+
+	if _, queried := read(); queried != 1 {
+		t.Fatalf("expected the first read to query, got %d", queried)
+	}
+	if got, queried := read(); queried != 0 || got.Body != "first draft" {
+		t.Fatalf("expected the second read from the cache, got %d queries and %q", queried, got.Body)
+	}
+
+	if w := send("PATCH", `{"body":"second draft"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from the edit, got %d: %s", w.Code, w.Body)
+	}
+	if got, queried := read(); queried != 1 || got.Body != "second draft" {
+		t.Fatalf("expected the edit to invalidate the cache, got %d queries and %q", queried, got.Body)
+	}
+
+	if w := send("DELETE", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 from the delete, got %d: %s", w.Code, w.Body)
+	}
+	if _, ok := cfg.chirpCache.get(chirp.ID); ok {
+		t.Fatal("expected the delete to invalidate the cache")
+	}
+}
+
+// A replica still behind an edit must not be able to refill the cache with
+// the old chirp after the edit forgot it.
+func TestGetChirpCacheSkipsLaggingReplica(t *testing.T) {
+	cfg, primary := newTestConfig(t)
+	replica, replicaConn := newFakeDB(t)
+	cfg.readDB = database.New(replicaConn)
+	cfg.chirpCache = newChirpCache(10, time.Hour)
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: "first draft"}
+	stale := chirp
+
+	primary.on("GetChirp", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+	replica.on("GetChirp", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{chirpRow(stale)}}
+	})
+	replica.on("GetChirpLikes", func(args []driver.Value) fakeResult { return fakeResult{} })
+	replica.on("GetReplyCounts", func(args []driver.Value) fakeResult { return fakeResult{} })
+
+	mux := cfg.routes()
+	read := func() Chirp {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/chirps/"+chirp.ID.String(), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var got Chirp
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return got
+	}
+
+	read()
+	chirp.Body = "second draft"
+	cfg.chirpCache.forget(chirp.ID)
+	for i := 0; i < 2; i++ {
+		if got := read(); got.Body != "second draft" {
+			t.Fatalf("read %d: expected the edited chirp, got %q", i, got.Body)
+		}
+	}
+	if replica.called("GetChirp") != 0 {
+		t.Fatalf("expected cache misses to skip the replica, got %v", replica.calls)
+	}
+}
+
+// Editing is a PATCH, so a browser preflights it; both requests have to
+// make it through the CORS middleware main() installs.
+func TestEditChirpCrossOrigin(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.cors = newCORSPolicy("https://allowed.example", "", "")
+	ownerID := uuid.New()
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: ownerID, Body: "first draft"}
+	f.on("GetChirp", func(args []driver.Value) fakeResult { return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}} })
+	f.on("CreateChirpRevision", func(args []driver.Value) fakeResult { return fakeResult{rowsAffected: 1} })
+	f.on("UpdateChirpBody", func(args []driver.Value) fakeResult {
+		chirp.Body = args[1].(string)
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+	handler := cfg.handler()
+	path := "/api/chirps/" + chirp.ID.String()
+
+	req := httptest.NewRequest("OPTIONS", path, nil)
+	req.Header.Set("Origin", "https://allowed.example")
+	req.Header.Set("Access-Control-Request-Method", "PATCH")
+	req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "PATCH") {
+		t.Fatalf("preflight: expected PATCH to be allowed, got %d %q", w.Code, w.Header().Get("Access-Control-Allow-Methods"))
+	}
+
+	req = newJSONRequest("PATCH", path, `{"body":"second draft"}`)
+	req.Header.Set("Origin", "https://allowed.example")
+	req.Header.Set("Authorization", bearer(t, ownerID))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://allowed.example" {
+		t.Fatalf("edit: expected 200 readable by the origin, got %d %q: %s", w.Code, w.Header().Get("Access-Control-Allow-Origin"), w.Body)
+	}
+}
+
+func TestChirpEditHistory(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	ownerID, otherID := uuid.New(), uuid.New()
+	created := time.Now().Add(-time.Hour)
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: created, UpdatedAt: created, UserID: ownerID, Body: "first draft"}
+
+	// the fake keeps the chirp and its revisions, as the queries would
+	var revisions []database.ChirpRevision
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		if args[0] != chirp.ID.String() {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+	f.on("CreateChirpRevision", func(args []driver.Value) fakeResult {
+		revisions = append(revisions, database.ChirpRevision{ID: uuid.New(), ChirpID: chirp.ID, Body: chirp.Body, CreatedAt: chirp.UpdatedAt, ReplacedAt: time.Now()})
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("UpdateChirpBody", func(args []driver.Value) fakeResult {
+		chirp.Body, chirp.UpdatedAt = args[1].(string), time.Now()
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+	f.on("GetChirpRevisions", func(args []driver.Value) fakeResult {
+		var rows [][]driver.Value
+		for _, rev := range revisions {
+			rows = append(rows, row(rev.ID, rev.ChirpID, rev.Body, rev.CreatedAt, rev.ReplacedAt))
+		}
+		return fakeResult{rows: rows}
+	})
+
+	mux := cfg.routes()
+	send := func(method, path string, userID uuid.UUID, body string) *httptest.ResponseRecorder {
+		req := newJSONRequest(method, path, body)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	path := "/api/chirps/" + chirp.ID.String()
+
+	for _, body := range []string{"second draft", "final kerfuffle", "final kerfuffle"} {
+		w := send("PATCH", path, ownerID, `{"body":"`+body+`"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("edit to %q: expected 200, got %d: %s", body, w.Code, w.Body)
+		}
+	}
+	if chirp.Body != "final ****" {
+		t.Fatalf("expected the cleaned body to be stored, got %q", chirp.Body)
+	}
+	// the last edit changed nothing, so it left no revision
+	if len(revisions) != 2 || f.called("BEGIN") != 2 {
+		t.Fatalf("expected 2 revisions written in 2 transactions, got %d in %d", len(revisions), f.called("BEGIN"))
+	}
+
+	w := send("GET", path+"/history", ownerID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var history []ChirpRevision
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Body != "first draft" || history[1].Body != "second draft" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	if !history[0].CreatedAt.Equal(created) || history[1].CreatedAt.Before(history[0].ReplacedAt) {
+		t.Fatalf("unexpected revision times: %+v", history)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		userID uuid.UUID
+		body   string
+		status int
+	}{
+		{"history of someone else's chirp", "GET", path + "/history", otherID, "", http.StatusForbidden},
+		{"history of an unknown chirp", "GET", "/api/chirps/" + uuid.NewString() + "/history", ownerID, "", http.StatusNotFound},
+		{"editing someone else's chirp", "PATCH", path, otherID, `{"body":"mine now"}`, http.StatusForbidden},
+		{"editing an unknown chirp", "PATCH", "/api/chirps/" + uuid.NewString(), ownerID, `{"body":"hello"}`, http.StatusNotFound},
+		{"editing to an empty body", "PATCH", path, ownerID, `{"body":"  "}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := send(tt.method, tt.path, tt.userID, tt.body); w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.status, w.Code, w.Body)
+		}
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("rejected edits shouldn't leave revisions, got %d", len(revisions))
+	}
+}
+
+func TestSeedHandler(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.adminKey = "admin-key"
+	var bodies []string
+	f.on("CreateUser", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: uuid.New(), Email: args[0].(string), HashedPassword: args[1].(string)})}}
+	})
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		bodies = append(bodies, args[0].(string))
+		return fakeResult{rows: [][]driver.Value{chirpRow(database.Chirp{ID: uuid.New(), Body: args[0].(string), UserID: uuid.MustParse(args[1].(string))})}}
+	})
+
+	seed := func(body string) *httptest.ResponseRecorder {
+		req := newJSONRequest("POST", "/admin/seed", body)
+		req.Header.Set("Authorization", "ApiKey admin-key")
+		w := httptest.NewRecorder()
+		cfg.routes().ServeHTTP(w, req)
+		return w
+	}
+
+	w := seed(`{"users":3,"chirps_per_user":2}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var got struct {
+		Users    int      `json:"users"`
+		Chirps   int      `json:"chirps"`
+		Emails   []string `json:"emails"`
+		Password string   `json:"password"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Users != 3 || got.Chirps != 6 || len(got.Emails) != 3 || got.Password != seedPassword {
+		t.Fatalf("unexpected summary: %+v", got)
+	}
+	if f.called("CreateUser") != 3 || f.called("CreateChirp") != 6 || f.called("BEGIN") != 1 {
+		t.Fatalf("expected 3 users and 6 chirps in one transaction, got %d, %d in %d", f.called("CreateUser"), f.called("CreateChirp"), f.called("BEGIN"))
+	}
+	for _, body := range bodies {
+		if _, err := cfg.validateChirpBody(body); err != nil {
+			t.Fatalf("seeded an invalid chirp %q: %v", body, err)
+		}
+	}
+
+	if w := seed(`{"users":0}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for zero users, got %d", w.Code)
+	}
+	if w := seed(fmt.Sprintf(`{"chirps_per_user":%d}`, maxSeedChirpsPerUser+1)); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 above the chirp cap, got %d", w.Code)
+	}
+
+	// a bare POST, with no body or Content-Type, seeds the defaults
+	req := httptest.NewRequest("POST", "/admin/seed", nil)
+	req.Header.Set("Authorization", "ApiKey admin-key")
+	w = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for a bare POST, got %d: %s", w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Users != defaultSeedUsers || got.Chirps != defaultSeedUsers*defaultSeedChirpsPerUser {
+		t.Fatalf("expected the default counts, got %+v", got)
+	}
+	seeded := 3 + defaultSeedUsers
+
+	// outside dev even a valid admin key can't seed
+	cfg.platform = "production"
+	if w := seed(`{}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 outside dev, got %d", w.Code)
+	}
+	if n := f.called("CreateUser"); n != seeded {
+		t.Fatalf("expected no more users outside dev, got %d", n-seeded)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	valid := map[string]string{
+		"DB_URL":    "postgres://localhost/chirpy",
+		"PLATFORM":  "dev",
+		"SECRET":    strings.Repeat("s", minSecretLength),
+		"POLKA_KEY": "polka",
+	}
+	getenv := func(overrides map[string]string) func(string) string {
+		return func(key string) string {
+			if v, ok := overrides[key]; ok {
+				return v
+			}
+			return valid[key]
+		}
+	}
+
+	env, err := loadConfig(getenv(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if env.dbURL != valid["DB_URL"] || env.secret != valid["SECRET"] {
+		t.Fatalf("unexpected config: %+v", env)
+	}
+
+	_, err = loadConfig(getenv(map[string]string{"DB_URL": "", "POLKA_KEY": "", "SECRET": "short", "TOTP_ENCRYPTION_KEY": "short"}))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"DB_URL is required", "POLKA_KEY is required", "SECRET must be at least", "TOTP_ENCRYPTION_KEY must be at least"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "PLATFORM") {
+		t.Errorf("did not expect PLATFORM in %q", err)
+	}
+
+	older, old := strings.Repeat("o", minSecretLength), strings.Repeat("p", minSecretLength)
+	env, err = loadConfig(getenv(map[string]string{"SECONDARY_SECRETS": older + ", " + old + ","}))
+	if err != nil || !slices.Equal(env.secondarySecrets, []string{older, old}) {
+		t.Fatalf("expected two secondary secrets, got %q, %v", env.secondarySecrets, err)
+	}
+	if _, err := loadConfig(getenv(map[string]string{"SECONDARY_SECRETS": "short"})); err == nil || !strings.Contains(err.Error(), "SECONDARY_SECRETS") {
+		t.Fatalf("expected short secondary secrets to be rejected, got %v", err)
+	}
+
+	if env.tokenType != tokenTypeJWT {
+		t.Fatalf("expected JWTs by default, got %q", env.tokenType)
+	}
+	if env, err := loadConfig(getenv(map[string]string{"TOKEN_TYPE": "paseto"})); err != nil || env.tokenType != tokenTypePASETO {
+		t.Fatalf("expected PASETO tokens, got %q, %v", env.tokenType, err)
+	}
+	if _, err := loadConfig(getenv(map[string]string{"TOKEN_TYPE": "saml"})); err == nil || !strings.Contains(err.Error(), "TOKEN_TYPE") {
+		t.Fatalf("expected an unknown TOKEN_TYPE to be rejected, got %v", err)
+	}
+
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for _, path := range []string{cert, key} {
+		if err := os.WriteFile(path, []byte("pem"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	env, err = loadConfig(getenv(map[string]string{"TLS_CERT_FILE": cert, "TLS_KEY_FILE": key}))
+	if err != nil || !env.useTLS() {
+		t.Fatalf("expected TLS config to load, got %+v, %v", env, err)
+	}
+	if _, err := loadConfig(getenv(map[string]string{"TLS_CERT_FILE": cert})); err == nil || !strings.Contains(err.Error(), "must be set together") {
+		t.Fatalf("expected an error when only the cert is set, got %v", err)
+	}
+	if _, err := loadConfig(getenv(map[string]string{"TLS_CERT_FILE": cert, "TLS_KEY_FILE": filepath.Join(dir, "missing.pem")})); err == nil || !strings.Contains(err.Error(), "TLS_KEY_FILE") {
+		t.Fatalf("expected an error for a missing key file, got %v", err)
+	}
+}
+
+func TestRequireJSON(t *testing.T) {
+	handler := requireJSON(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	cases := []struct {
+		contentType string
+		wantCode    int
+	}{
+		{"application/json", http.StatusNoContent},
+		{"application/json; charset=utf-8", http.StatusNoContent},
+		{"Application/JSON", http.StatusNoContent},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/api/chirps", strings.NewReader(`{"body":"hi"}`))
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != c.wantCode {
+			t.Errorf("Content-Type %q: expected %d, got %d", c.contentType, c.wantCode, w.Code)
+		}
+	}
+}
+
+func TestReportChirpTwiceConflicts(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: uuid.New(), Body: "hello"}
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+	reported := map[string]bool{}
+	f.on("CreateChirpReport", func(args []driver.Value) fakeResult {
+		key := args[0].(string) + "/" + args[1].(string)
+		if reported[key] {
+			return fakeResult{err: &pq.Error{Code: "23505"}}
+		}
+		reported[key] = true
+		return fakeResult{rows: [][]driver.Value{row(uuid.New(), time.Now(), args[0], args[1], args[2])}}
+	})
+
+	report := func(body string) *httptest.ResponseRecorder {
+		req := newJSONRequest("POST", "/api/chirps/"+chirp.ID.String()+"/report", body)
+		req.SetPathValue("chirpID", chirp.ID.String())
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.reportChirpHandler)(w, req)
+		return w
+	}
+
+	w := report(`{"reason":"spam"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var got ChirpReport
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Reason == nil || *got.Reason != "spam" || got.ReporterID != userID {
+		t.Fatalf("unexpected report: %+v", got)
+	}
+
+	if w := report(""); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a duplicate report, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAddChirpErrorSources(t *testing.T) {
+	cases := []struct {
+		name        string
+		body        string
+		dbErr       error
+		wantCode    int
+		wantErrCode errorCode
+		wantError   string
+	}{
+		{"too long", `{"body":"` + strings.Repeat("a", 141) + `"}`, nil, http.StatusBadRequest, codeChirpTooLong, "Chirp is too long"},
+		{"empty", `{"body":""}`, nil, http.StatusBadRequest, codeChirpEmpty, "Chirp is empty"},
+		{"database failure", `{"body":"hello"}`, errors.New("connection refused"), http.StatusInternalServerError, codeInternal, internalErrorMessage},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, f := newTestConfig(t)
+			f.on("CreateChirp", func(args []driver.Value) fakeResult { return fakeResult{err: c.dbErr} })
+
+			req := newJSONRequest("POST", "/api/chirps", c.body)
+			req.Header.Set("Authorization", bearer(t, uuid.New()))
+			w := httptest.NewRecorder()
+			cfg.requireAuth(cfg.addChirpHandler)(w, req)
+
+			if w.Code != c.wantCode {
+				t.Fatalf("expected %d, got %d: %s", c.wantCode, w.Code, w.Body)
+			}
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != c.wantErrCode || body.Error.Message != c.wantError {
+				t.Fatalf("expected %s %q, got %s %q", c.wantErrCode, c.wantError, body.Error.Code, body.Error.Message)
+			}
+		})
+	}
+}
+
+func TestChirpHubFiltersByAuthor(t *testing.T) {
+	hub := newChirpHub(10)
+	author := uuid.New()
+	all, err := hub.subscribe(uuid.NullUUID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine, err := hub.subscribe(uuid.NullUUID{UUID: author, Valid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.publish(Chirp{ID: uuid.New(), UserID: uuid.New(), Body: "someone else"})
+	hub.publish(Chirp{ID: uuid.New(), UserID: author, Body: "mine"})
+
+	if len(all.chirps) != 2 {
+		t.Fatalf("expected the unfiltered subscriber to get 2 chirps, got %d", len(all.chirps))
+	}
+	if len(mine.chirps) != 1 || (<-mine.chirps).Body != "mine" {
+		t.Fatal("expected the author subscriber to get only the author's chirp")
+	}
+
+	// unsubscribing twice must not close the channel twice
+	hub.unsubscribe(all)
+	hub.unsubscribe(all)
+}
+
+func TestChirpHubDropsSlowSubscriber(t *testing.T) {
+	hub := newChirpHub(10)
+	sub, err := hub.subscribe(uuid.NullUUID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= streamBuffer; i++ {
+		hub.publish(Chirp{ID: uuid.New()})
+	}
+
+	n := 0
+	for range sub.chirps {
+		n++
+	}
+	if n != streamBuffer {
+		t.Fatalf("expected %d buffered chirps before the drop, got %d", streamBuffer, n)
+	}
+}
+
+func TestChirpStreamLimit(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.chirpHub = newChirpHub(1)
+	if _, err := cfg.chirpHub.subscribe(uuid.NullUUID{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.chirpStreamHandler(w, httptest.NewRequest("GET", "/api/chirps/stream", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 at capacity, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCORSPreflightMethods(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.cors = newCORSPolicy("https://allowed.example", "", "")
+	handler := cfg.middlewareCORS(http.NotFoundHandler())
+
+	// every method the API routes must pass a preflight by default
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+		req := httptest.NewRequest("OPTIONS", "/api/chirps", nil)
+		req.Header.Set("Origin", "https://allowed.example")
+		req.Header.Set("Access-Control-Request-Method", method)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), method) {
+			t.Errorf("%s: expected the preflight to allow it, got %d %q", method, w.Code, w.Header().Get("Access-Control-Allow-Methods"))
+		}
+	}
+
+	// and the headers the API sets must be readable from the browser
+	req := httptest.NewRequest("GET", "/api/chirps", nil)
+	req.Header.Set("Origin", "https://allowed.example")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	exposed := strings.Split(w.Header().Get("Access-Control-Expose-Headers"), ", ")
+	for _, header := range []string{"X-New-Access-Token", "Idempotent-Replayed", "X-Next-Cursor", "X-Total-Count", "X-Deleted-Count", "Location", "ETag", "Retry-After", "X-Request-Id"} {
+		if !slices.Contains(exposed, header) {
+			t.Errorf("expected %s in Access-Control-Expose-Headers, got %q", header, exposed)
+		}
+	}
+}
+
+func TestChirpStreamOrigin(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.chirpHub = newChirpHub(10)
+	cfg.cors = newCORSPolicy("https://allowed.example", "", "")
+	srv := httptest.NewServer(http.HandlerFunc(cfg.chirpStreamHandler))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	dial := func(origin string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		return websocket.DefaultDialer.Dial(wsURL, header)
+	}
+
+	for _, origin := range []string{"", "https://allowed.example", srv.URL} {
+		conn, _, err := dial(origin)
+		if err != nil {
+			t.Fatalf("origin %q: expected the handshake to succeed, got %v", origin, err)
+		}
+		conn.Close()
+	}
+
+	_, resp, err := dial("https://evil.example")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for an origin off the allow-list, got %v %v", resp, err)
+	}
+	var body errorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error.Code != codeForbidden {
+		t.Fatalf("expected a forbidden error body, got %+v (%v)", body, err)
+	}
+
+	// an accepted stream receives published chirps
+	conn, _, err := dial("https://allowed.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for deadline := time.Now().Add(time.Second); ; {
+		cfg.chirpHub.mu.Lock()
+		n := len(cfg.chirpHub.subs)
+		cfg.chirpHub.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one subscriber, got %d", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cfg.chirpHub.publish(Chirp{ID: uuid.New(), Body: "hello"})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var got Chirp
+	if err := conn.ReadJSON(&got); err != nil || got.Body != "hello" {
+		t.Fatalf("expected the published chirp, got %+v (%v)", got, err)
+	}
+}
+
+// The stream has to upgrade through every middleware main() installs,
+// since each wrapper must still let the connection be hijacked.
+func TestChirpStreamThroughMiddleware(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.chirpHub = newChirpHub(10)
+	srv := httptest.NewServer(cfg.handler())
+	defer srv.Close()
+
+	header := http.Header{"Accept-Encoding": {"gzip"}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/chirps/stream", header)
+	if err != nil {
+		t.Fatalf("expected the handshake to succeed, got %v (%v)", err, resp)
+	}
+	conn.Close()
+}
+
+func TestGetChirpsCreatedAfter(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	since := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	authorID := uuid.New()
+	chirps := []database.Chirp{
+		{ID: uuid.New(), CreatedAt: since.Add(-time.Second), UserID: authorID, Body: "before"},
+		{ID: uuid.New(), CreatedAt: since, UserID: authorID, Body: "equal"},
+		{ID: uuid.New(), CreatedAt: since.Add(time.Second), UserID: authorID, Body: "after"},
+	}
+	// created_at > $1, as in both queries
+	createdAfter := func(args []driver.Value) []database.Chirp {
+		var out []database.Chirp
+		for _, c := range chirps {
+			if c.CreatedAt.After(args[0].(time.Time)) {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	f.on("CountChirpsCreatedAfter", func(args []driver.Value) fakeResult {
+		return countRows(len(createdAfter(args)))(args)
+	})
+	f.on("GetChirpsCreatedAfter", func(args []driver.Value) fakeResult {
+		return listedChirps(createdAfter(args))(args)
+	})
+
+	w := httptest.NewRecorder()
+	cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?created_after="+since.Format(time.RFC3339)+"&author_id="+authorID.String(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got []Chirp
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Body != "after" {
+		t.Fatalf("expected only the later chirp, got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?created_after=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad timestamp, got %d", w.Code)
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.fileserverHits.Store(3)
+	handler := cfg.middlewareHTTPMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	for _, path := range []string{"/a", "/b", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	cfg.prometheusHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected Content-Type %q", got)
+	}
+	for _, want := range []string{
+		"chirpy_http_requests_total 3\n",
+		`chirpy_http_responses_total{class="2xx"} 2` + "\n",
+		`chirpy_http_responses_total{class="4xx"} 1` + "\n",
+		`chirpy_http_request_duration_seconds_bucket{le="+Inf"} 3` + "\n",
+		"chirpy_http_request_duration_seconds_count 3\n",
+		"chirpy_fileserver_hits 3\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestErrorResponseSchema(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.adminKey = "admin-key"
+	cfg.chirpHub = newChirpHub(1)
+	mux := cfg.routes()
+
+	cases := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+		wantErr  errorCode
+	}{
+		{"unauthorized", httptest.NewRequest("DELETE", "/api/users/me", nil), http.StatusUnauthorized, codeUnauthorized},
+		{"forbidden", httptest.NewRequest("POST", "/admin/reset", nil), http.StatusForbidden, codeForbidden},
+		{"unsupported media type", httptest.NewRequest("POST", "/api/login", strings.NewReader("{}")), http.StatusUnsupportedMediaType, codeUnsupportedMediaType},
+		{"validation", newJSONRequest("POST", "/api/users", `{"email":"nope"}`), http.StatusUnprocessableEntity, codeValidationFailed},
+		{"not a websocket", httptest.NewRequest("GET", "/api/chirps/stream", nil), http.StatusBadRequest, codeBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, c.req)
+
+			if w.Code != c.wantCode {
+				t.Fatalf("expected %d, got %d: %s", c.wantCode, w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Fatalf("expected application/json, got %q", got)
+			}
+			var raw map[string]map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+				t.Fatalf("error body does not match the schema: %v: %s", err, w.Body)
+			}
+			if len(raw) != 1 || raw["error"] == nil {
+				t.Fatalf("expected a single top-level error object, got %s", w.Body)
+			}
+			if raw["error"]["code"] != string(c.wantErr) {
+				t.Fatalf("expected code %q, got %v", c.wantErr, raw["error"]["code"])
+			}
+			if msg, _ := raw["error"]["message"].(string); msg == "" {
+				t.Fatalf("expected a message, got %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestChirpyRedIgnoresOtherEvents(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+
+	req := newJSONRequest("POST", "/api/polka/webhooks", `{"event":"user.downgraded","data":{"user_id":"`+uuid.NewString()+`"}}`)
+	req.Header.Set("Authorization", "ApiKey polka")
+	w := httptest.NewRecorder()
+	cfg.chirpyRedHandler(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w.Body.Len() != 0 {
+		t.Fatalf("expected an empty body, got %q", w.Body)
+	}
+}
+
+func TestRevokeAll(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	alice, bob := uuid.New(), uuid.New()
+	tokens := map[string]*database.RefreshToken{
+		"alice-1": {Token: "alice-1", UserID: alice, ExpiresAt: time.Now().Add(time.Hour)},
+		"alice-2": {Token: "alice-2", UserID: alice, ExpiresAt: time.Now().Add(time.Hour)},
+		"bob-1":   {Token: "bob-1", UserID: bob, ExpiresAt: time.Now().Add(time.Hour)},
+	}
+
+	getToken := func(args []driver.Value) fakeResult {
+		rt, ok := tokens[args[0].(string)]
+		if !ok {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{row(rt.Token, time.Now(), time.Now(), rt.UserID, rt.ExpiresAt, rt.RevokedAt)}}
+	}
+	f.on("GetRefreshToken", getToken)
+	f.on("GetValidRefreshToken", validRefreshTokens(getToken))
+	f.on("RevokeAllUserRefreshTokens", func(args []driver.Value) fakeResult {
+		for _, rt := range tokens {
+			if rt.UserID.String() == args[0] && !rt.RevokedAt.Valid {
+				rt.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			}
+		}
+		return fakeResult{}
+	})
+	f.on("GetUserByID", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: uuid.MustParse(args[0].(string))})}}
+	})
+
+	refresh := func(token string) int {
+		req := httptest.NewRequest("POST", "/api/refresh", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		cfg.refreshHandler(w, req)
+		return w.Code
+	}
+
+	req := httptest.NewRequest("POST", "/api/revoke-all", nil)
+	req.Header.Set("Authorization", bearer(t, alice))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.revokeAllHandler)(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	for _, token := range []string{"alice-1", "alice-2"} {
+		if code := refresh(token); code != http.StatusUnauthorized {
+			t.Errorf("expected %s to be revoked, got %d", token, code)
+		}
+	}
+	if code := refresh("bob-1"); code != http.StatusOK {
+		t.Errorf("expected another user's token to keep working, got %d", code)
+	}
+}
+
+func TestAddUserCaseInsensitiveConflict(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	// an exact-match uniqueness check, so the conflict only shows up if the
+	// handler normalizes the email before it reaches the database
+	seen := map[string]bool{}
+	f.on("CreateUser", func(args []driver.Value) fakeResult {
+		key := args[0].(string)
+		if seen[key] {
+			return fakeResult{err: &pq.Error{Code: "23505"}}
+		}
+		seen[key] = true
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: uuid.New(), Email: args[0].(string)})}}
+	})
+
+	signup := func(email string) int {
+		w := httptest.NewRecorder()
+		cfg.addUserHandler(w, newJSONRequest("POST", "/api/users", `{"email":"`+email+`","password":"hunter2"}`))
+		return w.Code
+	}
+
+	if code := signup("Alice@x.com"); code != http.StatusCreated {
+		t.Fatalf("expected 201 for the first signup, got %d", code)
+	}
+	if code := signup(" alice@X.COM "); code != http.StatusConflict {
+		t.Fatalf("expected 409 for a differently-cased signup, got %d", code)
+	}
+}
+
+func TestGetChirpsSortBy(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	// created in order a, b, c; edited in order c, a, b
+	chirps := []database.Chirp{
+		{ID: uuid.New(), CreatedAt: base, UpdatedAt: base.Add(2 * time.Hour), Body: "a"},
+		{ID: uuid.New(), CreatedAt: base.Add(time.Minute), UpdatedAt: base.Add(3 * time.Hour), Body: "b"},
+		{ID: uuid.New(), CreatedAt: base.Add(2 * time.Minute), UpdatedAt: base.Add(time.Hour), Body: "c"},
+	}
+	f.on("CountChirps", countRows(len(chirps)))
+	f.on("GetChirps", listedChirps(chirps))
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"", "abc"},
+		{"?sort=asc", "abc"},
+		{"?sort=desc", "cba"},
+		{"?sort_by=created_at", "abc"},
+		{"?sort_by=created_at&sort=desc", "cba"},
+		{"?sort_by=updated_at", "cab"},
+		{"?sort_by=updated_at&sort=asc", "cab"},
+		{"?sort_by=updated_at&sort=desc", "bac"},
+	}
+	for _, c := range cases {
+		t.Run(c.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps"+c.query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+			}
+			var got []Chirp
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			order := ""
+			for _, chirp := range got {
+				order += chirp.Body
+			}
+			if order != c.want {
+				t.Fatalf("expected order %q, got %q", c.want, order)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps?sort_by=body%3BDROP%20TABLE%20chirps", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown sort_by, got %d", w.Code)
+	}
+	if n := f.called("GetChirps"); n != len(cases) {
+		t.Fatalf("expected the invalid sort_by to be rejected before querying, got %d calls", n)
+	}
+}
+
+func TestGetChirpsSortDirection(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	var chirps []database.Chirp
+	for i, body := range []string{"a", "b", "c"} {
+		at := base.Add(time.Duration(i) * time.Minute)
+		chirps = append(chirps, database.Chirp{ID: uuid.New(), CreatedAt: at, UpdatedAt: at, Body: body})
+	}
+	f.on("CountChirps", countRows(len(chirps)))
+	f.on("GetChirps", listedChirps(chirps))
+
+	order := func(query string) (int, string) {
+		w := httptest.NewRecorder()
+		cfg.getChirpsHandler(w, httptest.NewRequest("GET", "/api/chirps"+query, nil))
+		var got []Chirp
+		json.Unmarshal(w.Body.Bytes(), &got)
+		order := ""
+		for _, chirp := range got {
+			order += chirp.Body
+		}
+		return w.Code, order
+	}
+
+	cases := []struct {
+		query       string
+		defaultDesc bool
+		want        string
+	}{
+		{"", false, "abc"},
+		{"?sort=", false, "abc"},
+		{"?sort=desc", false, "cba"},
+		{"?sort=DESC", false, "cba"},
+		{"?sort=Asc", false, "abc"},
+		{"", true, "cba"},
+		{"?sort=asc", true, "abc"},
+	}
+	for _, c := range cases {
+		cfg.defaultSortDesc = c.defaultDesc
+		if code, got := order(c.query); code != http.StatusOK || got != c.want {
+			t.Errorf("%q (default desc %t): expected 200 %q, got %d %q", c.query, c.defaultDesc, c.want, code, got)
+		}
+	}
+
+	calls := f.called("GetChirps")
+	for _, query := range []string{"?sort=descending", "?sort=ascending", "?sort=up"} {
+		if code, _ := order(query); code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, code)
+		}
+	}
+	if n := f.called("GetChirps"); n != calls {
+		t.Fatalf("expected an invalid sort to be rejected before querying, got %d calls", n-calls)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	hash, err := auth.HashPassword("current-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := uuid.New()
+
+	cases := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"wrong current password", `{"current_password":"guess","new_password":"brand-new-password"}`, http.StatusUnauthorized},
+		{"weak new password", `{"current_password":"current-password","new_password":"short"}`, http.StatusUnprocessableEntity},
+		{"success", `{"current_password":"current-password","new_password":"brand-new-password"}`, http.StatusNoContent},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, f := newTestConfig(t)
+			f.on("GetUserByID", func(args []driver.Value) fakeResult {
+				return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, Email: "a@example.com", HashedPassword: hash})}}
+			})
+			var stored string
+			f.on("SetUserPassword", func(args []driver.Value) fakeResult {
+				stored = args[1].(string)
+				return fakeResult{}
+			})
+			f.on("RevokeAllUserRefreshTokens", func(args []driver.Value) fakeResult { return fakeResult{} })
+
+			req := newJSONRequest("POST", "/api/users/password", c.body)
+			req.Header.Set("Authorization", bearer(t, userID))
+			w := httptest.NewRecorder()
+			cfg.requireAuth(cfg.changePasswordHandler)(w, req)
+
+			if w.Code != c.wantCode {
+				t.Fatalf("expected %d, got %d: %s", c.wantCode, w.Code, w.Body)
+			}
+			if c.wantCode != http.StatusNoContent {
+				if f.called("SetUserPassword") != 0 {
+					t.Fatal("expected the password to be left alone")
+				}
+				return
+			}
+			if auth.CheckPasswordHash("brand-new-password", stored) != nil {
+				t.Fatal("expected the new password's hash to be stored")
+			}
+			if f.called("RevokeAllUserRefreshTokens") != 1 {
+				t.Fatal("expected refresh tokens to be revoked")
+			}
+		})
+	}
+}
+
+func TestUpdateEmailOnly(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	userID := uuid.New()
+	f.on("SetUserEmail", func(args []driver.Value) fakeResult { return fakeResult{} })
+	f.on("GetUserByID", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{userRow(database.User{ID: userID, Email: "new@example.com"})}}
+	})
+
+	req := newJSONRequest("PUT", "/api/users", `{"email":"New@example.com"}`)
+	req.Header.Set("Authorization", bearer(t, userID))
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.authHandler)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if f.called("SetUserEmail") != 1 || f.called("RevokeAllUserRefreshTokens") != 0 {
+		t.Fatalf("expected only the email to change, got calls %v", f.calls)
+	}
+
+	// passwords change only through POST /api/users/password, which checks
+	// the current one
+	req = newJSONRequest("PUT", "/api/users", `{"email":"new@example.com","password":"taken-over"}`)
+	req.Header.Set("Authorization", bearer(t, userID))
+	w = httptest.NewRecorder()
+	cfg.requireAuth(cfg.authHandler)(w, req)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "/api/users/password") {
+		t.Fatalf("expected 422 pointing at /api/users/password, got %d: %s", w.Code, w.Body)
+	}
+	if f.called("SetUserEmail") != 1 {
+		t.Fatalf("expected nothing to change, got calls %v", f.calls)
+	}
+}
+
+func TestChirpQuota(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.chirpQuota = chirpQuota{limit: 3, window: 10 * time.Minute}
+	userID := uuid.New()
+
+	var posted []time.Time
+	f.on("CountRecentChirps", func(args []driver.Value) fakeResult {
+		since := args[1].(time.Time)
+		var n int64
+		var oldest any
+		for _, at := range posted {
+			if at.After(since) {
+				n++
+				if oldest == nil {
+					oldest = at
+				}
+			}
+		}
+		return fakeResult{rows: [][]driver.Value{row(n, oldest)}}
+	})
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		posted = append(posted, time.Now())
+		return fakeResult{rows: [][]driver.Value{chirpRow(database.Chirp{ID: uuid.New(), UserID: userID, Body: args[0].(string)})}}
+	})
+
+	post := func() *httptest.ResponseRecorder {
+		req := newJSONRequest("POST", "/api/chirps", `{"body":"hello"}`)
+		req.Header.Set("Authorization", bearer(t, userID))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.addChirpHandler)(w, req)
+		return w
+	}
+
+	for i := 0; i < cfg.chirpQuota.limit; i++ {
+		if w := post(); w.Code != http.StatusCreated {
+			t.Fatalf("chirp %d: expected 201, got %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+
+	w := post()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 past the cap, got %d: %s", w.Code, w.Body)
+	}
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 600 {
+		t.Fatalf("expected a Retry-After within the window, got %q", w.Header().Get("Retry-After"))
+	}
+	if n := f.called("CreateChirp"); n != cfg.chirpQuota.limit {
+		t.Fatalf("expected %d inserts, got %d", cfg.chirpQuota.limit, n)
+	}
+}
+
+func TestMissingBearerTokenIsUnauthorized(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	handlers := map[string]struct {
+		handler http.HandlerFunc
+		body    string
+	}{
+		"add chirp": {cfg.requireAuth(cfg.addChirpHandler), `{"body":"hello"}`},
+		"batch":     {cfg.requireAuth(cfg.addChirpsBatchHandler), `[{"body":"hello"}]`},
+		"refresh":   {cfg.refreshHandler, ""},
+		"revoke":    {cfg.revokeHandler, ""},
+	}
+	for name, h := range handlers {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.handler(w, newJSONRequest("POST", "/", h.body))
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestGetSoftDeletedChirpAsOwner(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	ownerID := uuid.New()
+	chirp := database.Chirp{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now(), UserID: ownerID, Body: "hello", DeletedAt: sql.NullTime{Time: time.Now(), Valid: true}}
+	f.on("GetChirp", func(args []driver.Value) fakeResult {
+		// mirror the query's filter: deleted rows are visible to admins
+		// asking for them and to their owner
+		if args[1] != true && args[2] != ownerID.String() {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(chirp)}}
+	})
+
+	cases := []struct {
+		name     string
+		auth     string
+		wantCode int
+	}{
+		{"owner", bearer(t, ownerID), http.StatusOK},
+		{"stranger", bearer(t, uuid.New()), http.StatusNotFound},
+		{"anonymous", "", http.StatusNotFound},
+		{"invalid token", "Bearer not-a-jwt", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/chirps/"+chirp.ID.String(), nil)
+			req.SetPathValue("chirpID", chirp.ID.String())
+			if c.auth != "" {
+				req.Header.Set("Authorization", c.auth)
+			}
+			w := httptest.NewRecorder()
+			cfg.getChirpHandler(w, req)
+			if w.Code != c.wantCode {
+				t.Fatalf("expected %d, got %d: %s", c.wantCode, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestDeleteAuthorChirps(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	alice, bob := uuid.New(), uuid.New()
+	var chirps []*database.Chirp
+	for i, owner := range []uuid.UUID{alice, alice, alice, bob} {
+		chirps = append(chirps, &database.Chirp{ID: uuid.New(), UserID: owner, Body: fmt.Sprintf("chirp %d", i)})
+	}
+	f.on("DeleteChirpsByAuthor", func(args []driver.Value) fakeResult {
+		var n int64
+		for _, c := range chirps {
+			if c.UserID.String() == args[0] && !c.DeletedAt.Valid {
+				c.DeletedAt = sql.NullTime{Time: time.Now(), Valid: true}
+				n++
+			}
+		}
+		return fakeResult{rowsAffected: n}
+	})
+
+	del := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/api/chirps"+query, nil)
+		req.Header.Set("Authorization", bearer(t, alice))
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.deleteAuthorChirpsHandler)(w, req)
+		return w
+	}
+
+	if w := del("?author=" + bob.String()); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another user's chirps, got %d: %s", w.Code, w.Body)
+	}
+	if w := del(""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without an author, got %d: %s", w.Code, w.Body)
+	}
+
+	w := del("?author=me")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Deleted-Count"); got != "3" {
+		t.Fatalf("expected X-Deleted-Count 3, got %q", got)
+	}
+	for _, c := range chirps {
+		if gone := c.DeletedAt.Valid; gone != (c.UserID == alice) {
+			t.Errorf("%s (owner %s): deleted = %v", c.Body, c.UserID, gone)
+		}
+	}
+}
+
+func TestEmbeddedStaticIndex(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.staticEmbedded = true
+	// the embedded copy must not depend on the working directory
+	cfg.staticDir = t.TempDir()
+	mux := cfg.routes()
+
+	want, err := os.ReadFile(filepath.Join("public", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/app/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w.Body.String() != string(want) {
+		t.Fatalf("expected the embedded index.html, got %q", w.Body)
+	}
+}
+
+func TestRequireAuthRenewsNearExpiry(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.tokenRenewWindow = 10 * time.Minute
+	cfg.maxSessionAge = 24 * time.Hour
+	cfg.tokenLeeway = time.Minute
+	userID := uuid.New()
+	loggedIn := true
+	f.on("UserHasValidRefreshToken", func(args []driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{row(loggedIn)}}
+	})
+
+	var seen uuid.UUID
+	handler := cfg.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestUserID(r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	authTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	cases := []struct {
+		name      string
+		session   auth.Session
+		lifetime  time.Duration
+		loggedOut bool
+		wantRenew bool
+	}{
+		{"fresh token", auth.Session{UserID: userID, AuthTime: authTime}, time.Hour, false, false},
+		{"near expiry", auth.Session{UserID: userID, AuthTime: authTime}, 5 * time.Minute, false, true},
+		{"expired within the leeway", auth.Session{UserID: userID, AuthTime: authTime}, -30 * time.Second, false, false},
+		{"past the session maximum", auth.Session{UserID: userID, AuthTime: time.Now().Add(-25 * time.Hour)}, 5 * time.Minute, false, false},
+		{"logged out everywhere", auth.Session{UserID: userID, AuthTime: authTime}, 5 * time.Minute, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			token, err := cfg.tokens().Renew(c.session, c.lifetime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loggedIn = !c.loggedOut
+			seen = uuid.Nil
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+			}
+			if seen != userID {
+				t.Fatalf("expected user %s in the request context, got %s", userID, seen)
+			}
+
+			fresh := w.Header().Get(newAccessTokenHeader)
+			if !c.wantRenew {
+				if fresh != "" {
+					t.Fatal("expected no renewal")
+				}
+				return
+			}
+			renewed, err := cfg.tokens().ParseSession(fresh)
+			if err != nil {
+				t.Fatalf("renewed token is invalid: %v", err)
+			}
+			if renewed.UserID != userID {
+				t.Fatalf("expected a token for %s, got %s", userID, renewed.UserID)
+			}
+			// no longer-lived than the token it replaces, and still the
+			// same session
+			if got := renewed.ExpiresAt.Sub(renewed.IssuedAt); got > c.lifetime {
+				t.Fatalf("expected the renewed lifetime capped at %s, got %s", c.lifetime, got)
+			}
+			if !renewed.AuthTime.Equal(authTime) {
+				t.Fatalf("expected auth_time %s carried over, got %s", authTime, renewed.AuthTime)
+			}
+		})
+	}
+}
+
+func TestRequireAuthRejects(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	userID := uuid.New()
+	token := func(secret string, lifetime time.Duration) string {
+		tok, err := auth.MakeJWT(userID, secret, lifetime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + tok
+	}
+
+	cases := []struct {
+		name   string
+		header string
+	}{
+		{"missing header", ""},
+		{"wrong scheme", "ApiKey " + testSecret},
+		{"malformed token", "Bearer not-a-jwt"},
+		{"wrong secret", token("some-other-secret", time.Hour)},
+		{"expired", token(testSecret, -time.Minute)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			called := false
+			handler := cfg.requireAuth(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if c.header != "" {
+				req.Header.Set("Authorization", c.header)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d: %s", w.Code, w.Body)
+			}
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Code != codeUnauthorized {
+				t.Fatalf("expected an unauthorized error body, got %s", w.Body)
+			}
+			if called {
+				t.Fatal("expected the protected handler not to run")
+			}
+		})
+	}
+}
+
+func TestUserIDFromContext(t *testing.T) {
+	if _, ok := userIDFromContext(context.Background()); ok {
+		t.Fatal("expected no user in an empty context")
+	}
+	userID := uuid.New()
+	got, ok := userIDFromContext(withUserID(context.Background(), userID))
+	if !ok || got != userID {
+		t.Fatalf("expected %s, got %s (ok=%v)", userID, got, ok)
+	}
+}
+
+func TestAddChirpIdempotencyKey(t *testing.T) {
+	cfg, f := newTestConfig(t)
+	cfg.idempotencyKeyTTL = time.Hour
+	userID := uuid.New()
+
+	type stored struct {
+		chirp database.Chirp
+		at    time.Time
+	}
+	keys := map[string]stored{}
+	chirps := map[string]database.Chirp{}
+	f.on("CreateChirp", func(args []driver.Value) fakeResult {
+		c := database.Chirp{ID: uuid.New(), UserID: userID, Body: args[0].(string)}
+		chirps[c.ID.String()] = c
+		return fakeResult{rows: [][]driver.Value{chirpRow(c)}}
+	})
+	f.on("SaveIdempotencyKey", func(args []driver.Value) fakeResult {
+		k := args[0].(string) + "/" + args[1].(string)
+		if prev, ok := keys[k]; ok && prev.at.After(args[3].(time.Time)) {
+			return fakeResult{rowsAffected: 0}
+		}
+		keys[k] = stored{chirps[args[2].(string)], time.Now()}
+		return fakeResult{rowsAffected: 1}
+	})
+	f.on("GetIdempotentChirp", func(args []driver.Value) fakeResult {
+		s, ok := keys[args[0].(string)+"/"+args[1].(string)]
+		if !ok || !s.at.After(args[2].(time.Time)) {
+			return fakeResult{}
+		}
+		return fakeResult{rows: [][]driver.Value{chirpRow(s.chirp)}}
+	})
+
+	post := func(user uuid.UUID, key string) (*httptest.ResponseRecorder, Chirp) {
+		req := newJSONRequest("POST", "/api/chirps", `{"body":"hello"}`)
+		req.Header.Set("Authorization", bearer(t, user))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		cfg.requireAuth(cfg.addChirpHandler)(w, req)
+		var chirp Chirp
+		json.Unmarshal(w.Body.Bytes(), &chirp)
+		return w, chirp
+	}
+
+	w, first := post(userID, "abc")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("first request: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if f.called("SaveIdempotencyKey") != 1 {
+		t.Fatal("expected the key to be stored with the new chirp")
+	}
+
+	w, again := post(userID, "abc")
+	if w.Code != http.StatusOK {
+		t.Fatalf("repeat: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if again.ID != first.ID {
+		t.Fatalf("repeat: expected chirp %s, got %s", first.ID, again.ID)
+	}
+	if w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("repeat: expected Idempotent-Replayed header")
+	}
+	if n := f.called("CreateChirp"); n != 1 {
+		t.Fatalf("expected one insert, got %d", n)
+	}
+
+	// keys are scoped per user
+	if w, _ := post(uuid.New(), "abc"); w.Code != http.StatusCreated {
+		t.Fatalf("other user: expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	// an expired key creates a fresh chirp
+	k := userID.String() + "/abc"
+	keys[k] = stored{keys[k].chirp, time.Now().Add(-2 * time.Hour)}
+	w, fresh := post(userID, "abc")
+	if w.Code != http.StatusCreated || fresh.ID == first.ID {
+		t.Fatalf("expired key: expected a new chirp, got %d: %s", w.Code, w.Body)
+	}
+
+	if w, _ := post(userID, strings.Repeat("k", maxIdempotencyKeyLength+1)); w.Code != http.StatusBadRequest {
+		t.Fatalf("long key: expected 400, got %d", w.Code)
+	}
+}
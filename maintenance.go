@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultMaintenanceRetryAfter is how long clients are told to wait while
+// the API is in maintenance mode, unless MAINTENANCE_RETRY_AFTER says
+// otherwise.
+const defaultMaintenanceRetryAfter = time.Minute
+
+// maintenanceExempt lists the routes that keep working in maintenance
+// mode: the health check, so load balancers don't pull the instance, and
+// the toggle itself, so maintenance can be ended.
+var maintenanceExempt = map[string]bool{
+	"GET /api/healthz":        true,
+	"POST /admin/maintenance": true,
+}
+
+// middlewareMaintenance answers 503 to everything but maintenanceExempt
+// while cfg.maintenance is set.
+func (cfg *apiConfig) middlewareMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.maintenance.Load() || maintenanceExempt[r.Method+" "+r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(cfg.maintenanceRetry.Seconds()))))
+		returnError(w, http.StatusServiceUnavailable, errors.New("the API is down for maintenance"))
+	})
+}
+
+// maintenanceHandler turns maintenance mode on or off with
+// {"enabled": true|false}. The setting lives in memory only, so a restart
+// always comes back up serving.
+func (cfg *apiConfig) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.requireAdmin(r); err != nil {
+		returnError(w, http.StatusForbidden, err)
+		return
+	}
+
+	type parameters struct {
+		Enabled *bool `json:"enabled"`
+	}
+	params := parameters{}
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
+	if params.Enabled == nil {
+		returnError(w, http.StatusBadRequest, errors.New("enabled is required"))
+		return
+	}
+
+	cfg.maintenance.Store(*params.Enabled)
+	respondJSON(w, http.StatusOK, map[string]bool{"maintenance": *params.Enabled})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram; the same defaults the Prometheus client libraries use.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var statusClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// httpMetrics aggregates request counts and latencies for /metrics. It is
+// safe for concurrent use.
+type httpMetrics struct {
+	mu            sync.Mutex
+	total         int64
+	byClass       map[string]int64
+	bucketCounts  []int64
+	durationSum   float64
+	durationCount int64
+}
+
+func (m *httpMetrics) observe(status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byClass == nil {
+		m.byClass = map[string]int64{}
+		m.bucketCounts = make([]int64, len(durationBuckets))
+	}
+
+	m.total++
+	if status >= 100 && status < 600 {
+		m.byClass[statusClasses[status/100-1]]++
+	}
+
+	seconds := d.Seconds()
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			m.bucketCounts[i]++
+		}
+	}
+	m.durationSum += seconds
+	m.durationCount++
+}
+
+// writeTo renders the metrics in the Prometheus text exposition format.
+func (m *httpMetrics) writeTo(w io.Writer, fileserverHits int32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP chirpy_http_requests_total Total HTTP requests served.")
+	fmt.Fprintln(w, "# TYPE chirpy_http_requests_total counter")
+	fmt.Fprintf(w, "chirpy_http_requests_total %d\n", m.total)
+
+	fmt.Fprintln(w, "# HELP chirpy_http_responses_total HTTP responses by status class.")
+	fmt.Fprintln(w, "# TYPE chirpy_http_responses_total counter")
+	for _, class := range statusClasses {
+		fmt.Fprintf(w, "chirpy_http_responses_total{class=%q} %d\n", class, m.byClass[class])
+	}
+
+	fmt.Fprintln(w, "# HELP chirpy_http_request_duration_seconds HTTP request latency.")
+	fmt.Fprintln(w, "# TYPE chirpy_http_request_duration_seconds histogram")
+	for i, le := range durationBuckets {
+		var n int64
+		if m.bucketCounts != nil {
+			n = m.bucketCounts[i]
+		}
+		fmt.Fprintf(w, "chirpy_http_request_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(le, 'g', -1, 64), n)
+	}
+	fmt.Fprintf(w, "chirpy_http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(w, "chirpy_http_request_duration_seconds_sum %s\n", strconv.FormatFloat(m.durationSum, 'g', -1, 64))
+	fmt.Fprintf(w, "chirpy_http_request_duration_seconds_count %d\n", m.durationCount)
+
+	fmt.Fprintln(w, "# HELP chirpy_fileserver_hits Requests served by the /app/ file server.")
+	fmt.Fprintln(w, "# TYPE chirpy_fileserver_hits gauge")
+	fmt.Fprintf(w, "chirpy_fileserver_hits %d\n", fileserverHits)
+}
+
+func (cfg *apiConfig) middlewareHTTPMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		cfg.httpMetrics.observe(rec.status, time.Since(start))
+	})
+}
+
+// prometheusHandler serves /metrics for scraping; /admin/metrics stays the
+// human-readable page.
+func (cfg *apiConfig) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	cfg.httpMetrics.writeTo(w, cfg.fileserverHits.Load())
+}
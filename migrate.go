@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+
+	"github.com/pressly/goose/v3"
+)
+
+//go:embed sql/schema/*.sql
+var embeddedMigrations embed.FS
+
+// migrationsDir is where the goose files sit inside embeddedMigrations.
+const migrationsDir = "sql/schema"
+
+// migrationLockID keys the advisory lock that stops two instances starting
+// together from applying the same migration twice.
+const migrationLockID = 72_686_921
+
+// embeddedMigrationSet returns the embedded migrations, ordered by version.
+func embeddedMigrationSet() (goose.Migrations, error) {
+	goose.SetBaseFS(embeddedMigrations)
+	return goose.CollectMigrations(migrationsDir, 0, goose.MaxVersion)
+}
+
+// runMigrations applies every embedded migration the database hasn't seen
+// with goose, so the goose CLI and startup can be used on the same database.
+// An advisory lock held for the whole run keeps instances that start
+// together from racing.
+func runMigrations(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	goose.SetBaseFS(embeddedMigrations)
+	if err := goose.SetDialect("postgres"); err != nil {
+		return err
+	}
+	return goose.UpContext(ctx, db, migrationsDir)
+}
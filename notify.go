@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type chirpyRedEvent struct {
+	UserID      uuid.UUID `json:"user_id"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+}
+
+// chirpyRedNotifier forwards Chirpy Red status changes to an outbound webhook.
+// Deliveries happen on a single background worker so a slow sink never holds
+// up the request that triggered them.
+type chirpyRedNotifier struct {
+	url    string
+	client *http.Client
+	events chan chirpyRedEvent
+}
+
+func newChirpyRedNotifier(url string, timeout time.Duration, queueSize int) *chirpyRedNotifier {
+	n := &chirpyRedNotifier{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		events: make(chan chirpyRedEvent, queueSize),
+	}
+	go n.run()
+	return n
+}
+
+// notify queues ev for delivery. It never blocks: when the queue is full the
+// event is dropped and logged. A nil notifier ignores every event.
+func (n *chirpyRedNotifier) notify(ev chirpyRedEvent) {
+	if n == nil {
+		return
+	}
+	select {
+	case n.events <- ev:
+	default:
+		log.Printf("chirpy red sink: queue full, dropping event for user %s", ev.UserID)
+	}
+}
+
+func (n *chirpyRedNotifier) run() {
+	for ev := range n.events {
+		if err := n.send(ev); err != nil {
+			log.Printf("chirpy red sink: delivering event for user %s: %v", ev.UserID, err)
+		}
+	}
+}
+
+func (n *chirpyRedNotifier) send(ev chirpyRedEvent) error {
+	dat, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
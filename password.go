@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/jsleep/learngo_httpserver/internal/auth"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// changePasswordHandler replaces the authenticated user's password after
+// checking the current one, then revokes every refresh token so other
+// sessions have to log in again.
+func (cfg *apiConfig) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	params := parameters{}
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
+
+	userID := requestUserID(r)
+
+	fe := fieldErrors{}
+	if params.CurrentPassword == "" {
+		fe.add("current_password", "required")
+	}
+	validateNewPassword(fe, "new_password", params.NewPassword, params.CurrentPassword)
+	if fe.any() {
+		returnValidationErrors(w, fe)
+		return
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	dbUser, err := cfg.db.GetUserByID(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		returnError(w, http.StatusUnauthorized, errors.New("user not found"))
+		return
+	}
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	if auth.CheckPasswordHash(params.CurrentPassword, dbUser.HashedPassword) != nil {
+		returnError(w, http.StatusUnauthorized, errors.New("current password is incorrect"))
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.NewPassword)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = cfg.withTx(ctx, func(q *database.Queries) error {
+		err := q.SetUserPassword(ctx, database.SetUserPasswordParams{ID: userID, HashedPassword: hashedPassword})
+		if err != nil {
+			return err
+		}
+		return q.RevokeAllUserRefreshTokens(ctx, userID)
+	})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserProfile is the public view of a user: nothing that identifies them
+// beyond their ID, so it can be shown to anyone.
+type UserProfile struct {
+	ID          uuid.UUID `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	ChirpCount  int64     `json:"chirp_count"`
+}
+
+// getUserProfileHandler serves GET /api/users/{userID}/profile. Deleted
+// chirps aren't counted.
+func (cfg *apiConfig) getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	dbUser, err := cfg.readDB.GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			returnError(w, http.StatusNotFound, errors.New("user not found"))
+			return
+		}
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	stats, err := cfg.readDB.GetChirpStats(ctx, uuid.NullUUID{UUID: userID, Valid: true})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, UserProfile{
+		ID:          dbUser.ID,
+		CreatedAt:   dbUser.CreatedAt,
+		IsChirpyRed: dbUser.IsChirpyRed,
+		ChirpCount:  stats.Total,
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// getChirpRepliesHandler lists the direct replies to a chirp, oldest first.
+// The parent must be visible to the caller under the same rules as
+// GET /api/chirps/{chirpID}.
+func (cfg *apiConfig) getChirpRepliesHandler(w http.ResponseWriter, r *http.Request) {
+	chirpId, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	fields, err := parseChirpFields(r)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	withDeleted, err := cfg.includeDeleted(r)
+	if err != nil {
+		returnError(w, http.StatusForbidden, err)
+		return
+	}
+
+	viewer, err := cfg.optionalViewer(r)
+	if err != nil {
+		returnError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	if _, err := cfg.readDB.GetChirp(ctx, database.GetChirpParams{ID: chirpId, IncludeDeleted: withDeleted, ViewerID: viewer}); err != nil {
+		returnDBError(w, ctx, http.StatusNotFound, err)
+		return
+	}
+
+	dbChirps, err := cfg.readDB.GetChirpReplies(ctx, database.GetChirpRepliesParams{
+		ParentID:       uuid.NullUUID{UUID: chirpId, Valid: true},
+		IncludeDeleted: withDeleted,
+	})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	chirps := make([]Chirp, len(dbChirps))
+	for i, dbChirp := range dbChirps {
+		chirps[i] = chirpFromDB(dbChirp)
+	}
+	if err := cfg.attachCounts(ctx, chirps, viewer); err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondChirps(w, http.StatusOK, chirps, fields)
+}
+
+// attachCounts fills in the like and reply aggregates every chirp read
+// returns.
+func (cfg *apiConfig) attachCounts(ctx context.Context, chirps []Chirp, viewer uuid.NullUUID) error {
+	if err := cfg.attachLikes(ctx, chirps, viewer); err != nil {
+		return err
+	}
+	return cfg.attachReplyCounts(ctx, chirps)
+}
+
+// attachReplyCounts fills in reply_count for each chirp. Deleted replies
+// aren't counted.
+func (cfg *apiConfig) attachReplyCounts(ctx context.Context, chirps []Chirp) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(chirps))
+	for i, c := range chirps {
+		ids[i] = c.ID
+	}
+
+	rows, err := cfg.readDB.GetReplyCounts(ctx, ids)
+	if err != nil {
+		return err
+	}
+	counts := make(map[uuid.UUID]int64, len(rows))
+	for _, row := range rows {
+		counts[row.ChirpID] = row.ReplyCount
+	}
+
+	for i := range chirps {
+		chirps[i].ReplyCount = counts[chirps[i].ID]
+	}
+	return nil
+}
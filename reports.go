@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+const maxReportReasonLength = 500
+
+type ChirpReport struct {
+	ID         uuid.UUID `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ChirpID    uuid.UUID `json:"chirp_id"`
+	ReporterID uuid.UUID `json:"reporter_id"`
+	Reason     *string   `json:"reason"`
+}
+
+type ReportedChirp struct {
+	Chirp
+	ReportCount int64 `json:"report_count"`
+}
+
+// reportChirpHandler records that the authenticated user flagged a chirp
+// for moderation. Each user may report a given chirp once.
+func (cfg *apiConfig) reportChirpHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Reason string `json:"reason"`
+	}
+
+	chirpId, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	userID := requestUserID(r)
+
+	// the reason is optional, and so is the body
+	params := parameters{}
+	if r.ContentLength != 0 && !cfg.decodeJSON(w, r, &params) {
+		return
+	}
+	reason := sql.NullString{}
+	if s := strings.TrimSpace(params.Reason); s != "" {
+		if utf8.RuneCountInString(s) > maxReportReasonLength {
+			returnError(w, http.StatusBadRequest, fmt.Errorf("reason may be at most %d characters", maxReportReasonLength))
+			return
+		}
+		reason = sql.NullString{String: s, Valid: true}
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	if _, err := cfg.db.GetChirp(ctx, database.GetChirpParams{ID: chirpId}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			returnError(w, http.StatusNotFound, errors.New("chirp not found"))
+			return
+		}
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	dbReport, err := cfg.db.CreateChirpReport(ctx, database.CreateChirpReportParams{ChirpID: chirpId, ReporterID: userID, Reason: reason})
+	if err != nil {
+		if isUniqueViolation(err) {
+			returnError(w, http.StatusConflict, errors.New("you have already reported this chirp"))
+			return
+		}
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	report := ChirpReport{
+		ID:         dbReport.ID,
+		CreatedAt:  dbReport.CreatedAt,
+		ChirpID:    dbReport.ChirpID,
+		ReporterID: dbReport.ReporterID,
+	}
+	if dbReport.Reason.Valid {
+		report.Reason = &dbReport.Reason.String
+	}
+
+	respondJSON(w, http.StatusCreated, report)
+}
+
+// reportedChirpsHandler lists reported chirps, most-reported first.
+func (cfg *apiConfig) reportedChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.requireAdmin(r); err != nil {
+		returnError(w, http.StatusForbidden, err)
+		return
+	}
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	rows, err := cfg.db.GetReportedChirps(ctx, database.GetReportedChirpsParams{Limit: limit, Offset: offset})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	chirps := make([]ReportedChirp, len(rows))
+	for i, row := range rows {
+		chirps[i] = ReportedChirp{Chirp: chirpFromDB(row.Chirp), ReportCount: row.ReportCount}
+	}
+
+	respondJSON(w, http.StatusOK, chirps)
+}
+
+// adminDeleteChirpHandler soft-deletes any chirp, whoever wrote it, so
+// moderators can take down abuse found through reportedChirpsHandler. Deleting an already deleted chirp
+// succeeds. Admins share a key and so have no identity; the deletion is
+// logged with the request ID for the audit trail.
+func (cfg *apiConfig) adminDeleteChirpHandler(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.requireAdmin(r); err != nil {
+		returnError(w, http.StatusForbidden, err)
+		return
+	}
+
+	chirpId, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	deleted, err := cfg.db.DeleteChirp(ctx, chirpId)
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	cfg.chirpCache.forget(chirpId)
+	if deleted == 0 {
+		if _, err := cfg.db.GetChirp(ctx, database.GetChirpParams{ID: chirpId, IncludeDeleted: true}); err != nil {
+			returnDBError(w, ctx, http.StatusNotFound, err)
+			return
+		}
+	} else {
+		log.Printf("admin deleted chirp %s request_id=%s", chirpId, requestIDFrom(r.Context()))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// respondJSON writes payload as a JSON response with the given status. The
+// Content-Type goes out before the status line, and a payload that can't be
+// encoded becomes a 500 rather than an empty success.
+func respondJSON(w http.ResponseWriter, statusCode int, payload any) {
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("encoding %T response: %v", payload, err)
+		returnError(w, http.StatusInternalServerError, errors.New("failed to encode response"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(dat)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jsleep/learngo_httpserver/internal/database"
+	"github.com/lib/pq"
+)
+
+// retryPolicy says how often, and how patiently, a query that failed for a
+// transient reason is tried again. attempts counts the first try, so 1
+// disables retrying.
+type retryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+// backoff is the wait before retry number n (from 1): baseDelay doubled
+// each time up to maxDelay, with jitter so clients that failed together
+// don't all come back together.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.baseDelay << (n - 1)
+	if d <= 0 || (p.maxDelay > 0 && d > p.maxDelay) {
+		d = p.maxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// isTransientDBError reports whether err is the kind a retry can fix: a
+// dropped or refused connection, a server shutting down during failover, or
+// a serialization failure or deadlock. Constraint violations and the like
+// are the caller's problem and fail straight away.
+func isTransientDBError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01", "57P01", "57P02", "57P03":
+			return true
+		}
+		// class 08: connection exception
+		return strings.HasPrefix(string(pqErr.Code), "08")
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// withRetry calls fn until it succeeds, fails for a reason that isn't
+// transient, runs out of attempts or ctx is done. fn must be safe to repeat.
+func withRetry[T any](ctx context.Context, p retryPolicy, fn func() (T, error)) (T, error) {
+	for n := 1; ; n++ {
+		v, err := fn()
+		if err == nil || n >= p.attempts || !isTransientDBError(err) {
+			return v, err
+		}
+		timer := time.NewTimer(p.backoff(n))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return v, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryingDB retries the queries run through it under policy. It is only
+// for connections used for reads: a write that failed mid-flight may have
+// been applied, so ExecContext and PrepareContext pass straight through.
+type retryingDB struct {
+	database.DBTX
+	policy retryPolicy
+}
+
+func (db retryingDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return withRetry(ctx, db.policy, func() (*sql.Rows, error) {
+		return db.DBTX.QueryContext(ctx, query, args...)
+	})
+}
+
+func (db retryingDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	row, _ := withRetry(ctx, db.policy, func() (*sql.Row, error) {
+		row := db.DBTX.QueryRowContext(ctx, query, args...)
+		return row, row.Err()
+	})
+	return row
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// routeCounters counts requests per matched route pattern. It is safe for
+// concurrent use.
+type routeCounters struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (c *routeCounters) inc(route string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = map[string]int64{}
+	}
+	c.counts[route]++
+}
+
+func (c *routeCounters) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]int64, len(c.counts))
+	for route, n := range c.counts {
+		out[route] = n
+	}
+	return out
+}
+
+func (c *routeCounters) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = nil
+}
+
+// routeKey names the route r was dispatched to. It must be called after the
+// mux has handled r, since that is when r.Pattern gets filled in.
+func routeKey(r *http.Request) string {
+	if r.Pattern == "" {
+		return "unmatched"
+	}
+	// patterns registered without a method match any method
+	if !strings.Contains(r.Pattern, " ") {
+		return r.Method + " " + r.Pattern
+	}
+	return r.Pattern
+}
+
+func (cfg *apiConfig) middlewareRouteCounts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		cfg.routeHits.inc(routeKey(r))
+	})
+}
+
+func (cfg *apiConfig) routeMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.requireAdmin(r); err != nil {
+		returnError(w, http.StatusForbidden, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, cfg.routeHits.snapshot())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/auth"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// Limits and defaults for POST /admin/seed. Every row is its own INSERT
+// inside one DB_TIMEOUT-bounded transaction, so the caps keep the largest
+// seed to about a thousand statements.
+const (
+	defaultSeedUsers         = 10
+	defaultSeedChirpsPerUser = 5
+	maxSeedUsers             = 100
+	maxSeedChirpsPerUser     = 10
+)
+
+// seedPassword is shared by every seeded user so demo accounts can log in.
+const seedPassword = "chirpy-demo-password"
+
+var seedWords = strings.Fields(`
+	just shipped another build of the app and the coffee is still warm
+	today I learned that gophers dig tunnels faster than I write tests
+	the weather is great for a walk around the park with the dog
+	anyone else think tabs versus spaces is settled by gofmt anyway
+	reading a book about distributed systems on a slow train home`)
+
+// seedChirpBody strings random words together, well under the chirp limit.
+func seedChirpBody() string {
+	words := make([]string, 4+rand.IntN(6))
+	for i := range words {
+		words[i] = seedWords[rand.IntN(len(seedWords))]
+	}
+	return strings.Join(words, " ")
+}
+
+// seedHandler fills a development database with demo users, each with a few
+// chirps, all in one transaction. Like resetHandler it needs admin access,
+// and it is refused outside PLATFORM=dev whatever the key.
+func (cfg *apiConfig) seedHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.platform != "dev" {
+		returnError(w, http.StatusForbidden, errors.New("seeding is only allowed in dev"))
+		return
+	}
+	if err := cfg.requireAdmin(r); err != nil {
+		returnError(w, http.StatusForbidden, err)
+		return
+	}
+
+	type parameters struct {
+		Users         *int `json:"users"`
+		ChirpsPerUser *int `json:"chirps_per_user"`
+	}
+	type response struct {
+		Users    int      `json:"users"`
+		Chirps   int      `json:"chirps"`
+		Emails   []string `json:"emails"`
+		Password string   `json:"password"`
+	}
+
+	// a bare POST seeds the defaults
+	params := parameters{}
+	if !cfg.decodeOptionalJSON(w, r, &params) {
+		return
+	}
+	users, chirpsPerUser := defaultSeedUsers, defaultSeedChirpsPerUser
+	if params.Users != nil {
+		users = *params.Users
+	}
+	if params.ChirpsPerUser != nil {
+		chirpsPerUser = *params.ChirpsPerUser
+	}
+	fe := fieldErrors{}
+	if users < 1 || users > maxSeedUsers {
+		fe["users"] = fmt.Sprintf("must be between 1 and %d", maxSeedUsers)
+	}
+	if chirpsPerUser < 0 || chirpsPerUser > maxSeedChirpsPerUser {
+		fe["chirps_per_user"] = fmt.Sprintf("must be between 0 and %d", maxSeedChirpsPerUser)
+	}
+	if len(fe) > 0 {
+		returnValidationErrors(w, fe)
+		return
+	}
+
+	// one hash for everyone; bcrypt per user would take minutes
+	hash, err := auth.HashPassword(seedPassword)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	// a per-run tag keeps emails unique when seeding more than once
+	run := uuid.NewString()[:8]
+	resp := response{Emails: make([]string, 0, users), Password: seedPassword}
+	err = cfg.withTx(ctx, func(q *database.Queries) error {
+		for i := 1; i <= users; i++ {
+			user, err := q.CreateUser(ctx, database.CreateUserParams{
+				Email:          fmt.Sprintf("demo-%s-%d@example.com", run, i),
+				HashedPassword: hash,
+			})
+			if err != nil {
+				return err
+			}
+			for j := 0; j < chirpsPerUser; j++ {
+				if _, err := q.CreateChirp(ctx, database.CreateChirpParams{Body: seedChirpBody(), UserID: user.ID}); err != nil {
+					return err
+				}
+			}
+			resp.Emails = append(resp.Emails, user.Email)
+		}
+		return nil
+	})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp.Users = len(resp.Emails)
+	resp.Chirps = resp.Users * chirpsPerUser
+	respondJSON(w, http.StatusCreated, resp)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/auth"
+)
+
+// newAccessTokenHeader carries a renewed access token back to the client.
+const newAccessTokenHeader = "X-New-Access-Token"
+
+type userIDKey struct{}
+
+func withUserID(ctx context.Context, userID uuid.UUID) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// userIDFromContext returns the authenticated user stored by requireAuth.
+func userIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	userID, ok := ctx.Value(userIDKey{}).(uuid.UUID)
+	return userID, ok
+}
+
+// requestUserID is userIDFromContext for handlers mounted behind
+// requireAuth; reaching one without it is a routing bug.
+func requestUserID(r *http.Request) uuid.UUID {
+	userID, ok := userIDFromContext(r.Context())
+	if !ok {
+		panic("requestUserID: " + r.URL.Path + " is not behind requireAuth")
+	}
+	return userID
+}
+
+// defaultTokenLeeway is the clock skew allowed when checking access token
+// times, unless JWT_LEEWAY says otherwise.
+const defaultTokenLeeway = 30 * time.Second
+
+// tokens is how this server mints and checks access tokens: JWTs unless
+// TOKEN_TYPE=paseto.
+func (cfg *apiConfig) tokens() auth.TokenBackend {
+	if cfg.tokenType == tokenTypePASETO {
+		return auth.PASETOConfig{Secret: cfg.secret, SecondarySecrets: cfg.secondarySecrets, Issuer: cfg.jwtIssuer, Audience: cfg.jwtAudience, Leeway: cfg.tokenLeeway}
+	}
+	return auth.JWTConfig{Secret: cfg.secret, SecondarySecrets: cfg.secondarySecrets, Issuer: cfg.jwtIssuer, Audience: cfg.jwtAudience, Leeway: cfg.tokenLeeway}
+}
+
+// defaultMaxSessionAge is how long after logging in access tokens stop
+// being renewed, unless MAX_SESSION_AGE says otherwise. After that the
+// client has to use its refresh token.
+const defaultMaxSessionAge = 24 * time.Hour
+
+// authenticate validates the request's bearer access token, returning the
+// session it belongs to.
+func (cfg *apiConfig) authenticate(r *http.Request) (auth.Session, error) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return auth.Session{}, err
+	}
+	return cfg.tokens().ParseSession(token)
+}
+
+// requireAuth validates the access token once for a protected handler and
+// passes the user on through the request context. Tokens within
+// cfg.tokenRenewWindow of expiring are renewed, and the fresh token is
+// returned in the X-New-Access-Token header so active clients stay logged in.
+func (cfg *apiConfig) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := cfg.authenticate(r)
+		if err != nil {
+			returnError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		if cfg.tokenRenewWindow > 0 && time.Until(session.ExpiresAt) < cfg.tokenRenewWindow {
+			fresh, err := cfg.renewAccessToken(r, session)
+			if err != nil {
+				// the current token is still good; renewal can wait
+				log.Printf("renewing access token for user %s: %v", session.UserID, err)
+			} else if fresh != "" {
+				w.Header().Set(newAccessTokenHeader, fresh)
+			}
+		}
+
+		next(w, r.WithContext(withUserID(r.Context(), session.UserID)))
+	}
+}
+
+// renewAccessToken mints a token continuing session, or returns "" when the
+// session may not be extended: the token has already expired (it is only
+// accepted within the leeway), the session is older than cfg.maxSessionAge,
+// or the user has been deleted or has logged out everywhere. The new token
+// lives no longer than the one it replaces.
+func (cfg *apiConfig) renewAccessToken(r *http.Request, session auth.Session) (string, error) {
+	now := time.Now()
+	if !session.ExpiresAt.After(now) || session.IssuedAt.IsZero() {
+		return "", nil
+	}
+	lifetime := min(defaultTokenLifetime, session.ExpiresAt.Sub(session.IssuedAt))
+	if cfg.maxSessionAge > 0 {
+		lifetime = min(lifetime, session.AuthTime.Add(cfg.maxSessionAge).Sub(now))
+	}
+	// renewing has to buy the client something
+	if !now.Add(lifetime).After(session.ExpiresAt) {
+		return "", nil
+	}
+
+	// a deleted user's refresh tokens go with them, so this covers both;
+	// read from the primary so a revocation is seen straight away
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+	active, err := cfg.db.UserHasValidRefreshToken(ctx, session.UserID)
+	if err != nil || !active {
+		return "", err
+	}
+	return cfg.tokens().Renew(session, lifetime)
+}
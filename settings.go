@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// defaultMaxSettingsBytes caps a user's settings object, after compaction,
+// unless MAX_SETTINGS_BYTES says otherwise.
+const defaultMaxSettingsBytes = 16 << 10
+
+// getSettingsHandler returns the caller's settings object, which is {} until
+// they store one.
+func (cfg *apiConfig) getSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	settings, err := cfg.db.GetUserSettings(ctx, userID)
+	if err != nil {
+		returnDBError(w, ctx, http.StatusNotFound, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, settings)
+}
+
+// putSettingsHandler replaces the caller's settings with the JSON object in
+// the body. The server doesn't look inside it; what the keys mean is up to
+// clients.
+func (cfg *apiConfig) putSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var raw json.RawMessage
+	if !cfg.decodeJSON(w, r, &raw) {
+		return
+	}
+	if len(raw) == 0 || raw[0] != '{' {
+		returnError(w, http.StatusBadRequest, errors.New("settings must be a JSON object"))
+		return
+	}
+
+	var settings bytes.Buffer
+	if err := json.Compact(&settings, raw); err != nil {
+		returnError(w, http.StatusBadRequest, errors.New("invalid JSON body"))
+		return
+	}
+	if settings.Len() > cfg.maxSettingsBytes {
+		returnError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("settings exceed %d bytes", cfg.maxSettingsBytes))
+		return
+	}
+
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	updated, err := cfg.db.SetUserSettings(ctx, database.SetUserSettingsParams{ID: userID, Settings: settings.Bytes()})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	if updated == 0 {
+		returnError(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, json.RawMessage(settings.Bytes()))
+}
@@ -0,0 +1,13 @@
+-- name: CreateChirpReport :one
+INSERT INTO chirp_reports (id, created_at, chirp_id, reporter_id, reason)
+VALUES (
+    gen_random_uuid(), now(), $1, $2, $3
+)
+RETURNING *;
+
+-- name: GetReportedChirps :many
+SELECT sqlc.embed(chirps), COUNT(chirp_reports.id) AS report_count
+FROM chirps JOIN chirp_reports ON chirp_reports.chirp_id = chirps.id
+GROUP BY chirps.id
+ORDER BY report_count DESC, chirps.created_at ASC
+LIMIT $1 OFFSET $2;
\ No newline at end of file
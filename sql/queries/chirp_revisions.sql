@@ -0,0 +1,8 @@
+-- name: CreateChirpRevision :execrows
+INSERT INTO chirp_revisions (id, chirp_id, body, created_at, replaced_at)
+SELECT gen_random_uuid(), id, body, updated_at, now()
+FROM chirps WHERE id = $1 AND deleted_at IS NULL;
+
+-- name: GetChirpRevisions :many
+SELECT * FROM chirp_revisions WHERE chirp_id = $1
+ORDER BY replaced_at ASC;
\ No newline at end of file
@@ -1,21 +1,148 @@
 -- name: CreateChirp :one
-INSERT INTO chirps (id, created_at, updated_at, body, user_id)
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, parent_id, image_url)
 VALUES (
-    gen_random_uuid(), now(), now(), $1, $2
+    gen_random_uuid(), now(), now(), $1, $2, $3, $4
 )
 RETURNING *;
 
 -- name: GetChirp :one
-SELECT * FROM chirps WHERE id = $1;
+SELECT * FROM chirps WHERE id = sqlc.arg(id)
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL OR user_id = sqlc.narg(viewer_id));
 
 -- name: GetChirps :many
 SELECT * FROM chirps 
-ORDER BY created_at ASC;
+WHERE sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL
+ORDER BY
+    CASE WHEN sqlc.arg(sort_desc)::boolean THEN CASE WHEN sqlc.arg(sort_by)::text = 'updated_at' THEN updated_at ELSE created_at END END DESC,
+    CASE WHEN sqlc.arg(sort_by)::text = 'updated_at' THEN updated_at ELSE created_at END ASC,
+    CASE WHEN sqlc.arg(sort_desc)::boolean THEN id END DESC,
+    id ASC
+LIMIT sqlc.arg(page_limit) OFFSET sqlc.arg(page_offset);
 
--- name: GetChirpsFromAuthor :many
+-- name: GetChirpsFromAuthors :many
 SELECT * FROM chirps 
-WHERE user_id = $1
-ORDER BY created_at ASC;
+WHERE user_id = ANY(sqlc.arg(author_ids)::uuid[])
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL)
+ORDER BY
+    CASE WHEN sqlc.arg(sort_desc)::boolean THEN CASE WHEN sqlc.arg(sort_by)::text = 'updated_at' THEN updated_at ELSE created_at END END DESC,
+    CASE WHEN sqlc.arg(sort_by)::text = 'updated_at' THEN updated_at ELSE created_at END ASC,
+    CASE WHEN sqlc.arg(sort_desc)::boolean THEN id END DESC,
+    id ASC
+LIMIT sqlc.arg(page_limit) OFFSET sqlc.arg(page_offset);
 
--- name: DeleteChirp :exec
-DELETE FROM chirps where id= $1;
\ No newline at end of file
+-- name: CountChirps :one
+SELECT COUNT(*) FROM chirps
+WHERE sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL;
+
+-- name: CountChirpsFromAuthors :one
+SELECT COUNT(*) FROM chirps
+WHERE user_id = ANY(sqlc.arg(author_ids)::uuid[])
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL);
+
+-- name: CountRecentChirps :one
+SELECT COUNT(*) AS recent, MIN(created_at)::timestamp AS oldest
+FROM chirps
+WHERE user_id = sqlc.arg(user_id) AND created_at > sqlc.arg(since);
+
+-- name: DeleteChirp :execrows
+UPDATE chirps SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL;
+
+-- name: SearchChirps :many
+SELECT * FROM chirps
+WHERE body ILIKE sqlc.arg(pattern)
+AND (sqlc.narg(author_id)::uuid IS NULL OR user_id = sqlc.narg(author_id))
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL)
+AND (sqlc.narg(created_after)::timestamp IS NULL OR created_at > sqlc.narg(created_after))
+ORDER BY
+    CASE WHEN sqlc.arg(sort_desc)::boolean THEN CASE WHEN sqlc.arg(sort_by)::text = 'updated_at' THEN updated_at ELSE created_at END END DESC,
+    CASE WHEN sqlc.arg(sort_by)::text = 'updated_at' THEN updated_at ELSE created_at END ASC,
+    CASE WHEN sqlc.arg(sort_desc)::boolean THEN id END DESC,
+    id ASC
+LIMIT sqlc.arg(page_limit) OFFSET sqlc.arg(page_offset);
+
+-- name: CountSearchChirps :one
+SELECT COUNT(*) FROM chirps
+WHERE body ILIKE sqlc.arg(pattern)
+AND (sqlc.narg(author_id)::uuid IS NULL OR user_id = sqlc.narg(author_id))
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL)
+AND (sqlc.narg(created_after)::timestamp IS NULL OR created_at > sqlc.narg(created_after));
+
+-- name: DeleteChirpForUser :execrows
+UPDATE chirps SET deleted_at = now() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL;
+
+-- name: DeleteChirpsByAuthor :execresult
+UPDATE chirps SET deleted_at = now() WHERE user_id = $1 AND deleted_at IS NULL;
+
+-- name: GetChirpStats :one
+SELECT COUNT(*) AS total, MIN(created_at)::timestamp AS earliest, MAX(created_at)::timestamp AS latest
+FROM chirps
+WHERE (sqlc.narg(author_id)::uuid IS NULL OR user_id = sqlc.narg(author_id))
+AND deleted_at IS NULL;
+
+-- name: GetTopChirpAuthors :many
+SELECT user_id, COUNT(*) AS chirp_count FROM chirps
+WHERE (sqlc.narg(author_id)::uuid IS NULL OR user_id = sqlc.narg(author_id))
+AND deleted_at IS NULL
+GROUP BY user_id
+ORDER BY chirp_count DESC, user_id
+LIMIT sqlc.arg(max_authors);
+
+-- name: GetChirpWithAuthor :one
+SELECT sqlc.embed(chirps), users.email AS author_email
+FROM chirps JOIN users ON users.id = chirps.user_id
+WHERE chirps.id = sqlc.arg(id)
+AND (sqlc.arg(include_deleted)::boolean OR chirps.deleted_at IS NULL OR chirps.user_id = sqlc.narg(viewer_id));
+
+-- name: GetChirpsCreatedAfter :many
+SELECT * FROM chirps
+WHERE created_at > sqlc.arg(created_after)
+AND (sqlc.narg(author_id)::uuid IS NULL OR user_id = sqlc.narg(author_id))
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL)
+ORDER BY
+    CASE WHEN sqlc.arg(sort_desc)::boolean THEN CASE WHEN sqlc.arg(sort_by)::text = 'updated_at' THEN updated_at ELSE created_at END END DESC,
+    CASE WHEN sqlc.arg(sort_by)::text = 'updated_at' THEN updated_at ELSE created_at END ASC,
+    CASE WHEN sqlc.arg(sort_desc)::boolean THEN id END DESC,
+    id ASC
+LIMIT sqlc.arg(page_limit) OFFSET sqlc.arg(page_offset);
+
+-- name: CountChirpsCreatedAfter :one
+SELECT COUNT(*) FROM chirps
+WHERE created_at > sqlc.arg(created_after)
+AND (sqlc.narg(author_id)::uuid IS NULL OR user_id = sqlc.narg(author_id))
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL);
+
+-- name: GetChirpsPageAfter :many
+SELECT * FROM chirps
+WHERE (sqlc.narg(cursor_created_at)::timestamp IS NULL OR (created_at, id) > (sqlc.narg(cursor_created_at), sqlc.narg(cursor_id)::uuid))
+AND (COALESCE(cardinality(sqlc.arg(author_ids)::uuid[]), 0) = 0 OR user_id = ANY(sqlc.arg(author_ids)::uuid[]))
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL)
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg(page_limit);
+
+-- name: GetChirpsPageBefore :many
+SELECT * FROM chirps
+WHERE (sqlc.narg(cursor_created_at)::timestamp IS NULL OR (created_at, id) < (sqlc.narg(cursor_created_at), sqlc.narg(cursor_id)::uuid))
+AND (COALESCE(cardinality(sqlc.arg(author_ids)::uuid[]), 0) = 0 OR user_id = ANY(sqlc.arg(author_ids)::uuid[]))
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL)
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(page_limit);
+
+-- name: GetChirpReplies :many
+SELECT * FROM chirps
+WHERE parent_id = sqlc.arg(parent_id)
+AND (sqlc.arg(include_deleted)::boolean OR deleted_at IS NULL)
+ORDER BY created_at ASC, id ASC;
+
+-- name: GetReplyCounts :many
+SELECT parent_id::uuid AS chirp_id, COUNT(*) AS reply_count FROM chirps
+WHERE parent_id = ANY(sqlc.arg(chirp_ids)::uuid[])
+AND deleted_at IS NULL
+GROUP BY parent_id;
+
+-- name: UpdateChirpBody :one
+UPDATE chirps SET body = $2, updated_at = now()
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING *;
+
+-- name: ClearChirps :exec
+DELETE FROM chirps;
\ No newline at end of file
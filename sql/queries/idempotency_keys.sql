@@ -0,0 +1,11 @@
+-- name: GetIdempotentChirp :one
+SELECT chirps.* FROM idempotency_keys JOIN chirps ON chirps.id = idempotency_keys.chirp_id
+WHERE idempotency_keys.user_id = sqlc.arg(user_id) AND idempotency_keys.key = sqlc.arg(key)
+AND idempotency_keys.created_at > sqlc.arg(created_after);
+
+-- name: SaveIdempotencyKey :execrows
+INSERT INTO idempotency_keys (user_id, key, chirp_id, created_at)
+VALUES (sqlc.arg(user_id), sqlc.arg(key), sqlc.arg(chirp_id), now())
+ON CONFLICT (user_id, key) DO UPDATE
+SET chirp_id = excluded.chirp_id, created_at = excluded.created_at
+WHERE idempotency_keys.created_at <= sqlc.arg(expired_before);
\ No newline at end of file
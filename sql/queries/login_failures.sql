@@ -0,0 +1,16 @@
+-- name: GetLoginLockedUntil :one
+SELECT locked_until::timestamp FROM login_failures
+WHERE user_id = $1 AND locked_until > now();
+
+-- name: RecordLoginFailure :one
+INSERT INTO login_failures (user_id, failed_count)
+VALUES ($1, 1)
+ON CONFLICT (user_id) DO UPDATE
+SET failed_count = login_failures.failed_count + 1
+RETURNING failed_count;
+
+-- name: LockLogin :exec
+UPDATE login_failures SET failed_count = 0, locked_until = $2 WHERE user_id = $1;
+
+-- name: ClearLoginFailures :exec
+DELETE FROM login_failures WHERE user_id = $1;
\ No newline at end of file
@@ -8,5 +8,26 @@ RETURNING *;
 -- name: GetRefreshToken :one
 SELECT * FROM refresh_tokens WHERE token = $1;
 
+-- name: GetValidRefreshToken :one
+SELECT * FROM refresh_tokens
+WHERE token = $1 AND expires_at > now() AND revoked_at IS NULL;
+
 -- name: RevokeRefreshToken :exec
-UPDATE refresh_tokens SET revoked_at = now() WHERE token = $1;
\ No newline at end of file
+UPDATE refresh_tokens SET revoked_at = now() WHERE token = $1;
+
+-- name: RevokeAllUserRefreshTokens :exec
+UPDATE refresh_tokens SET revoked_at = now(), updated_at = now()
+WHERE user_id = $1 AND revoked_at IS NULL;
+
+-- name: DeleteExpiredRefreshTokens :execrows
+DELETE FROM refresh_tokens
+WHERE expires_at < now() OR revoked_at < sqlc.arg(revoked_before)::timestamp;
+
+-- name: ClearRefreshTokens :exec
+DELETE FROM refresh_tokens;
+
+-- name: UserHasValidRefreshToken :one
+SELECT EXISTS (
+    SELECT 1 FROM refresh_tokens
+    WHERE user_id = $1 AND expires_at > now() AND revoked_at IS NULL
+);
\ No newline at end of file
@@ -0,0 +1,16 @@
+-- name: SaveTOTPSecret :execrows
+INSERT INTO user_totp (user_id, secret, created_at)
+VALUES ($1, $2, now())
+ON CONFLICT (user_id) DO UPDATE
+SET secret = excluded.secret, created_at = excluded.created_at, last_used_step = 0
+WHERE user_totp.enabled_at IS NULL;
+
+-- name: GetTOTP :one
+SELECT * FROM user_totp WHERE user_id = $1;
+
+-- name: EnableTOTP :execrows
+UPDATE user_totp SET enabled_at = now() WHERE user_id = $1 AND enabled_at IS NULL;
+
+-- name: UseTOTPStep :execrows
+UPDATE user_totp SET last_used_step = sqlc.arg(step)
+WHERE user_id = sqlc.arg(user_id) AND last_used_step < sqlc.arg(step);
\ No newline at end of file
@@ -6,13 +6,40 @@ VALUES (
 RETURNING *;
 
 -- name: GetUser :one
-SELECT * FROM users WHERE email = $1;
+SELECT * FROM users WHERE lower(email) = lower(sqlc.arg(email));
 
--- name: SetUserEmailPassword :exec
-UPDATE users SET email = $2, hashed_password = $3, updated_at=now() WHERE id = $1;
+-- name: GetUserByID :one
+SELECT * FROM users WHERE id = $1;
+
+-- name: GetUsersByIDs :many
+SELECT id, email FROM users WHERE id = ANY(sqlc.arg(ids)::uuid[]);
+
+-- name: SetUserEmail :exec
+UPDATE users SET email = $2, updated_at=now() WHERE id = $1;
+
+-- name: SetUserPassword :exec
+UPDATE users SET hashed_password = $2, updated_at=now() WHERE id = $1;
 
 -- name: ClearUsers :exec
 DELETE FROM users;
 
 -- name: SetUserIsChirpyRed :execresult
-UPDATE users SET is_chirpy_red=$2, updated_at=now() WHERE id = $1;
\ No newline at end of file
+UPDATE users SET is_chirpy_red=$2, updated_at=now() WHERE id = $1;
+
+-- name: SetUserLastLogin :one
+UPDATE users SET last_login_at = now() WHERE id = $1
+RETURNING *;
+
+-- name: GetUsers :many
+SELECT * FROM users
+ORDER BY created_at ASC
+LIMIT $1 OFFSET $2;
+
+-- name: DeleteUser :execresult
+DELETE FROM users WHERE id = $1;
+
+-- name: GetUserSettings :one
+SELECT settings FROM users WHERE id = $1;
+
+-- name: SetUserSettings :execrows
+UPDATE users SET settings = $2, updated_at = now() WHERE id = $1;
\ No newline at end of file
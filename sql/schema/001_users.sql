@@ -6,5 +6,5 @@ CREATE TABLE users (
     email TEXT NOT NULL UNIQUE
 );
 
--- +goose Downgoo
+-- +goose Down
 DROP TABLE users;
\ No newline at end of file
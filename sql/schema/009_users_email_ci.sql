@@ -0,0 +1,9 @@
+-- +goose Up
+-- emails are stored lowercased; fold older rows so the index below holds.
+-- This fails if two accounts already differ only by case, which has to be
+-- resolved by hand before migrating.
+UPDATE users SET email = lower(email) WHERE email <> lower(email);
+CREATE UNIQUE INDEX users_email_lower_idx ON users (lower(email));
+
+-- +goose Down
+DROP INDEX users_email_lower_idx;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN settings JSONB NOT NULL DEFAULT '{}';
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN settings;
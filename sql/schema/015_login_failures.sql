@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE login_failures (
+    user_id UUID PRIMARY KEY,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE login_failures;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE chirps ADD COLUMN image_url TEXT;
+
+-- +goose Down
+ALTER TABLE chirps DROP COLUMN image_url;
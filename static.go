@@ -0,0 +1,133 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed public
+var embeddedStatic embed.FS
+
+// dotFileHidingFS hides every file or directory whose name starts with a
+// dot, so files like .env or .git are never served.
+type dotFileHidingFS struct {
+	fs.FS
+}
+
+func (fsys dotFileHidingFS) Open(name string) (fs.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != "." {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return fsys.FS.Open(name)
+}
+
+// staticFS is where the frontend is served from: the copy of public/ built
+// into the binary when STATIC_SOURCE=embed, otherwise cfg.staticDir on disk
+// so edits show up without a rebuild.
+func (cfg *apiConfig) staticFS() fs.FS {
+	if cfg.staticEmbedded {
+		sub, err := fs.Sub(embeddedStatic, "public")
+		if err != nil {
+			panic(err)
+		}
+		return sub
+	}
+	return os.DirFS(cfg.staticDir)
+}
+
+// staticHandler serves the static files, answering missing paths with the
+// site's 404.html when it has one. With cfg.staticSPA set, a missing path
+// without a file extension is taken to be a client-side route and gets
+// index.html instead, so deep links into a single-page app load.
+func (cfg *apiConfig) staticHandler() http.Handler {
+	fsys := dotFileHidingFS{cfg.staticFS()}
+	fileServer := http.FileServerFS(fsys)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			name = "."
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			if cfg.staticSPA && path.Ext(name) == "" && serveSPAIndex(w, r, fsys) {
+				return
+			}
+			staticNotFound(w, r, fsys)
+			return
+		}
+		f.Close()
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// serveSPAIndex answers with the app's index.html, reporting false when
+// there isn't one. It isn't cached, so a deploy is picked up on the next
+// navigation.
+func serveSPAIndex(w http.ResponseWriter, r *http.Request, fsys fs.FS) bool {
+	index, err := fs.ReadFile(fsys, "index.html")
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(index)
+	}
+	return true
+}
+
+// staticNotFound answers a missing asset with JSON for clients that asked
+// for it, and otherwise with the site's 404.html or net/http's plain text.
+func staticNotFound(w http.ResponseWriter, r *http.Request, fsys fs.FS) {
+	w.Header().Del("Cache-Control")
+
+	if wantsJSON(r) {
+		returnError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+
+	page, err := fsys.Open("404.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer page.Close()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	io.Copy(w, page)
+}
+
+// middlewareStaticCache lets browsers cache static assets for
+// cfg.staticMaxAge. Setting STATIC_CACHE_MAX_AGE=0 leaves the header off,
+// which is handy while developing the frontend.
+func (cfg *apiConfig) middlewareStaticCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.staticMaxAge > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cfg.staticMaxAge/time.Second)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectTo sends the request on to target, keeping its query string.
+func redirectTo(target string, statusCode int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := target
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, u, statusCode)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+const (
+	defaultTopAuthors = 10
+	maxTopAuthors     = 100
+)
+
+type AuthorChirpCount struct {
+	UserID     uuid.UUID `json:"user_id"`
+	ChirpCount int64     `json:"chirp_count"`
+}
+
+type ChirpStats struct {
+	Total      int64              `json:"total"`
+	Earliest   *time.Time         `json:"earliest"`
+	Latest     *time.Time         `json:"latest"`
+	TopAuthors []AuthorChirpCount `json:"top_authors"`
+}
+
+func (cfg *apiConfig) chirpStatsHandler(w http.ResponseWriter, r *http.Request) {
+	authorId := uuid.NullUUID{}
+	if s := r.URL.Query().Get("author_id"); s != "" {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			returnError(w, http.StatusBadRequest, err)
+			return
+		}
+		authorId = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	top := defaultTopAuthors
+	if s := r.URL.Query().Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxTopAuthors {
+			returnError(w, http.StatusBadRequest, fmt.Errorf("top must be between 1 and %d", maxTopAuthors))
+			return
+		}
+		top = n
+	}
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	dbStats, err := cfg.readDB.GetChirpStats(ctx, authorId)
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	dbAuthors, err := cfg.readDB.GetTopChirpAuthors(ctx, database.GetTopChirpAuthorsParams{AuthorID: authorId, MaxAuthors: int32(top)})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	stats := ChirpStats{
+		Total:      dbStats.Total,
+		Earliest:   nullTimePtr(dbStats.Earliest),
+		Latest:     nullTimePtr(dbStats.Latest),
+		TopAuthors: make([]AuthorChirpCount, len(dbAuthors)),
+	}
+	for i, a := range dbAuthors {
+		stats.TopAuthors[i] = AuthorChirpCount{UserID: a.UserID, ChirpCount: a.ChirpCount}
+	}
+
+	respondJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	streamWriteWait  = 10 * time.Second
+	streamPongWait   = 60 * time.Second
+	streamPingPeriod = streamPongWait * 9 / 10
+	streamBuffer     = 16
+)
+
+var errStreamFull = errors.New("too many stream connections")
+
+// chirpSubscriber receives chirps for one stream connection, optionally
+// only those by a single author.
+type chirpSubscriber struct {
+	authorID uuid.NullUUID
+	chirps   chan Chirp
+}
+
+// chirpHub fans newly created chirps out to every connected stream. A
+// subscriber that falls behind is dropped rather than allowed to block the
+// handler that published.
+type chirpHub struct {
+	mu   sync.Mutex
+	subs map[*chirpSubscriber]struct{}
+	max  int
+}
+
+func newChirpHub(maxSubscribers int) *chirpHub {
+	return &chirpHub{subs: map[*chirpSubscriber]struct{}{}, max: maxSubscribers}
+}
+
+func (h *chirpHub) subscribe(authorID uuid.NullUUID) (*chirpSubscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) >= h.max {
+		return nil, errStreamFull
+	}
+	sub := &chirpSubscriber{authorID: authorID, chirps: make(chan Chirp, streamBuffer)}
+	h.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// unsubscribe removes sub and closes its channel. It is safe to call more
+// than once.
+func (h *chirpHub) unsubscribe(sub *chirpSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.chirps)
+	}
+}
+
+// publish delivers c to every matching subscriber. A nil hub ignores it.
+func (h *chirpHub) publish(c Chirp) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if sub.authorID.Valid && sub.authorID.UUID != c.UserID {
+			continue
+		}
+		select {
+		case sub.chirps <- c:
+		default:
+			delete(h.subs, sub)
+			close(sub.chirps)
+		}
+	}
+}
+
+// streamUpgrader answers the WebSocket handshake for chirp streams. Failed
+// handshakes are reported in the API's JSON error schema.
+func (cfg *apiConfig) streamUpgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: cfg.streamOriginAllowed,
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			returnError(w, status, reason)
+		},
+	}
+}
+
+// streamOriginAllowed lets a browser open a stream only from the API's own
+// origin or one on the CORS allow-list, since cookies and other ambient
+// credentials ride along with a cross-site handshake. Clients that send no
+// Origin aren't browsers and are always allowed.
+func (cfg *apiConfig) streamOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || cfg.cors.allowedOrigins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// chirpStreamHandler upgrades to a WebSocket and pushes each new chirp as a
+// JSON text message, filtered by ?author_id= when given.
+func (cfg *apiConfig) chirpStreamHandler(w http.ResponseWriter, r *http.Request) {
+	authorId := uuid.NullUUID{}
+	if s := r.URL.Query().Get("author_id"); s != "" {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			returnError(w, http.StatusBadRequest, err)
+			return
+		}
+		authorId = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	sub, err := cfg.chirpHub.subscribe(authorId)
+	if err != nil {
+		returnError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer cfg.chirpHub.unsubscribe(sub)
+
+	// the upgrader has already answered a failed handshake
+	conn, err := cfg.streamUpgrader().Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// the reader only exists to answer pings, notice pongs and see the
+	// client leave; the stream is one-way
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.SetReadDeadline(time.Now().Add(streamPongWait))
+		conn.SetPongHandler(func(string) error { return conn.SetReadDeadline(time.Now().Add(streamPongWait)) })
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(streamPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case chirp, ok := <-sub.chirps:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "too slow")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(streamWriteWait))
+				return
+			}
+			dat, _ := json.Marshal(chirp)
+			conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, dat); err != nil {
+				log.Printf("chirp stream: %v", err)
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
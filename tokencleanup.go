@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// refreshTokenCleanup periodically deletes refresh tokens that can no
+// longer be used: expired ones straight away, revoked ones once they are
+// older than revokedRetention, which keeps them around long enough for
+// /api/refresh to tell clients the token was revoked.
+type refreshTokenCleanup struct {
+	interval         time.Duration
+	revokedRetention time.Duration
+}
+
+// runRefreshTokenCleanup purges once at startup and then every interval
+// until ctx is cancelled. A zero interval disables it.
+func (cfg *apiConfig) runRefreshTokenCleanup(ctx context.Context) {
+	if cfg.tokenCleanup.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.tokenCleanup.interval)
+	defer ticker.Stop()
+	for {
+		cfg.purgeRefreshTokens(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeRefreshTokens runs one cleanup pass and logs what it removed.
+func (cfg *apiConfig) purgeRefreshTokens(ctx context.Context) {
+	if cfg.dbTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.dbTimeout)
+		defer cancel()
+	}
+
+	n, err := cfg.db.DeleteExpiredRefreshTokens(ctx, time.Now().Add(-cfg.tokenCleanup.revokedRetention))
+	if err != nil {
+		log.Printf("refresh token cleanup: %v", err)
+		return
+	}
+	log.Printf("refresh token cleanup: purged %d tokens", n)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jsleep/learngo_httpserver/internal/auth"
+	"github.com/jsleep/learngo_httpserver/internal/database"
+)
+
+// totpIssuer labels the account in authenticator apps.
+const totpIssuer = "Chirpy"
+
+var errInvalidTOTP = errors.New("invalid two-factor code")
+
+// totpAvailable reports whether two-factor secrets can be stored and read,
+// answering 503 when TOTP_ENCRYPTION_KEY isn't set.
+func (cfg *apiConfig) totpAvailable(w http.ResponseWriter) bool {
+	if cfg.totpBox == nil {
+		returnError(w, http.StatusServiceUnavailable, errors.New("two-factor authentication is not configured"))
+		return false
+	}
+	return true
+}
+
+// enrollTOTPHandler starts two-factor setup: it stores a fresh secret,
+// encrypted with cfg.totpBox, and returns it with the otpauth:// URI for the
+// user's authenticator app.
+// Nothing changes at login until the user proves the app works through
+// confirmTOTPHandler. Enrolling again before that replaces the secret.
+func (cfg *apiConfig) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.totpAvailable(w) {
+		return
+	}
+
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	dbUser, err := cfg.db.GetUserByID(ctx, userID)
+	if err != nil {
+		returnDBError(w, ctx, http.StatusNotFound, err)
+		return
+	}
+
+	secret, uri, err := auth.NewTOTPKey(totpIssuer, dbUser.Email)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sealed, err := cfg.totpBox.Seal(secret, userID.String())
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
+		return
+	}
+	saved, err := cfg.db.SaveTOTPSecret(ctx, database.SaveTOTPSecretParams{UserID: userID, Secret: sealed})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	if saved == 0 {
+		returnError(w, http.StatusConflict, errors.New("two-factor authentication is already enabled"))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"secret":      secret,
+		"otpauth_uri": uri,
+	})
+}
+
+// confirmTOTPHandler turns two-factor authentication on once the user
+// sends a valid code for the secret they enrolled.
+func (cfg *apiConfig) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if !cfg.totpAvailable(w) {
+		return
+	}
+
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	params := parameters{}
+	if !cfg.decodeJSON(w, r, &params) {
+		return
+	}
+
+	userID := requestUserID(r)
+
+	ctx, cancel := cfg.dbContext(r)
+	defer cancel()
+
+	totp, err := cfg.db.GetTOTP(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		returnError(w, http.StatusConflict, errors.New("enroll in two-factor authentication first"))
+		return
+	}
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	if totp.EnabledAt.Valid {
+		returnError(w, http.StatusConflict, errors.New("two-factor authentication is already enabled"))
+		return
+	}
+
+	secret, err := cfg.totpBox.Open(totp.Secret, userID.String())
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
+		return
+	}
+	step, err := auth.ValidateTOTP(params.Code, secret, time.Now())
+	if err != nil {
+		returnErrorCode(w, http.StatusBadRequest, codeTOTPInvalid, errInvalidTOTP)
+		return
+	}
+
+	err = cfg.withTx(ctx, func(q *database.Queries) error {
+		// the confirming code can't be replayed to log in
+		if _, err := q.UseTOTPStep(ctx, database.UseTOTPStepParams{Step: step, UserID: userID}); err != nil {
+			return err
+		}
+		_, err := q.EnableTOTP(ctx, userID)
+		return err
+	})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// passesTOTP reports whether a login for userID may go ahead: always when
+// the user hasn't enabled two-factor authentication, otherwise only with a
+// valid code that hasn't been used before. On failure it answers 401, or
+// 503 when two-factor authentication isn't configured. A wrong or replayed
+// code counts towards the login lockout like a wrong password, so the code
+// can't be brute-forced once the password is known.
+func (cfg *apiConfig) passesTOTP(w http.ResponseWriter, ctx context.Context, userID uuid.UUID, code string) bool {
+	totp, err := cfg.db.GetTOTP(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return false
+	}
+	if !totp.EnabledAt.Valid {
+		return true
+	}
+	if !cfg.totpAvailable(w) {
+		return false
+	}
+
+	if code == "" {
+		returnErrorCode(w, http.StatusUnauthorized, codeTOTPRequired, errors.New("a two-factor code is required"))
+		return false
+	}
+	secret, err := cfg.totpBox.Open(totp.Secret, userID.String())
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	step, err := auth.ValidateTOTP(code, secret, time.Now())
+	if err != nil {
+		cfg.rejectTOTP(w, ctx, userID)
+		return false
+	}
+	used, err := cfg.db.UseTOTPStep(ctx, database.UseTOTPStepParams{Step: step, UserID: userID})
+	if err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return false
+	}
+	if used == 0 {
+		// this code, or a later one, already logged someone in
+		cfg.rejectTOTP(w, ctx, userID)
+		return false
+	}
+	return true
+}
+
+// rejectTOTP counts a bad two-factor code as a failed login and answers 401.
+func (cfg *apiConfig) rejectTOTP(w http.ResponseWriter, ctx context.Context, userID uuid.UUID) {
+	if err := cfg.recordLoginFailure(ctx, userID); err != nil {
+		returnDBError(w, ctx, http.StatusInternalServerError, err)
+		return
+	}
+	returnErrorCode(w, http.StatusUnauthorized, codeTOTPInvalid, errInvalidTOTP)
+}
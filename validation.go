@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"unicode/utf8"
+)
+
+// maxPasswordBytes is bcrypt's input limit; longer passwords are rejected
+// rather than silently truncated.
+const maxPasswordBytes = 72
+
+const minPasswordLength = 8
+
+// fieldErrors collects per-field validation messages so a client can point
+// at every invalid input at once.
+type fieldErrors map[string]string
+
+func (fe fieldErrors) add(field, message string) {
+	if _, ok := fe[field]; !ok {
+		fe[field] = message
+	}
+}
+
+func (fe fieldErrors) any() bool {
+	return len(fe) > 0
+}
+
+// returnValidationErrors writes fe as a 422 response, listing each invalid
+// field under error.fields.
+func returnValidationErrors(w http.ResponseWriter, fe fieldErrors) {
+	writeErrorBody(w, http.StatusUnprocessableEntity, errorBody{
+		Code:    codeValidationFailed,
+		Message: "request has invalid fields",
+		Fields:  fe,
+	})
+}
+
+// validateCredentials checks an email/password pair and returns the
+// canonical email along with any field errors.
+func validateCredentials(email, password string) (string, fieldErrors) {
+	fe := fieldErrors{}
+
+	email, err := validateEmail(email)
+	if err != nil {
+		fe.add("email", "invalid format")
+	}
+
+	validatePassword(fe, "password", password)
+
+	return email, fe
+}
+
+// validatePassword records a field error when password is missing or longer
+// than bcrypt accepts.
+func validatePassword(fe fieldErrors, field, password string) {
+	switch {
+	case password == "":
+		fe.add(field, "required")
+	case len(password) > maxPasswordBytes:
+		fe.add(field, "too long")
+	}
+}
+
+// validateNewPassword applies the stricter rules for a password chosen
+// through the change-password endpoint.
+func validateNewPassword(fe fieldErrors, field, password, current string) {
+	validatePassword(fe, field, password)
+	switch {
+	case utf8.RuneCountInString(password) < minPasswordLength:
+		fe.add(field, "too short")
+	case password == current:
+		fe.add(field, "must differ from the current password")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "net/http"
+
+// Build information, stamped in at link time, e.g.
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// -X can only set string variables initialized to constants, so keep them
+// that way.
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// versionHandler reports which build is running.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Version   string `json:"version"`
+		Commit    string `json:"commit"`
+		BuildTime string `json:"build_time"`
+	}
+	respondJSON(w, http.StatusOK, response{Version: version, Commit: commit, BuildTime: buildTime})
+}